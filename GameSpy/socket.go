@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"sync"
 
 	"../log"
 )
@@ -11,6 +12,7 @@ import (
 // Socket is a basic event-based TCP-Server
 type Socket struct {
 	Clients   []*Client
+	clientsMu sync.Mutex
 	name      string
 	port      string
 	listen    net.Listener
@@ -132,7 +134,9 @@ func (socket *Socket) run() {
 		}
 		go socket.handleClientEvents(newClient, clientEventSocket)
 
+		socket.clientsMu.Lock()
 		socket.Clients = append(socket.Clients, newClient)
+		socket.clientsMu.Unlock()
 
 		// Fire newClient event
 		socket.eventChan <- SocketEvent{
@@ -144,6 +148,16 @@ func (socket *Socket) run() {
 	}
 }
 
+// GetClients returns a copy of the connected clients, safe to range over from any goroutine
+func (socket *Socket) GetClients() []*Client {
+	socket.clientsMu.Lock()
+	defer socket.clientsMu.Unlock()
+
+	clients := make([]*Client, len(socket.Clients))
+	copy(clients, socket.Clients)
+	return clients
+}
+
 func (socket *Socket) removeClient(client *Client) error {
 	var indexToRemove = 0
 	var foundClient = false
@@ -153,6 +167,9 @@ func (socket *Socket) removeClient(client *Client) error {
 	client.IsActive = false
 	(*client.conn).Close()
 
+	socket.clientsMu.Lock()
+	defer socket.clientsMu.Unlock()
+
 	for i := range socket.Clients {
 		if socket.Clients[i] == client {
 			indexToRemove = i
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"sync"
 
 	"time"
 
@@ -14,6 +15,7 @@ import (
 // Socket is a basic event-based TCP-Server
 type SocketTLS struct {
 	ClientsTLS []*ClientTLS
+	clientsMu  sync.Mutex
 	name       string
 	port       string
 	listen     net.Listener
@@ -157,7 +159,9 @@ func (socket *SocketTLS) run() {
 			go socket.handleClientEvents(newClient, clientEventSocket)
 
 			log.Noteln(socket.name + ": A new client connected")
+			socket.clientsMu.Lock()
 			socket.ClientsTLS = append(socket.ClientsTLS, newClient)
+			socket.clientsMu.Unlock()
 
 			// Fire newClient event
 			socket.eventChan <- SocketEvent{
@@ -170,6 +174,16 @@ func (socket *SocketTLS) run() {
 	}
 }
 
+// GetClients returns a copy of the connected clients, safe to range over from any goroutine
+func (socket *SocketTLS) GetClients() []*ClientTLS {
+	socket.clientsMu.Lock()
+	defer socket.clientsMu.Unlock()
+
+	clients := make([]*ClientTLS, len(socket.ClientsTLS))
+	copy(clients, socket.ClientsTLS)
+	return clients
+}
+
 func (socket *SocketTLS) removeClient(client *ClientTLS) error {
 	var indexToRemove = 0
 	var foundClient = false
@@ -179,6 +193,9 @@ func (socket *SocketTLS) removeClient(client *ClientTLS) error {
 	client.IsActive = false
 	(*client.conn).Close()
 
+	socket.clientsMu.Lock()
+	defer socket.clientsMu.Unlock()
+
 	for i := range socket.ClientsTLS {
 		if socket.ClientsTLS[i] == client {
 			indexToRemove = i
@@ -2,7 +2,9 @@ package GameSpy
 
 import (
 	"crypto/md5"
+	cryptoRand "crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"math/big"
@@ -59,6 +61,19 @@ var CrcLookup = []rune{
 
 var randSrc = rand.NewSource(time.Now().UnixNano())
 
+// cryptoSource is a rand.Source reading from crypto/rand, safe for concurrent use
+type cryptoSource struct{}
+
+func (cryptoSource) Int63() int64 {
+	var b [8]byte
+	if _, err := cryptoRand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) & (1<<63 - 1))
+}
+
+func (cryptoSource) Seed(seed int64) {}
+
 // Command struct
 type Command struct {
 	Message map[string]string
@@ -126,6 +141,12 @@ func BF2RandomUnsafe(randomLen int) string {
 	return BF2Random(randomLen, randSrc)
 }
 
+// BF2RandomSecure generates a random string with valid BF2 random chars using crypto/rand.
+// Use it for anything a client must not be able to guess, like lkeys.
+func BF2RandomSecure(randomLen int) string {
+	return BF2Random(randomLen, cryptoSource{})
+}
+
 // BF2Random generates a random string with valid BF2 random chars
 // https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-golang/31832326
 func BF2Random(randomLen int, source rand.Source) string {
@@ -60,3 +60,15 @@ func TestBF2RandomUnsafe(t *testing.T) {
 	}
 
 }
+
+func TestBF2RandomSecure(t *testing.T) {
+	rand1 := GameSpy.BF2RandomSecure(24)
+	rand2 := GameSpy.BF2RandomSecure(24)
+	if rand1 == rand2 {
+		t.Errorf("TestBF2RandomSecure was incorrect, got same value twice: %s, %s.", rand1, rand2)
+	}
+
+	if len(rand1) != 24 || len(rand2) != 24 {
+		t.Errorf("TestBF2RandomSecure was incorrect, got wrong length: %s, %s.", rand1, rand2)
+	}
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NeonRG/RG_Backend-V2/auth"
+	"github.com/NeonRG/RG_Backend-V2/log"
+	"github.com/NeonRG/RG_Backend-V2/matchmaking"
+	"github.com/NeonRG/RG_Backend-V2/moderation"
+	"github.com/NeonRG/RG_Backend-V2/stats"
+	"github.com/NeonRG/RG_Backend-V2/theater"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+)
+
+// registerAdminRoutes - the admin API used by our web panel and tooling
+func registerAdminRoutes(r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+
+	admin.HandleFunc("/users/{userID}/sessions", adminOnly(listSessionsHandler)).Methods("GET")
+	admin.HandleFunc("/users/{userID}/sessions", adminOnly(logoutUserHandler)).Methods("DELETE")
+	admin.HandleFunc("/sessions/{lkey}", adminOnly(revokeSessionHandler)).Methods("DELETE")
+
+	admin.HandleFunc("/users/{userID}/roles", adminOnly(listRolesHandler)).Methods("GET")
+	admin.HandleFunc("/users/{userID}/roles/{role}", adminOnly(grantRoleHandler)).Methods("PUT")
+	admin.HandleFunc("/users/{userID}/roles/{role}", adminOnly(revokeRoleHandler)).Methods("DELETE")
+	admin.HandleFunc("/permissions/cache", adminOnly(flushPermissionsHandler)).Methods("DELETE")
+
+	admin.HandleFunc("/bans", adminOnly(listBansHandler)).Methods("GET")
+	admin.HandleFunc("/bans", adminOnly(addBanHandler)).Methods("POST")
+	admin.HandleFunc("/bans/{id}", adminOnly(liftBanHandler)).Methods("DELETE")
+
+	admin.HandleFunc("/heroes/{heroID}/stats/history", adminOnly(statsHistoryHandler)).Methods("GET")
+	admin.HandleFunc("/heroes/{heroID}/stats/rollback", adminOnly(statsRollbackHandler)).Methods("POST")
+	admin.HandleFunc("/heroes/{heroID}/stats/cache", adminOnly(statsInvalidateHandler)).Methods("DELETE")
+	admin.HandleFunc("/heroes/{heroID}/stats/consistency", adminOnly(statsConsistencyHandler)).Methods("GET")
+
+	admin.HandleFunc("/seasons", adminOnly(listSeasonsHandler)).Methods("GET")
+	admin.HandleFunc("/seasons", adminOnly(addSeasonHandler)).Methods("POST")
+	admin.HandleFunc("/seasons/{id}/end", adminOnly(endSeasonHandler)).Methods("POST")
+
+	admin.HandleFunc("/lobbies", adminOnly(listLobbiesHandler)).Methods("GET")
+	admin.HandleFunc("/lobbies", adminOnly(addLobbyHandler)).Methods("POST")
+	admin.HandleFunc("/lobbies/{lid}/games", adminOnly(lobbyGamesHandler)).Methods("GET")
+
+	admin.HandleFunc("/games/{gid}/players", adminOnly(gamePlayersHandler)).Methods("GET")
+	admin.HandleFunc("/games/{gid}/players/{heroID}/kick", adminOnly(kickHandler)).Methods("POST")
+	admin.HandleFunc("/games/{gid}/announcements", adminOnly(announceToGameHandler)).Methods("POST")
+	admin.HandleFunc("/announcements", adminOnly(announceHandler)).Methods("POST")
+	admin.HandleFunc("/servers/{serverID}/bans", adminOnly(listServerBansHandler)).Methods("GET")
+	admin.HandleFunc("/servers/{serverID}/bans", adminOnly(addServerBanHandler)).Methods("POST")
+	admin.HandleFunc("/servers/{serverID}/bans/{heroID}", adminOnly(liftServerBanHandler)).Methods("DELETE")
+	admin.HandleFunc("/games/{gid}/reservations", adminOnly(listReservationsHandler)).Methods("GET")
+	admin.HandleFunc("/games/{gid}/reservations", adminOnly(addReservationsHandler)).Methods("POST")
+	admin.HandleFunc("/games/{gid}/reservations/{heroID}", adminOnly(cancelReservationHandler)).Methods("DELETE")
+	admin.HandleFunc("/games/{gid}/whitelist", adminOnly(listWhitelistHandler)).Methods("GET")
+	admin.HandleFunc("/games/{gid}/whitelist/{heroID}", adminOnly(whitelistHeroHandler)).Methods("PUT")
+	admin.HandleFunc("/games/{gid}/whitelist/{heroID}", adminOnly(unwhitelistHeroHandler)).Methods("DELETE")
+}
+
+// adminOnly - only lets requests through that carry the configured X-ADMIN-KEY
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminKey := r.Header.Get("X-ADMIN-KEY")
+		if MyConfig.AdminKey == "" || subtle.ConstantTimeCompare([]byte(adminKey), []byte(MyConfig.AdminKey)) != 1 {
+			log.Noteln("Refused admin request to " + r.URL.Path + " from " + r.RemoteAddr)
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Errorln("Failed writing admin answer", err)
+	}
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	writeJSON(w, http.StatusOK, sessions.List(vars["userID"]))
+}
+
+// logoutUserHandler - force-logout, revokes every session of the account
+func logoutUserHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	revoked := sessions.RevokeUser(vars["userID"])
+
+	log.Noteln("Admin logged out user", vars["userID"], "revoked", revoked, "sessions")
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := sessions.Revoke(vars["lkey"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": 1})
+}
+
+func listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	roles, err := permissions.Roles(vars["userID"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, roles)
+}
+
+func grantRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	changeRole(w, vars["userID"], vars["role"], permissions.Grant)
+}
+
+func revokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	changeRole(w, vars["userID"], vars["role"], permissions.Revoke)
+}
+
+func changeRole(w http.ResponseWriter, userID string, role string, change func(string, string) error) {
+	err := change(userID, role)
+	switch err {
+	case nil:
+		log.Noteln("Admin changed role " + role + " of user " + userID)
+		writeJSON(w, http.StatusOK, map[string]string{"userID": userID, "role": role})
+	case auth.ErrRoleNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+// flushPermissionsHandler - for roles changed directly in the database
+func flushPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	err := permissions.Invalidate("*")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"flushed": true})
+}
+
+// listBansHandler - active bans, or the full history of one target with ?type=&target=
+func listBansHandler(w http.ResponseWriter, r *http.Request) {
+	var list []*moderation.Ban
+	var err error
+
+	if r.URL.Query().Get("target") != "" {
+		list, err = bans.History(r.URL.Query().Get("type"), r.URL.Query().Get("target"))
+	} else {
+		list, err = bans.Active()
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+type banRequest struct {
+	Type        string `json:"type"`
+	Target      string `json:"target"`
+	Reason      string `json:"reason"`
+	ModeratorID string `json:"moderatorID"`
+	// Duration in seconds, 0 for a permanent ban
+	Duration int64 `json:"duration"`
+}
+
+func addBanHandler(w http.ResponseWriter, r *http.Request) {
+	var request banRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.ModeratorID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "type, target and moderatorID are required"})
+		return
+	}
+
+	ban := &moderation.Ban{
+		Type:        request.Type,
+		Target:      request.Target,
+		Reason:      request.Reason,
+		ModeratorID: request.ModeratorID,
+	}
+	if request.Duration > 0 {
+		ban.ExpiresAt = time.Now().Unix() + request.Duration
+	}
+
+	err = bans.Add(ban)
+	switch err {
+	case nil:
+		// The lkeys of the account and its game servers must not outlive the ban
+		if ban.Type == moderation.BanAccount {
+			sessions.RevokeUser(ban.Target)
+		}
+		writeJSON(w, http.StatusCreated, ban)
+	case moderation.ErrInvalidBan:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func liftBanHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := bans.Lift(vars["id"])
+	switch err {
+	case nil:
+		log.Noteln("Admin lifted ban " + vars["id"])
+		writeJSON(w, http.StatusOK, map[string]string{"lifted": vars["id"]})
+	case moderation.ErrBanNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+// statsHistoryHandler - the latest stat changes of a hero, ?limit= defaults to 100
+func statsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	history, err := statsStore.History(vars["heroID"], limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+type rollbackRequest struct {
+	// To is the unix timestamp the stats are restored to
+	To          int64  `json:"to"`
+	ModeratorID string `json:"moderatorID"`
+}
+
+// statsRollbackHandler - restores all stats of a hero to a point in time
+func statsRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var request rollbackRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.To <= 0 || request.ModeratorID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "to and moderatorID are required"})
+		return
+	}
+
+	keys, err := statsStore.Rollback(vars["heroID"], time.Unix(request.To, 0), stats.WriterAdmin+":"+request.ModeratorID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Noteln("Admin " + request.ModeratorID + " rolled back stats of hero " + vars["heroID"])
+	writeJSON(w, http.StatusOK, map[string][]string{"restored": keys})
+}
+
+// statsInvalidateHandler - call after editing game_stats of a hero directly in the database
+func statsInvalidateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := statsStore.Invalidate(vars["heroID"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"invalidated": vars["heroID"]})
+}
+
+// statsConsistencyHandler - lists the stats of a hero whose cached value differs from MySQL
+func statsConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	mismatches, err := statsStore.Verify(vars["heroID"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if mismatches == nil {
+		mismatches = []stats.Mismatch{}
+	}
+
+	writeJSON(w, http.StatusOK, mismatches)
+}
+
+func listSeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := seasons.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+type seasonRequest struct {
+	Name string `json:"name"`
+	// Unix timestamps
+	StartsAt int64 `json:"startsAt"`
+	EndsAt   int64 `json:"endsAt"`
+}
+
+// addSeasonHandler - schedules a season, it ends on its own at endsAt
+func addSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	var request seasonRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Name == "" || request.EndsAt <= request.StartsAt {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name, startsAt and a later endsAt are required"})
+		return
+	}
+
+	season, err := seasons.Add(request.Name, time.Unix(request.StartsAt, 0), time.Unix(request.EndsAt, 0))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Noteln("Admin scheduled season " + season.Name)
+	writeJSON(w, http.StatusCreated, season)
+}
+
+// endSeasonHandler - ends a season right away: archive, rewards and reset
+func endSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid season id"})
+		return
+	}
+
+	err = seasons.End(id)
+	switch err {
+	case nil:
+		log.Noteln("Admin ended season " + vars["id"])
+		writeJSON(w, http.StatusOK, map[string]string{"ended": vars["id"]})
+	case stats.ErrSeasonNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case stats.ErrSeasonArchived, stats.ErrSeasonEnding:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func listLobbiesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := lobbies.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// addLobbyHandler - creates a lobby, LLST lists it right away
+func addLobbyHandler(w http.ResponseWriter, r *http.Request) {
+	lobby := &matchmaking.Lobby{Locale: "en_US", MaxGames: 10000}
+	err := json.NewDecoder(r.Body).Decode(lobby)
+	if err != nil || lobby.Name == "" || lobby.MaxGames <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name and a positive maxGames are required"})
+		return
+	}
+
+	err = lobbies.Add(lobby)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Noteln("Admin added lobby " + lobby.Name)
+	writeJSON(w, http.StatusCreated, lobby)
+}
+
+// lobbyGamesHandler - the live games of all shards in a lobby, with their players
+func lobbyGamesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := lobbies.Get(vars["lid"]); err != nil {
+		status := http.StatusInternalServerError
+		if err == matchmaking.ErrLobbyNotFound {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	games := []*matchmaking.Game{}
+	for _, game := range lobbies.Games(vars["lid"]) {
+		players, err := matchmaking.FullRoster(redisClient, game.GID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		game.Players = players
+		games = append(games, game)
+	}
+
+	writeJSON(w, http.StatusOK, games)
+}
+
+// gamePlayersHandler - who plays on a game of any shard, since when and what its server reported about them
+func gamePlayersHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if matchmaking.Games.Get(vars["gid"]) == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "game not found"})
+		return
+	}
+
+	players, err := matchmaking.FullRoster(redisClient, vars["gid"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if players == nil {
+		players = []matchmaking.Player{}
+	}
+
+	writeJSON(w, http.StatusOK, players)
+}
+
+// kickHandler - has the server of a game drop one of its players, on whatever shard it is connected to
+func kickHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := theater.Kick(redisClient, vars["gid"], vars["heroID"])
+	switch err {
+	case nil:
+		log.Noteln("Admin kicked hero " + vars["heroID"] + " from game " + vars["gid"])
+		writeJSON(w, http.StatusOK, map[string]string{"kicked": vars["heroID"]})
+	case theater.ErrGameNotFound, theater.ErrNotInGame:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func announceToGameHandler(w http.ResponseWriter, r *http.Request) {
+	announce(w, r, mux.Vars(r)["gid"])
+}
+
+// announceHandler - sends a message to every client connected to any shard
+func announceHandler(w http.ResponseWriter, r *http.Request) {
+	announce(w, r, "")
+}
+
+func announce(w http.ResponseWriter, r *http.Request, gid string) {
+	announcement := &theater.Announcement{Type: theater.AnnounceSystem}
+	err := json.NewDecoder(r.Body).Decode(announcement)
+	if err != nil || announcement.Text == "" ||
+		(announcement.Type != theater.AnnounceSystem && announcement.Type != theater.AnnounceChat) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "text is required, type is chat or system"})
+		return
+	}
+	announcement.GID = gid
+
+	err = theater.Announce(redisClient, announcement)
+	switch err {
+	case nil:
+		log.Noteln("Admin announced to " + gid + ": " + announcement.Text)
+		writeJSON(w, http.StatusOK, announcement)
+	case theater.ErrGameNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+// listServerBansHandler - the heroes banned from one game server
+func listServerBansHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	list, err := serverBans.Active(vars["serverID"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+type serverBanRequest struct {
+	HeroID      string `json:"heroID"`
+	Reason      string `json:"reason"`
+	ModeratorID string `json:"moderatorID"`
+	// Duration in seconds, 0 for a permanent ban
+	Duration int64 `json:"duration"`
+}
+
+// addServerBanHandler - bans a hero from a game server and kicks it if it plays there
+func addServerBanHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var request serverBanRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.ModeratorID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "heroID and moderatorID are required"})
+		return
+	}
+
+	ban := &moderation.ServerBan{
+		ServerID:    vars["serverID"],
+		HeroID:      request.HeroID,
+		Reason:      request.Reason,
+		ModeratorID: request.ModeratorID,
+	}
+	if request.Duration > 0 {
+		ban.ExpiresAt = time.Now().Unix() + request.Duration
+	}
+
+	err = serverBans.Add(ban)
+	if err == moderation.ErrInvalidBan {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if gid := matchmaking.GameOfServer(redisClient, ban.ServerID); gid != "" {
+		err = theater.Kick(redisClient, gid, ban.HeroID)
+		if err != nil && err != theater.ErrNotInGame {
+			log.Errorln("Failed kicking hero "+ban.HeroID+" banned from server "+ban.ServerID, err)
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func liftServerBanHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := serverBans.Lift(vars["serverID"], vars["heroID"])
+	switch err {
+	case nil:
+		log.Noteln("Admin lifted the ban of hero " + vars["heroID"] + " from server " + vars["serverID"])
+		writeJSON(w, http.StatusOK, map[string]string{"lifted": vars["heroID"]})
+	case moderation.ErrBanNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func listReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	list, err := matchmaking.Reservations(redisClient, vars["gid"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+type reservationRequest struct {
+	HeroIDs []string `json:"heroIDs"`
+	// Duration in seconds, defaults to the reservation timeout of parties
+	Duration int64 `json:"duration"`
+}
+
+// addReservationsHandler - holds slots on a game for a list of heroes, used by tournament tooling
+func addReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var request reservationRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || len(request.HeroIDs) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "heroIDs are required"})
+		return
+	}
+	if matchmaking.Games.Get(vars["gid"]) == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "game not found"})
+		return
+	}
+
+	ttl := matchmaking.ReservationTimeout
+	if request.Duration > 0 {
+		ttl = time.Second * time.Duration(request.Duration)
+	}
+
+	err = matchmaking.ReserveFor(redisClient, vars["gid"], request.HeroIDs, ttl)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Noteln("Admin reserved " + strconv.Itoa(len(request.HeroIDs)) + " slots on game " + vars["gid"])
+	listReservationsHandler(w, r)
+}
+
+func cancelReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := matchmaking.ReleaseReservation(redisClient, vars["gid"], vars["heroID"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"cancelled": vars["heroID"]})
+}
+
+// listWhitelistHandler - the heroes that may use the reserved slots of a game, besides admins
+func listWhitelistHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	list, err := matchmaking.Whitelist(redisClient, vars["gid"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func whitelistHeroHandler(w http.ResponseWriter, r *http.Request) {
+	changeWhitelist(w, r, matchmaking.AddToWhitelist)
+}
+
+func unwhitelistHeroHandler(w http.ResponseWriter, r *http.Request) {
+	changeWhitelist(w, r, matchmaking.RemoveFromWhitelist)
+}
+
+func changeWhitelist(w http.ResponseWriter, r *http.Request, change func(*redis.Client, string, string) error) {
+	vars := mux.Vars(r)
+
+	err := change(redisClient, vars["gid"], vars["heroID"])
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	listWhitelistHandler(w, r)
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// MaxLoginAttempts - failed logins allowed before an account gets locked
+	MaxLoginAttempts = 5
+	// LockoutDuration - how long an account stays locked after too many failed logins
+	LockoutDuration = time.Minute * 15
+	// BcryptCost - cost used when hashing new passwords
+	BcryptCost = bcrypt.DefaultCost
+)
+
+var (
+	// ErrUserNotFound - no account matches the given nuid
+	ErrUserNotFound = errors.New("user not found")
+	// ErrWrongPassword - the password does not match the stored hash
+	ErrWrongPassword = errors.New("password incorrect")
+	// ErrLockedOut - too many failed attempts, account is temporarily locked
+	ErrLockedOut = errors.New("account locked")
+	// ErrNoPassword - the account has no password set and can only use game tokens
+	ErrNoPassword = errors.New("no password set")
+)
+
+// User - the account data needed to establish a session
+type User struct {
+	ID        string
+	Username  string
+	Email     string
+	Birthday  string
+	Language  string
+	Country   string
+	GameToken string
+}
+
+// Credentials - verifies nuid/password logins against the users table
+type Credentials struct {
+	db    *sql.DB
+	redis *redis.Client
+
+	// Database Statements
+	stmtGetUserByNuid   *sql.Stmt
+	stmtSetUserPassword *sql.Stmt
+}
+
+// New prepares the statements used by the credential store
+func (c *Credentials) New(db *sql.DB, redis *redis.Client) {
+	var err error
+
+	c.db = db
+	c.redis = redis
+
+	c.stmtGetUserByNuid, err = c.db.Prepare(
+		"SELECT id, username, email, birthday, language, country, game_token, IFNULL(password, '')" +
+			"	FROM users" +
+			"	WHERE username = ? OR email = ?" +
+			"	LIMIT 1")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetUserByNuid.", err.Error())
+	}
+
+	c.stmtSetUserPassword, err = c.db.Prepare(
+		"UPDATE users SET" +
+			"	password = ?," +
+			"	updated_at = NOW()" +
+			"	WHERE id = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtSetUserPassword.", err.Error())
+	}
+}
+
+// Verify checks nuid (username or email) and password and returns the matching user.
+// Failed attempts are counted per nuid and lock the account once MaxLoginAttempts is reached.
+func (c *Credentials) Verify(nuid string, password string) (*User, error) {
+	if c.isLockedOut(nuid) {
+		return nil, ErrLockedOut
+	}
+
+	var hash string
+	user := new(User)
+	err := c.stmtGetUserByNuid.QueryRow(nuid, nuid).Scan(&user.ID, &user.Username, &user.Email, &user.Birthday, &user.Language, &user.Country, &user.GameToken, &hash)
+	if err == sql.ErrNoRows {
+		c.registerFailure(nuid)
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hash == "" {
+		return nil, ErrNoPassword
+	}
+
+	if !CheckPassword(hash, password) {
+		c.registerFailure(nuid)
+		return nil, ErrWrongPassword
+	}
+
+	c.redis.Del(failureKey(nuid))
+
+	// Upgrade bcrypt hashes created with a lower cost than we use now
+	if NeedsRehash(hash) {
+		newHash, err := HashPassword(password)
+		if err == nil {
+			c.stmtSetUserPassword.Exec(newHash, user.ID)
+		}
+	}
+
+	return user, nil
+}
+
+// SetPassword stores a freshly hashed password for the given user
+func (c *Credentials) SetPassword(userID string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.stmtSetUserPassword.Exec(hash, userID)
+	return err
+}
+
+// Unlock removes the failed-attempt counter for nuid
+func (c *Credentials) Unlock(nuid string) error {
+	return c.redis.Del(failureKey(nuid)).Err()
+}
+
+func (c *Credentials) isLockedOut(nuid string) bool {
+	attempts, err := c.redis.Get(failureKey(nuid)).Int()
+	if err != nil {
+		return false
+	}
+
+	return attempts >= MaxLoginAttempts
+}
+
+func (c *Credentials) registerFailure(nuid string) {
+	attempts, err := c.redis.Incr(failureKey(nuid)).Result()
+	if err != nil {
+		log.Errorln("Failed counting login failure for "+nuid, err.Error())
+		return
+	}
+
+	// Every failure restarts the lockout window
+	c.redis.Expire(failureKey(nuid), LockoutDuration)
+
+	if int(attempts) == MaxLoginAttempts {
+		log.Noteln("Locking account " + nuid + " after " + strconv.Itoa(MaxLoginAttempts) + " failed logins")
+	}
+}
+
+func failureKey(nuid string) string {
+	return "loginFailures:" + strings.ToLower(nuid)
+}
+
+// HashPassword creates a bcrypt hash for new passwords
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+	return string(hash), err
+}
+
+// CheckPassword compares password to a bcrypt ($2a$, $2b$, $2y$) or argon2id ($argon2id$) hash
+func CheckPassword(hash string, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, password)
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NeedsRehash reports whether hash should be replaced by a fresh HashPassword result
+func NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return false
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+
+	return cost < BcryptCost
+}
+
+// checkArgon2id verifies hashes in the PHC format used by PHP's password_hash:
+// $argon2id$v=19$m=65536,t=4,p=1$<salt>$<hash>
+func checkArgon2id(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+
+	return subtle.ConstantTimeCompare(expected, actual) == 1
+}
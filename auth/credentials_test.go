@@ -0,0 +1,57 @@
+package auth_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"./auth"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := auth.HashPassword("SuperDuperSecretPassword")
+	if err != nil {
+		t.Errorf("HashPassword was incorrect, got error: %s", err)
+	}
+
+	if !auth.CheckPassword(hash, "SuperDuperSecretPassword") {
+		t.Errorf("CheckPassword was incorrect, rejected the password %s was created from.", hash)
+	}
+	if auth.CheckPassword(hash, "superdupersecretpassword") {
+		t.Errorf("CheckPassword was incorrect, accepted a wrong password for %s.", hash)
+	}
+	if auth.NeedsRehash(hash) {
+		t.Errorf("NeedsRehash was incorrect, fresh hash %s needs a rehash.", hash)
+	}
+}
+
+func TestCheckPasswordLaravelBcrypt(t *testing.T) {
+	// Laravel/PHP writes $2y$ hashes
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	hash[2] = 'y'
+
+	if !auth.CheckPassword(string(hash), "secret") {
+		t.Errorf("CheckPassword was incorrect, rejected $2y$ hash %s.", hash)
+	}
+	if !auth.NeedsRehash(string(hash)) {
+		t.Errorf("NeedsRehash was incorrect, hash %s with cost %d was not upgraded.", hash, bcrypt.MinCost)
+	}
+}
+
+func TestCheckPasswordArgon2id(t *testing.T) {
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("secret"), salt, 2, 1024, 1, 32)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=2,p=1$%s$%s", argon2.Version, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	if !auth.CheckPassword(hash, "secret") {
+		t.Errorf("CheckPassword was incorrect, rejected argon2id hash %s.", hash)
+	}
+	if auth.CheckPassword(hash, "wrong") {
+		t.Errorf("CheckPassword was incorrect, accepted a wrong password for %s.", hash)
+	}
+	if auth.CheckPassword("$argon2id$v=19$broken", "secret") {
+		t.Errorf("CheckPassword was incorrect, accepted a malformed hash.")
+	}
+}
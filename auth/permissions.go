@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// Permission slugs checked by the backend
+const (
+	PermissionLogin     = "game.login"
+	PermissionMatchmake = "game.matchmake"
+	PermissionServer    = "game.server"
+	// PermissionReservedSlot - may join games on the slots their servers keep free for admins
+	PermissionReservedSlot = "game.reservedslot"
+)
+
+// PermissionsChannel - redis pub/sub channel announcing changed roles, the payload is a user id or "*"
+const PermissionsChannel = "permissions:invalidate"
+
+// PermissionCacheTTL - how long looked up permissions are kept in memory
+var PermissionCacheTTL = time.Minute * 5
+
+// ErrRoleNotFound - there is no role with that slug
+var ErrRoleNotFound = errors.New("role not found")
+
+type permissionEntry struct {
+	slugs   map[string]bool
+	expires time.Time
+}
+
+// Permissions - resolves permissions through roles, permission_role and role_user
+type Permissions struct {
+	db    *sql.DB
+	redis *redis.Client
+	cache map[string]*permissionEntry
+	mutex sync.RWMutex
+
+	// Database Statements
+	stmtGetPermissionsByUserID *sql.Stmt
+	stmtGetRolesByUserID       *sql.Stmt
+	stmtGetRoleBySlug          *sql.Stmt
+	stmtAddRoleToUser          *sql.Stmt
+	stmtRemoveRoleFromUser     *sql.Stmt
+}
+
+// New prepares the statements and starts listening for invalidations from other shards
+func (p *Permissions) New(db *sql.DB, redis *redis.Client) {
+	var err error
+
+	p.db = db
+	p.redis = redis
+	p.cache = make(map[string]*permissionEntry)
+
+	p.stmtGetPermissionsByUserID, err = p.db.Prepare(
+		"SELECT DISTINCT permissions.slug" +
+			"	FROM role_user" +
+			"	LEFT JOIN permission_role" +
+			"		ON permission_role.role_id=role_user.role_id" +
+			"	LEFT JOIN permissions" +
+			"		ON permissions.id=permission_role.permission_id" +
+			"	WHERE role_user.user_id = ?" +
+			"		AND permissions.slug IS NOT NULL")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetPermissionsByUserID.", err.Error())
+	}
+
+	p.stmtGetRolesByUserID, err = p.db.Prepare(
+		"SELECT roles.id, roles.slug, roles.name" +
+			"	FROM role_user" +
+			"	LEFT JOIN roles" +
+			"		ON roles.id=role_user.role_id" +
+			"	WHERE role_user.user_id = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetRolesByUserID.", err.Error())
+	}
+
+	p.stmtGetRoleBySlug, err = p.db.Prepare(
+		"SELECT id FROM roles WHERE slug = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetRoleBySlug.", err.Error())
+	}
+
+	p.stmtAddRoleToUser, err = p.db.Prepare(
+		"INSERT IGNORE INTO role_user" +
+			"	(role_id, user_id, created_at, updated_at)" +
+			"	VALUES (?, ?, NOW(), NOW())")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddRoleToUser.", err.Error())
+	}
+
+	p.stmtRemoveRoleFromUser, err = p.db.Prepare(
+		"DELETE FROM role_user WHERE role_id = ? AND user_id = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtRemoveRoleFromUser.", err.Error())
+	}
+
+	go p.listenForInvalidations()
+}
+
+// Has reports whether the user has a role granting slug. Lookup errors deny.
+func (p *Permissions) Has(userID string, slug string) bool {
+	if userID == "" {
+		return false
+	}
+
+	p.mutex.RLock()
+	entry, ok := p.cache[userID]
+	p.mutex.RUnlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		slugs, err := p.load(userID)
+		if err != nil {
+			log.Errorln("Failed loading permissions for user "+userID, err.Error())
+			return false
+		}
+
+		entry = &permissionEntry{
+			slugs:   slugs,
+			expires: time.Now().Add(PermissionCacheTTL),
+		}
+
+		p.mutex.Lock()
+		p.cache[userID] = entry
+		p.mutex.Unlock()
+	}
+
+	return entry.slugs[slug]
+}
+
+// Role - a role assigned to a user
+type Role struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// Roles lists the roles of a user
+func (p *Permissions) Roles(userID string) ([]Role, error) {
+	rows, err := p.stmtGetRolesByUserID.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.ID, &role.Slug, &role.Name)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// Grant gives the role with roleSlug to a user
+func (p *Permissions) Grant(userID string, roleSlug string) error {
+	roleID, err := p.roleID(roleSlug)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.stmtAddRoleToUser.Exec(roleID, userID)
+	if err != nil {
+		return err
+	}
+
+	return p.Invalidate(userID)
+}
+
+// Revoke takes the role with roleSlug away from a user
+func (p *Permissions) Revoke(userID string, roleSlug string) error {
+	roleID, err := p.roleID(roleSlug)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.stmtRemoveRoleFromUser.Exec(roleID, userID)
+	if err != nil {
+		return err
+	}
+
+	return p.Invalidate(userID)
+}
+
+// Invalidate drops the cached permissions of userID ("*" for everyone) on every shard
+func (p *Permissions) Invalidate(userID string) error {
+	p.drop(userID)
+	return p.redis.Publish(PermissionsChannel, userID).Err()
+}
+
+func (p *Permissions) drop(userID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if userID == "*" {
+		p.cache = make(map[string]*permissionEntry)
+		return
+	}
+
+	delete(p.cache, userID)
+}
+
+func (p *Permissions) listenForInvalidations() {
+	pubsub := p.redis.Subscribe(PermissionsChannel)
+	for msg := range pubsub.Channel() {
+		p.drop(msg.Payload)
+	}
+}
+
+func (p *Permissions) load(userID string) (map[string]bool, error) {
+	rows, err := p.stmtGetPermissionsByUserID.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slugs := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		err := rows.Scan(&slug)
+		if err != nil {
+			return nil, err
+		}
+		slugs[slug] = true
+	}
+
+	return slugs, rows.Err()
+}
+
+func (p *Permissions) roleID(roleSlug string) (int, error) {
+	var roleID int
+	err := p.stmtGetRoleBySlug.QueryRow(roleSlug).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		return 0, ErrRoleNotFound
+	}
+
+	return roleID, err
+}
@@ -0,0 +1,406 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"../GameSpy"
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// Session policies, applied when an account or hero logs in while already having a session
+const (
+	// PolicyKick revokes the older sessions and lets the new login through
+	PolicyKick = "kick"
+	// PolicyRefuse keeps the older sessions and refuses the new login
+	PolicyRefuse = "refuse"
+	// PolicyAllow allows any number of sessions in parallel
+	PolicyAllow = "allow"
+)
+
+// RevokedChannel - redis pub/sub channel announcing revoked lkeys to every shard
+const RevokedChannel = "sessions:revoked"
+
+// PingPrefix - followed by a ping site, the session and connection state field holding the latency to it
+const PingPrefix = "ping:"
+
+var (
+	// SessionTTL - lkeys expire after this long without being used
+	SessionTTL = time.Minute * 30
+	// SessionPolicy - one of PolicyKick, PolicyRefuse or PolicyAllow
+	SessionPolicy = PolicyKick
+)
+
+var (
+	// ErrSessionNotFound - the lkey is unknown, expired or revoked
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionActive - the account or hero is already logged in and SessionPolicy refuses a second login
+	ErrSessionActive = errors.New("session already active")
+)
+
+// Session - a lkey and the identity it was issued for
+type Session struct {
+	LKey      string `json:"lkey"`
+	ID        string `json:"id"`
+	UserID    string `json:"userID"`
+	HeroID    string `json:"heroID,omitempty"`
+	ServerID  string `json:"serverID,omitempty"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"createdAt"`
+	TTL       int    `json:"ttl"`
+
+	// PingSite is the ping site closest to the client, "" until it measured them
+	PingSite string `json:"pingSite,omitempty"`
+	// Pings are the latencies in ms the client measured to the ping sites
+	Pings map[string]int `json:"pings,omitempty"`
+}
+
+// Sessions - keeps track of the lkeys handed out by NuLogin/NuLoginPersona
+type Sessions struct {
+	redis *redis.Client
+}
+
+// New sets up the session store
+func (s *Sessions) New(redis *redis.Client) {
+	s.redis = redis
+}
+
+// createScript applies the session policy and stores the new session in one step, so two logins
+// can't both pass the policy check. KEYS are the set the policy applies to, the new session, the
+// set of the owning account (its server set for server sessions) and the hero or server set ("" for
+// account sessions). ARGV is the policy, the lkey, the TTL in
+// seconds, the number of lkeys to keep followed by them, and the field/value pairs of the session.
+// Returns the kicked lkeys, or false if the policy refuses the login.
+var createScript = redis.NewScript(`
+local keep = {}
+local count = tonumber(ARGV[4])
+for i = 1, count do
+	keep[ARGV[4 + i]] = true
+end
+
+local kicked = {}
+if ARGV[1] ~= "allow" then
+	for _, lkey in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+		if redis.call("EXISTS", "lkeys:" .. lkey) == 0 then
+			redis.call("SREM", KEYS[1], lkey)
+		elseif not keep[lkey] then
+			if ARGV[1] == "refuse" then
+				return false
+			end
+			table.insert(kicked, lkey)
+		end
+	end
+end
+
+for _, lkey in ipairs(kicked) do
+	local owner = redis.call("HMGET", "lkeys:" .. lkey, "userID", "heroID")
+	redis.call("DEL", "lkeys:" .. lkey)
+	if owner[1] then
+		redis.call("SREM", "sessions:user:" .. owner[1], lkey)
+	end
+	if owner[2] and owner[2] ~= "" then
+		redis.call("SREM", "sessions:hero:" .. owner[2], lkey)
+	end
+end
+
+local ttl = tonumber(ARGV[3])
+redis.call("HMSET", KEYS[2], unpack(ARGV, 5 + count))
+redis.call("EXPIRE", KEYS[2], ttl)
+redis.call("SADD", KEYS[3], ARGV[2])
+redis.call("EXPIRE", KEYS[3], ttl)
+if KEYS[4] ~= "" then
+	redis.call("SADD", KEYS[4], ARGV[2])
+	redis.call("EXPIRE", KEYS[4], ttl)
+end
+return kicked`)
+
+// ValidPolicy reports whether policy is one of PolicyKick, PolicyRefuse or PolicyAllow
+func ValidPolicy(policy string) bool {
+	return policy == PolicyKick || policy == PolicyRefuse || policy == PolicyAllow
+}
+
+// Create issues a new lkey for id (the user or hero id used by theater) and stores it with SessionTTL.
+// SessionPolicy is applied to the other sessions of userID (or heroID, for persona logins), sessions
+// listed in keep belong to the connection logging in and are never counted as conflicts.
+func (s *Sessions) Create(id string, userID string, heroID string, name string, keep []string) (string, error) {
+	setKey := userSetKey(userID)
+	if heroID != "" {
+		setKey = heroSetKey(heroID)
+	}
+
+	lkey, kicked, err := s.create(id, userID, heroID, "", name, SessionPolicy, setKey, keep)
+	if err != nil {
+		return "", err
+	}
+
+	for _, kickedLkey := range kicked {
+		log.Noteln("Kicking previous session " + kickedLkey + " of user " + userID)
+		if err := s.redis.Publish(RevokedChannel, kickedLkey).Err(); err != nil {
+			log.Errorln("Failed announcing revoked session "+kickedLkey, err)
+		}
+	}
+
+	return lkey, nil
+}
+
+// CreateServer issues a new lkey for a game server (game_servers.id) owned by userID. Server sessions are
+// kept apart from the sessions of the account, so the owner logging in to play neither kicks nor is refused by them.
+func (s *Sessions) CreateServer(id string, userID string, serverID string, name string) (string, error) {
+	lkey, _, err := s.create(id, userID, "", serverID, name, PolicyAllow, serverSetKey(serverID), nil)
+	return lkey, err
+}
+
+func (s *Sessions) create(id string, userID string, heroID string, serverID string, name string, policy string, setKey string, keep []string) (string, []string, error) {
+	lkey := GameSpy.BF2RandomSecure(24)
+
+	ownerKey, heroKey := userSetKey(userID), ""
+	if heroID != "" {
+		heroKey = heroSetKey(heroID)
+	}
+	if serverID != "" {
+		ownerKey, heroKey = userServersKey(userID), serverSetKey(serverID)
+	}
+
+	args := []interface{}{policy, lkey, int(SessionTTL.Seconds()), len(keep)}
+	for _, keepLkey := range keep {
+		args = append(args, keepLkey)
+	}
+	args = append(args,
+		"id", id,
+		"userID", userID,
+		"heroID", heroID,
+		"serverID", serverID,
+		"name", name,
+		"createdAt", strconv.FormatInt(time.Now().UTC().Unix(), 10))
+
+	kicked, err := createScript.Run(s.redis, []string{setKey, sessionKey(lkey), ownerKey, heroKey}, args...).Result()
+	if err == redis.Nil {
+		return "", nil, ErrSessionActive
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	var kickedLkeys []string
+	for _, kickedLkey := range kicked.([]interface{}) {
+		kickedLkeys = append(kickedLkeys, kickedLkey.(string))
+	}
+
+	return lkey, kickedLkeys, nil
+}
+
+// Get returns the session for lkey and restarts its TTL
+func (s *Sessions) Get(lkey string) (*Session, error) {
+	if lkey == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := s.redis.HGetAll(sessionKey(lkey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	s.Refresh(lkey)
+
+	return toSession(lkey, data, SessionTTL), nil
+}
+
+// SetPings stores the ping site results of a client on its sessions, unknown keys are ignored
+func (s *Sessions) SetPings(lkeys []string, pingSite string, pings map[string]int) {
+	data := make(map[string]interface{})
+	data["pingSite"] = pingSite
+	for site, ping := range pings {
+		data[PingPrefix+site] = ping
+	}
+
+	for _, lkey := range lkeys {
+		if s.redis.Exists(sessionKey(lkey)).Val() == 0 {
+			continue
+		}
+
+		if err := s.redis.HMSet(sessionKey(lkey), data).Err(); err != nil {
+			log.Errorln("Failed storing pings of session "+lkey, err)
+		}
+	}
+}
+
+// Refresh restarts the TTL of the given lkeys, unknown keys are ignored
+func (s *Sessions) Refresh(lkeys ...string) {
+	for _, lkey := range lkeys {
+		if lkey == "" {
+			continue
+		}
+
+		data, err := s.redis.HMGet(sessionKey(lkey), "userID", "heroID", "serverID").Result()
+		if err != nil || data[0] == nil {
+			continue
+		}
+
+		s.redis.Expire(sessionKey(lkey), SessionTTL)
+		if serverID, ok := data[2].(string); ok && serverID != "" {
+			s.redis.Expire(userServersKey(data[0].(string)), SessionTTL)
+			s.redis.Expire(serverSetKey(serverID), SessionTTL)
+			continue
+		}
+		s.redis.Expire(userSetKey(data[0].(string)), SessionTTL)
+		if heroID, ok := data[1].(string); ok && heroID != "" {
+			s.redis.Expire(heroSetKey(heroID), SessionTTL)
+		}
+	}
+}
+
+// List returns all active sessions of an account, including those of its game servers
+func (s *Sessions) List(userID string) []*Session {
+	var sessions []*Session
+
+	for _, lkey := range append(s.members(userSetKey(userID)), s.members(userServersKey(userID))...) {
+		data, err := s.redis.HGetAll(sessionKey(lkey)).Result()
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		ttl, _ := s.redis.TTL(sessionKey(lkey)).Result()
+		sessions = append(sessions, toSession(lkey, data, ttl))
+	}
+
+	return sessions
+}
+
+// HeroOnline tells whether heroID has an active session, i.e. is logged in on some shard
+func (s *Sessions) HeroOnline(heroID string) bool {
+	return len(s.members(heroSetKey(heroID))) > 0
+}
+
+// End removes a session after its connection closed cleanly
+func (s *Sessions) End(lkey string) error {
+	data, err := s.redis.HMGet(sessionKey(lkey), "userID", "heroID", "serverID").Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(sessionKey(lkey))
+		if userID, ok := data[0].(string); ok {
+			pipe.SRem(userSetKey(userID), lkey)
+			pipe.SRem(userServersKey(userID), lkey)
+		}
+		if heroID, ok := data[1].(string); ok && heroID != "" {
+			pipe.SRem(heroSetKey(heroID), lkey)
+		}
+		if serverID, ok := data[2].(string); ok && serverID != "" {
+			pipe.SRem(serverSetKey(serverID), lkey)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Revoke removes a session and tells every shard to disconnect the connections using it
+func (s *Sessions) Revoke(lkey string) error {
+	err := s.End(lkey)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.Publish(RevokedChannel, lkey).Err()
+}
+
+// RevokeUser revokes every session of an account and its game servers (force-logout, bans)
+func (s *Sessions) RevokeUser(userID string) int {
+	revoked := 0
+	for _, lkey := range append(s.members(userSetKey(userID)), s.members(userServersKey(userID))...) {
+		if err := s.Revoke(lkey); err != nil {
+			log.Errorln("Failed revoking session "+lkey, err)
+			continue
+		}
+		revoked++
+	}
+
+	return revoked
+}
+
+// Revocations subscribes to RevokedChannel and returns the revoked lkeys
+func (s *Sessions) Revocations() <-chan string {
+	lkeys := make(chan string, 100)
+
+	pubsub := s.redis.Subscribe(RevokedChannel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			lkeys <- msg.Payload
+		}
+	}()
+
+	return lkeys
+}
+
+// members returns the lkeys stored in setKey and drops the ones that already expired
+func (s *Sessions) members(setKey string) []string {
+	var lkeys []string
+
+	for _, lkey := range s.redis.SMembers(setKey).Val() {
+		if s.redis.Exists(sessionKey(lkey)).Val() == 0 {
+			s.redis.SRem(setKey, lkey)
+			continue
+		}
+		lkeys = append(lkeys, lkey)
+	}
+
+	return lkeys
+}
+
+func toSession(lkey string, data map[string]string, ttl time.Duration) *Session {
+	createdAt, _ := strconv.ParseInt(data["createdAt"], 10, 64)
+
+	var pings map[string]int
+	for field, value := range data {
+		if !strings.HasPrefix(field, PingPrefix) {
+			continue
+		}
+		if pings == nil {
+			pings = make(map[string]int)
+		}
+		pings[strings.TrimPrefix(field, PingPrefix)], _ = strconv.Atoi(value)
+	}
+
+	return &Session{
+		LKey:      lkey,
+		ID:        data["id"],
+		UserID:    data["userID"],
+		HeroID:    data["heroID"],
+		ServerID:  data["serverID"],
+		Name:      data["name"],
+		CreatedAt: time.Unix(createdAt, 0).UTC().Format(time.RFC3339),
+		TTL:       int(ttl.Seconds()),
+		PingSite:  data["pingSite"],
+		Pings:     pings,
+	}
+}
+
+func sessionKey(lkey string) string {
+	return "lkeys:" + lkey
+}
+
+func userSetKey(userID string) string {
+	return "sessions:user:" + userID
+}
+
+func heroSetKey(heroID string) string {
+	return "sessions:hero:" + heroID
+}
+
+func serverSetKey(serverID string) string {
+	return "sessions:server:" + serverID
+}
+
+// The server sessions of an account, so revoking the account reaches its game servers
+func userServersKey(userID string) string {
+	return "sessions:user:" + userID + ":servers"
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// TicketTTL - how long a player has to connect to the game server after EGAM
+	TicketTTL = time.Minute * 2
+	// GameKeysTTL - game keys expire after this long without KeepGame, so keys of games nobody removed don't pile up
+	GameKeysTTL = time.Minute * 10
+)
+
+var (
+	// ErrGameNotFound - no keys were issued for this GID
+	ErrGameNotFound = errors.New("game not found")
+	// ErrTicketInvalid - the ticket was never issued for this PID/GID, expired or was tampered with
+	ErrTicketInvalid = errors.New("ticket invalid")
+)
+
+// GameKeys - per-game values handed to the server in CGAM and to joining clients in EGEG
+type GameKeys struct {
+	EKey   string
+	Secret string
+
+	// signKey never leaves the backend, it signs the tickets for this game
+	signKey []byte
+}
+
+// Tickets - issues per-game secrets and per-join tickets bound to PID and GID
+type Tickets struct {
+	redis *redis.Client
+}
+
+// New sets up the ticket service
+func (t *Tickets) New(redis *redis.Client) {
+	t.redis = redis
+}
+
+// CreateGame generates fresh keys for a new game
+func (t *Tickets) CreateGame(gid string) (*GameKeys, error) {
+	secret := binary.BigEndian.Uint32(randomBytes(4))
+
+	keys := &GameKeys{
+		// The game expects 16 url-escaped base64 bytes
+		EKey:    url.QueryEscape(base64.StdEncoding.EncodeToString(randomBytes(16))),
+		Secret:  strconv.FormatUint(uint64(secret%9000000+1000000), 10),
+		signKey: randomBytes(32),
+	}
+
+	data := make(map[string]interface{})
+	data["EKEY"] = keys.EKey
+	data["SECRET"] = keys.Secret
+	data["signKey"] = hex.EncodeToString(keys.signKey)
+
+	_, err := t.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(gameKeysKey(gid), data)
+		pipe.Expire(gameKeysKey(gid), GameKeysTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Game returns the keys created for gid
+func (t *Tickets) Game(gid string) (*GameKeys, error) {
+	data, err := t.redis.HGetAll(gameKeysKey(gid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrGameNotFound
+	}
+
+	signKey, err := hex.DecodeString(data["signKey"])
+	if err != nil {
+		return nil, err
+	}
+
+	return &GameKeys{
+		EKey:    data["EKEY"],
+		Secret:  data["SECRET"],
+		signKey: signKey,
+	}, nil
+}
+
+// KeepGame restarts the GameKeysTTL of the keys of gid, called whenever its server reports in
+func (t *Tickets) KeepGame(gid string) error {
+	return t.redis.Expire(gameKeysKey(gid), GameKeysTTL).Err()
+}
+
+// DeleteGame removes the keys of a game that shut down
+func (t *Tickets) DeleteGame(gid string) error {
+	return t.redis.Del(gameKeysKey(gid)).Err()
+}
+
+// Issue creates a ticket allowing pid to join gid for TicketTTL
+func (t *Tickets) Issue(gid string, pid string) (string, error) {
+	keys, err := t.Game(gid)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := hex.EncodeToString(randomBytes(8))
+	expires := strconv.FormatInt(time.Now().Add(TicketTTL).Unix(), 10)
+	ticket := signTicket(keys.signKey, gid, pid, expires, nonce)
+
+	data := make(map[string]interface{})
+	data["ticket"] = ticket
+	data["nonce"] = nonce
+	data["expires"] = expires
+
+	_, err = t.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(ticketKey(gid, pid), data)
+		pipe.Expire(ticketKey(gid, pid), TicketTTL)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ticket, nil
+}
+
+// Validate checks that ticket was issued for pid joining gid and hasn't expired. Valid tickets are consumed.
+func (t *Tickets) Validate(gid string, pid string, ticket string) error {
+	if ticket == "" {
+		return ErrTicketInvalid
+	}
+
+	keys, err := t.Game(gid)
+	if err != nil {
+		return err
+	}
+
+	data, err := t.redis.HGetAll(ticketKey(gid, pid)).Result()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return ErrTicketInvalid
+	}
+
+	expires, err := strconv.ParseInt(data["expires"], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrTicketInvalid
+	}
+
+	expected := signTicket(keys.signKey, gid, pid, data["expires"], data["nonce"])
+	if !hmac.Equal([]byte(expected), []byte(data["ticket"])) || !hmac.Equal([]byte(expected), []byte(ticket)) {
+		return ErrTicketInvalid
+	}
+
+	t.redis.Del(ticketKey(gid, pid))
+
+	return nil
+}
+
+// signTicket - HMAC-SHA256 over the join, reduced to the 32bit number the game uses as TICKET
+func signTicket(signKey []byte, gid string, pid string, expires string, nonce string) string {
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write([]byte(gid + ":" + pid + ":" + expires + ":" + nonce))
+	sum := mac.Sum(nil)
+
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(sum[:4])), 10)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func gameKeysKey(gid string) string {
+	return "gkeys:" + gid
+}
+
+func ticketKey(gid string, pid string) string {
+	return "tickets:" + gid + ":" + pid
+}
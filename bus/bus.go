@@ -0,0 +1,84 @@
+package bus
+
+import (
+	"errors"
+	"sync"
+
+	"../GameSpy"
+	"../log"
+)
+
+// ErrUnknownShard - the message is for a shard the bus can't reach
+var ErrUnknownShard = errors.New("unknown shard")
+
+// Message - something a shard asks another one to do, like writing a packet to a connection it holds
+type Message struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+	// Type picks the handler on the receiving shard
+	Type string `json:"type"`
+	// Target is what the message is about on the receiving shard, like a GID
+	Target  string            `json:"target"`
+	Query   string            `json:"query"`
+	Payload map[string]string `json:"payload"`
+}
+
+// Handler - handles messages of one type
+type Handler func(message *Message)
+
+// Bus - routes messages between the shards of a deployment
+type Bus interface {
+	// Shard is the shard this bus receives messages for
+	Shard() string
+	// Send delivers message to shard, which may be this one
+	Send(shard string, message *Message) error
+	// Handle registers the handler of a message type, replacing the previous one
+	Handle(messageType string, handler Handler)
+}
+
+// router - the handlers and delivery shared by every bus
+type router struct {
+	shard string
+
+	mutex    sync.RWMutex
+	handlers map[string]Handler
+}
+
+func (r *router) init(shard string) {
+	r.shard = shard
+	r.handlers = make(map[string]Handler)
+}
+
+// Shard is the shard this bus receives messages for
+func (r *router) Shard() string {
+	return r.shard
+}
+
+// Handle registers the handler of a message type, replacing the previous one
+func (r *router) Handle(messageType string, handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.handlers[messageType] = handler
+}
+
+func (r *router) deliver(message *Message) {
+	r.mutex.RLock()
+	handler, ok := r.handlers[message.Type]
+	r.mutex.RUnlock()
+
+	if !ok {
+		log.Errorln("No handler for bus message " + message.Type + " from shard " + message.From)
+		return
+	}
+
+	handler(message)
+}
+
+// prepare fills in sender and ID of an outgoing message
+func (r *router) prepare(message *Message) {
+	message.From = r.shard
+	if message.ID == "" {
+		message.ID = r.shard + "-" + GameSpy.BF2RandomUnsafe(12)
+	}
+}
@@ -0,0 +1,22 @@
+package bus
+
+// Local - the bus of a single instance, every message stays in this process
+type Local struct {
+	router
+}
+
+// New sets up the bus for shard
+func (l *Local) New(shard string) {
+	l.init(shard)
+}
+
+// Send hands message to the handler of its type, there are no other shards to reach
+func (l *Local) Send(shard string, message *Message) error {
+	if shard != l.shard {
+		return ErrUnknownShard
+	}
+
+	l.prepare(message)
+	go l.deliver(message)
+	return nil
+}
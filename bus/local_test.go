@@ -0,0 +1,68 @@
+package bus_test
+
+import (
+	"testing"
+	"time"
+
+	"./bus"
+)
+
+func TestLocalSend(t *testing.T) {
+	local := new(bus.Local)
+	local.New("a")
+
+	received := make(chan *bus.Message, 1)
+	local.Handle("test", func(message *bus.Message) {
+		received <- message
+	})
+
+	err := local.Send("a", &bus.Message{Type: "test", Target: "1", Payload: map[string]string{"PID": "2"}})
+	if err != nil {
+		t.Fatalf("Send to the own shard failed: %s", err)
+	}
+
+	select {
+	case message := <-received:
+		if message.From != "a" || message.ID == "" {
+			t.Errorf("Send didn't fill in sender and ID, got from %q and ID %q", message.From, message.ID)
+		}
+		if message.Target != "1" || message.Payload["PID"] != "2" {
+			t.Errorf("Send changed the message, got target %q and payload %v", message.Target, message.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send didn't deliver the message to its handler")
+	}
+}
+
+func TestLocalSendUnknownShard(t *testing.T) {
+	local := new(bus.Local)
+	local.New("a")
+
+	if err := local.Send("b", &bus.Message{Type: "test"}); err != bus.ErrUnknownShard {
+		t.Errorf("Send to another shard = %v, want ErrUnknownShard", err)
+	}
+}
+
+func TestLocalHandleReplaces(t *testing.T) {
+	local := new(bus.Local)
+	local.New("a")
+
+	received := make(chan string, 2)
+	local.Handle("test", func(message *bus.Message) {
+		received <- "first"
+	})
+	local.Handle("test", func(message *bus.Message) {
+		received <- "second"
+	})
+
+	local.Send("a", &bus.Message{Type: "test"})
+
+	select {
+	case handler := <-received:
+		if handler != "second" {
+			t.Errorf("Send delivered to the %s handler, want the one registered last", handler)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send didn't deliver the message to its handler")
+	}
+}
@@ -0,0 +1,68 @@
+package bus
+
+import (
+	"encoding/json"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// ChannelPrefix - followed by a shard, the redis pub/sub channel that shard receives its bus messages on
+const ChannelPrefix = "bus:"
+
+// Redis - routes messages between instances over one redis pub/sub channel per shard
+type Redis struct {
+	router
+
+	redis *redis.Client
+}
+
+// New subscribes to the channel of shard and starts delivering its messages
+func (r *Redis) New(shard string, redis *redis.Client) {
+	r.init(shard)
+	r.redis = redis
+
+	pubsub := r.redis.Subscribe(channel(shard))
+	go func() {
+		for msg := range pubsub.Channel() {
+			message := new(Message)
+			if err := json.Unmarshal([]byte(msg.Payload), message); err != nil {
+				log.Errorln("Dropping invalid bus message", msg.Payload, err)
+				continue
+			}
+
+			go r.deliver(message)
+		}
+	}()
+}
+
+// Send publishes message on the channel of shard, messages for this shard skip redis
+func (r *Redis) Send(shard string, message *Message) error {
+	r.prepare(message)
+
+	if shard == r.shard {
+		go r.deliver(message)
+		return nil
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// Nobody listening means the shard is gone
+	receivers, err := r.redis.Publish(channel(shard), data).Result()
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		return ErrUnknownShard
+	}
+
+	return nil
+}
+
+func channel(shard string) string {
+	return ChannelPrefix + shard
+}
@@ -0,0 +1,92 @@
+package bus_test
+
+import (
+	"testing"
+	"time"
+
+	"./bus"
+
+	"github.com/go-redis/redis"
+)
+
+// testRedis connects to the redis of the development setup, the tests are skipped without one
+func testRedis(t *testing.T) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("No redis on localhost:6379:", err)
+	}
+
+	return client
+}
+
+func TestRedisSendOtherShard(t *testing.T) {
+	client := testRedis(t)
+	defer client.Close()
+
+	sender := new(bus.Redis)
+	sender.New("test-a", client)
+	receiver := new(bus.Redis)
+	receiver.New("test-b", client)
+
+	received := make(chan *bus.Message, 1)
+	receiver.Handle("test", func(message *bus.Message) {
+		received <- message
+	})
+
+	// The subscription of the receiver may take a moment
+	var err error
+	for i := 0; i < 10; i++ {
+		err = sender.Send("test-b", &bus.Message{Type: "test", Target: "1", Payload: map[string]string{"PID": "2"}})
+		if err != bus.ErrUnknownShard {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err != nil {
+		t.Fatalf("Send to another shard failed: %s", err)
+	}
+
+	select {
+	case message := <-received:
+		if message.From != "test-a" || message.Target != "1" || message.Payload["PID"] != "2" {
+			t.Errorf("Send changed the message, got %+v", message)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("Send didn't deliver the message to the other shard")
+	}
+}
+
+func TestRedisSendUnknownShard(t *testing.T) {
+	client := testRedis(t)
+	defer client.Close()
+
+	sender := new(bus.Redis)
+	sender.New("test-a", client)
+
+	if err := sender.Send("test-nobody", &bus.Message{Type: "test"}); err != bus.ErrUnknownShard {
+		t.Errorf("Send to a shard nobody listens for = %v, want ErrUnknownShard", err)
+	}
+}
+
+func TestRedisSendOwnShard(t *testing.T) {
+	client := testRedis(t)
+	defer client.Close()
+
+	local := new(bus.Redis)
+	local.New("test-a", client)
+
+	received := make(chan *bus.Message, 1)
+	local.Handle("test", func(message *bus.Message) {
+		received <- message
+	})
+
+	if err := local.Send("test-a", &bus.Message{Type: "test"}); err != nil {
+		t.Fatalf("Send to the own shard failed: %s", err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Send didn't deliver the message to its own shard")
+	}
+}
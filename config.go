@@ -4,6 +4,8 @@ import (
 	"io/ioutil"
 	"log"
 
+	"github.com/NeonRG/RG_Backend-V2/matchmaking"
+
 	"gopkg.in/yaml.v2"
 )
 
@@ -19,6 +21,48 @@ type Config struct {
 	InfluxDBDatabase string
 	InfluxDBUser     string
 	InfluxDBPassword string
+
+	// Username/password login
+	LoginMaxAttempts    int
+	LoginLockoutMinutes int
+
+	// lkey sessions, SessionPolicy is one of kick, refuse or allow
+	SessionTTLMinutes int
+	SessionPolicy     string
+
+	// How long role/permission lookups are cached
+	PermissionCacheMinutes int
+
+	// yml file with the stat definitions enforced by UpdateStats/GetStats
+	StatsDefinitions string
+
+	// Redis write-behind cache for game_stats, StatsConsistencyCheck compares every cache hit with MySQL
+	StatsCache            bool
+	StatsCacheTTLMinutes  int
+	StatsFlushSeconds     int
+	StatsConsistencyCheck bool
+
+	// How often the leaderboards are computed
+	LeaderboardMinutes int
+
+	// How the matchmaker weighs free slots, ELO, team balance and region, see matchmaking.Weights
+	Matchmaking matchmaking.Weights
+
+	// Games whose server sent no PING or UGAM for this long are reaped
+	GameTimeoutSeconds int
+
+	// Team balance policy per game mode (B-U-gamemode), modes without one use matchmaking.DefaultBalancePolicy
+	TeamBalance map[string]matchmaking.BalancePolicy
+
+	// Ping sites GetPingSites hands out, clients have to measure MinPingSites of them
+	PingSites    []matchmaking.PingSite
+	MinPingSites int
+
+	// Ping site of game servers by game_servers.id, servers not listed are in the region they announce (B-U-region)
+	ServerRegions map[string]string
+
+	// Key expected in the X-ADMIN-KEY header of admin API requests, empty disables the admin API
+	AdminKey string
 }
 
 func (config *Config) Parse(data []byte) error {
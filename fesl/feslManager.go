@@ -4,14 +4,18 @@ import (
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"time"
 
 	"../GameSpy"
+	"../auth"
 	"../core"
-	"../lib"
 	"../log"
+	"../matchmaking"
+	"../moderation"
+	"../stats"
 
 	"github.com/go-redis/redis"
 )
@@ -28,32 +32,40 @@ type FeslManager struct {
 	server        bool
 	iDB           *core.InfluxDB
 	localMode     bool
+	credentials   *auth.Credentials
+	sessions      *auth.Sessions
+	permissions   *auth.Permissions
+	bans          *moderation.Bans
+	stats         stats.StatsStore
 
 	// Database Statements
-	stmtGetUserByGameToken              *sql.Stmt
-	stmtGetServerBySecret               *sql.Stmt
-	stmtGetServerByID                   *sql.Stmt
-	stmtGetServerByName                 *sql.Stmt
-	stmtGetCountOfPermissionByIDAndSlug *sql.Stmt
-	stmtGetHeroesByUserID               *sql.Stmt
-	stmtGetHeroeByName                  *sql.Stmt
-	stmtGetHeroeByID                    *sql.Stmt
-	stmtClearGameServerStats            *sql.Stmt
-	mapGetStatsVariableAmount           map[int]*sql.Stmt
-	mapGetServerStatsVariableAmount     map[int]*sql.Stmt
-	mapSetStatsVariableAmount           map[int]*sql.Stmt
-	mapSetServerStatsVariableAmount     map[int]*sql.Stmt
+	stmtGetUserByGameToken          *sql.Stmt
+	stmtGetServerBySecret           *sql.Stmt
+	stmtGetServerByID               *sql.Stmt
+	stmtGetServerByName             *sql.Stmt
+	stmtGetHeroesByUserID           *sql.Stmt
+	stmtGetHeroeByName              *sql.Stmt
+	stmtGetHeroeByID                *sql.Stmt
+	mapGetServerStatsVariableAmount map[int]*sql.Stmt
+	mapSetServerStatsVariableAmount map[int]*sql.Stmt
 }
 
 var Shard string
 
+// Leaderboards - the precomputed rankings, shared by all managers
+var Leaderboards *stats.Leaderboards
+
+// Seasons - archived stats of past seasons
+var Seasons *stats.Seasons
+
 // New creates and starts a new ClientManager
-func (fM *FeslManager) New(name string, port string, certFile string, keyFile string, server bool, db *sql.DB, redis *redis.Client, iDB *core.InfluxDB, localMode bool) {
+func (fM *FeslManager) New(name string, port string, certFile string, keyFile string, server bool, db *sql.DB, redis *redis.Client, statsStore stats.StatsStore, iDB *core.InfluxDB, localMode bool) {
 	var err error
 
 	fM.socket = new(GameSpy.SocketTLS)
 	fM.db = db
 	fM.redis = redis
+	fM.stats = statsStore
 	fM.name = name
 	fM.eventsChannel, err = fM.socket.New(fM.name, port, certFile, keyFile)
 	fM.stopTicker = make(chan bool, 1)
@@ -61,9 +73,7 @@ func (fM *FeslManager) New(name string, port string, certFile string, keyFile st
 	fM.iDB = iDB
 	fM.localMode = localMode
 
-	fM.mapGetStatsVariableAmount = make(map[int]*sql.Stmt)
 	fM.mapGetServerStatsVariableAmount = make(map[int]*sql.Stmt)
-	fM.mapSetStatsVariableAmount = make(map[int]*sql.Stmt)
 
 	// Prepare database statements
 	fM.prepareStatements()
@@ -71,10 +81,28 @@ func (fM *FeslManager) New(name string, port string, certFile string, keyFile st
 		log.Errorln(err)
 	}
 
-	_, err = fM.stmtClearGameServerStats.Exec()
-	if err != nil {
-		log.Panicln("Error clearing out game server stats", err)
-	}
+	fM.credentials = new(auth.Credentials)
+	fM.credentials.New(db, redis)
+	fM.sessions = new(auth.Sessions)
+	fM.sessions.New(redis)
+	fM.permissions = new(auth.Permissions)
+	fM.permissions.New(db, redis)
+	fM.bans = new(moderation.Bans)
+	fM.bans.New(db, redis)
+
+	// Disconnect clients whose session got revoked, no matter which shard revoked it
+	go func() {
+		for lkey := range fM.sessions.Revocations() {
+			fM.disconnectSession(lkey)
+		}
+	}()
+
+	// Banned players and servers are disconnected right away
+	go func() {
+		for ban := range fM.bans.Issued() {
+			fM.disconnectBanned(ban)
+		}
+	}()
 
 	// Collect metrics every 10 seconds
 	fM.batchTicker = time.NewTicker(time.Second * 1)
@@ -113,60 +141,6 @@ func (fM *FeslManager) getServerStatsVariableAmount(statsAmount int) *sql.Stmt {
 	return fM.mapGetServerStatsVariableAmount[statsAmount]
 }
 
-func (fM *FeslManager) getStatsStatement(statsAmount int) *sql.Stmt {
-	var err error
-
-	// Check if we already have a statement prepared for that amount of stats
-	if statement, ok := fM.mapGetStatsVariableAmount[statsAmount]; ok {
-		return statement
-	}
-
-	var query string
-	for i := 1; i < statsAmount; i++ {
-		query += "?, "
-	}
-
-	sql := "SELECT user_id, heroID, statsKey, statsValue" +
-		"	FROM game_stats" +
-		"	WHERE heroID=?" +
-		"		AND user_id=?" +
-		"		AND statsKey IN (" + query + "?)"
-
-	fM.mapGetStatsVariableAmount[statsAmount], err = fM.db.Prepare(sql)
-	if err != nil {
-		log.Fatalln("Error preparing stmtGetStatsVariableAmount with "+sql+" query.", err.Error())
-	}
-
-	return fM.mapGetStatsVariableAmount[statsAmount]
-}
-
-func (fM *FeslManager) setStatsStatement(statsAmount int) *sql.Stmt {
-	var err error
-
-	// Check if we already have a statement prepared for that amount of stats
-	if statement, ok := fM.mapSetStatsVariableAmount[statsAmount]; ok {
-		return statement
-	}
-
-	var query string
-	for i := 1; i < statsAmount; i++ {
-		query += "(?, ?, ?, ?), "
-	}
-
-	sql := "INSERT INTO game_stats" +
-		"	(user_id, heroID, statsKey, statsValue)" +
-		"	VALUES " + query + "(?, ?, ?, ?)" +
-		"	ON DUPLICATE KEY UPDATE" +
-		"	statsValue=VALUES(statsValue)"
-
-	fM.mapSetStatsVariableAmount[statsAmount], err = fM.db.Prepare(sql)
-	if err != nil {
-		log.Fatalln("Error preparing stmtSetStatsVariableAmount with "+sql+" query.", err.Error())
-	}
-
-	return fM.mapSetStatsVariableAmount[statsAmount]
-}
-
 func (fM *FeslManager) prepareStatements() {
 	var err error
 
@@ -208,21 +182,6 @@ func (fM *FeslManager) prepareStatements() {
 		log.Fatalln("Error preparing stmtGetServerByName.", err.Error())
 	}
 
-	fM.stmtGetCountOfPermissionByIDAndSlug, err = fM.db.Prepare(
-		"SELECT count(permissions.slug)" +
-			"	FROM users" +
-			"	LEFT JOIN role_user" +
-			"		ON users.id=role_user.user_id" +
-			"	LEFT JOIN permission_role" +
-			"		ON permission_role.role_id=role_user.role_id" +
-			"	LEFT JOIN permissions" +
-			"		ON permissions.id=permission_role.permission_id" +
-			"	WHERE users.id = ?" +
-			"		AND permissions.slug = ?")
-	if err != nil {
-		log.Fatalln("Error preparing stmtGetCountOfPermissionByIdAndSlug.", err.Error())
-	}
-
 	fM.stmtGetHeroesByUserID, err = fM.db.Prepare(
 		"SELECT id, user_id, heroName, online" +
 			"	FROM game_heroes" +
@@ -246,12 +205,6 @@ func (fM *FeslManager) prepareStatements() {
 	if err != nil {
 		log.Fatalln("Error preparing stmtGetHeroeByID.", err.Error())
 	}
-
-	fM.stmtClearGameServerStats, err = fM.db.Prepare(
-		"DELETE FROM game_server_stats")
-	if err != nil {
-		log.Fatalln("Error preparing stmtClearGameServerStats.", err.Error())
-	}
 }
 
 func (fM *FeslManager) closeStatements() {
@@ -259,43 +212,19 @@ func (fM *FeslManager) closeStatements() {
 	fM.stmtGetServerBySecret.Close()
 	fM.stmtGetServerByID.Close()
 	fM.stmtGetServerByName.Close()
-	fM.stmtGetCountOfPermissionByIDAndSlug.Close()
 	fM.stmtGetHeroesByUserID.Close()
 	fM.stmtGetHeroeByName.Close()
-	fM.stmtClearGameServerStats.Close()
-
-	// Close the dynamic lenght getStats statements
-	for index := range fM.mapGetStatsVariableAmount {
-		fM.mapGetStatsVariableAmount[index].Close()
-	}
-
-	// Close the dynamic lenght setStats statements
-	for index := range fM.mapSetStatsVariableAmount {
-		fM.mapSetStatsVariableAmount[index].Close()
-	}
 }
 
 func (fM *FeslManager) userHasPermission(id string, slug string) bool {
-
-	var count int
-	err := fM.stmtGetCountOfPermissionByIDAndSlug.QueryRow(id, slug).Scan(&count)
-	if err != nil {
-		return true
-	}
-
-	// If user has at least on role allowing that permission, return true
-	if count > 0 {
-		return true
-	}
-
-	return true
+	return fM.permissions.Has(id, slug)
 }
 
 func (fM *FeslManager) collectMetrics() {
 	// Create a point and add to batch
 	tags := map[string]string{"clients": "clients-total", "server": "feslManager" + fM.name}
 	fields := map[string]interface{}{
-		"clients": len(fM.socket.ClientsTLS),
+		"clients": len(fM.socket.GetClients()),
 	}
 
 	fM.iDB.AddMetric("clients_total", tags, fields)
@@ -323,6 +252,14 @@ func (fM *FeslManager) run() {
 				fM.GetStatsForOwners(event.Data.(GameSpy.EventClientTLSCommand))
 			case event.Name == "client.command.GetStats":
 				fM.GetStats(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.GetRankedStats":
+				fM.GetRankedStats(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.GetRankedStatsForOwners":
+				fM.GetRankedStatsForOwners(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.GetTopN":
+				fM.GetTopN(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.GetTopNAndStats":
+				fM.GetTopNAndStats(event.Data.(GameSpy.EventClientTLSCommand))
 			case event.Name == "client.command.NuLookupUserInfo":
 				fM.NuLookupUserInfo(event.Data.(GameSpy.EventClientTLSCommand))
 			case event.Name == "client.command.GetPingSites":
@@ -333,6 +270,16 @@ func (fM *FeslManager) run() {
 				fM.GetTelemetryToken(event.Data.(GameSpy.EventClientTLSCommand))
 			case event.Name == "client.command.Start":
 				fM.Start(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.PartyCreate":
+				fM.PartyCreate(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.PartyInvite":
+				fM.PartyInvite(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.PartyAccept":
+				fM.PartyAccept(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.PartyLeave":
+				fM.PartyLeave(event.Data.(GameSpy.EventClientTLSCommand))
+			case event.Name == "client.command.PartyGet":
+				fM.PartyGet(event.Data.(GameSpy.EventClientTLSCommand))
 			case event.Name == "client.close":
 				fM.close(event.Data.(GameSpy.EventClientTLSClose))
 			case event.Name == "client.command":
@@ -421,6 +368,11 @@ func (fM *FeslManager) newClient(event GameSpy.EventNewClientTLS) {
 				memCheck["salt"] = "5"
 				event.Client.WriteFESL("fsys", memCheck, 0xC0000000)
 				fM.logAnswer("fsys", memCheck, 0xC0000000)
+
+				// Keep the sessions of connected clients from expiring
+				if event.Client.RedisState != nil {
+					fM.sessions.Refresh(clientLkeys(event.Client)...)
+				}
 			}
 		}
 	}()
@@ -433,13 +385,13 @@ func (fM *FeslManager) close(event GameSpy.EventClientTLSClose) {
 	log.Noteln("Client closed.")
 
 	if event.Client.RedisState != nil {
-		if event.Client.RedisState.Get("lkeys") != "" {
-			lkeys := strings.Split(event.Client.RedisState.Get("lkeys"), ";")
-			for _, lkey := range lkeys {
-				lkeyRedis := new(lib.RedisObject)
-				lkeyRedis.New(fM.redis, "lkeys", lkey)
-				lkeyRedis.Delete()
-			}
+		for _, lkey := range clientLkeys(event.Client) {
+			fM.sessions.End(lkey)
+		}
+
+		// Heroes that log off stop holding up their party
+		if heroID := event.Client.RedisState.Get("heroID"); heroID != "" {
+			matchmaking.LeaveParty(fM.redis, heroID)
 		}
 
 		event.Client.RedisState.Delete()
@@ -451,6 +403,90 @@ func (fM *FeslManager) close(event GameSpy.EventClientTLSClose) {
 
 }
 
+// clientLkeys - returns the lkeys handed out to this connection
+func clientLkeys(client *GameSpy.ClientTLS) []string {
+	var lkeys []string
+	for _, lkey := range strings.Split(client.RedisState.Get("lkeys"), ";") {
+		if lkey != "" {
+			lkeys = append(lkeys, lkey)
+		}
+	}
+
+	return lkeys
+}
+
+// disconnectSession - says goodbye to and closes every connection using lkey
+func (fM *FeslManager) disconnectSession(lkey string) {
+	for _, client := range fM.socket.GetClients() {
+		if !client.IsActive || client.RedisState == nil {
+			continue
+		}
+
+		for _, clientLkey := range clientLkeys(client) {
+			if clientLkey != lkey {
+				continue
+			}
+
+			log.Noteln("Disconnecting " + client.RedisState.Get("username") + ", session " + lkey + " was revoked")
+			fM.sayGoodbye(client, "You have been logged out.")
+			break
+		}
+	}
+}
+
+// disconnectBanned - closes every connection covered by a freshly issued ban
+func (fM *FeslManager) disconnectBanned(ban *moderation.Ban) {
+	for _, client := range fM.socket.GetClients() {
+		if !client.IsActive || client.RedisState == nil {
+			continue
+		}
+
+		if ban.Matches(client.RedisState.Get("uID"), client.RedisState.Get("heroID"), client.RedisState.Get("sID"), clientIP(client)) {
+			log.Noteln("Disconnecting banned " + client.RedisState.Get("username"))
+			client.State.Banned = true
+			fM.sayGoodbye(client, ban.Message(client.RedisState.Get("locale")))
+		}
+	}
+}
+
+// rejectBanned - answers the login with the ban notice if any of the identities is banned
+func (fM *FeslManager) rejectBanned(event GameSpy.EventClientTLSCommand, userID string, heroID string, serverID string) bool {
+	ban, err := fM.bans.CheckAll(userID, heroID, serverID, clientIP(event.Client))
+	if err != nil {
+		log.Errorln("Failed checking bans", err)
+		return false
+	}
+	if ban == nil {
+		return false
+	}
+
+	log.Noteln("Refusing banned login of user " + userID + ", ban " + ban.Type + " " + ban.Target)
+	event.Client.State.Banned = true
+	fM.sendLoginError(event, errCodeAccountDisabled, ban.Message(event.Client.RedisState.Get("locale")))
+	return true
+}
+
+// sayGoodbye - tells the client why and closes the connection
+func (fM *FeslManager) sayGoodbye(client *GameSpy.ClientTLS, message string) {
+	goodbye := make(map[string]string)
+	goodbye["TXN"] = "Goodbye"
+	goodbye["reason"] = "GOODBYE_CLIENT_NORMAL"
+	goodbye["message"] = "\"" + message + "\""
+	client.WriteFESL("fsys", goodbye, 0xC0000000)
+	fM.logAnswer("fsys", goodbye, 0xC0000000)
+
+	client.Close()
+}
+
+func clientIP(client *GameSpy.ClientTLS) net.IP {
+	addr, ok := client.IpAddr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+
+	return addr.IP
+}
+
 func (fM *FeslManager) error(event GameSpy.EventClientTLSError) {
 	log.Noteln("Client threw an error: ", event.Error)
 }
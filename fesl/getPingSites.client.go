@@ -1,8 +1,13 @@
 package fesl
 
 import (
+	"strconv"
+	"strings"
+
 	"../GameSpy"
+	"../auth"
 	"../log"
+	"../matchmaking"
 )
 
 // GetPingSites - returns a list of endpoints to test for the lowest latency on a client
@@ -12,20 +17,56 @@ func (fM *FeslManager) GetPingSites(event GameSpy.EventClientTLSCommand) {
 		return
 	}
 
-	// gva = eu central
-	// nrt = us east
-
 	answer := make(map[string]string)
 	answer["TXN"] = "GetPingSites"
-	answer["minPingSitesToPing"] = "2"
-	answer["pingSites.[]"] = "2"
-	answer["pingSites.0.addr"] = "45.77.66.233"
-	answer["pingSites.0.name"] = "gva"
-	answer["pingSites.0.type"] = "0"
-	answer["pingSites.1.addr"] = "45.77.76.193"
-	answer["pingSites.1.name"] = "nrt"
-	answer["pingSites.1.type"] = "0"
+	answer["minPingSitesToPing"] = strconv.Itoa(matchmaking.MinPingSites)
+	answer["pingSites.[]"] = strconv.Itoa(len(matchmaking.PingSites))
+	for i, site := range matchmaking.PingSites {
+		answer["pingSites."+strconv.Itoa(i)+".addr"] = site.Addr
+		answer["pingSites."+strconv.Itoa(i)+".name"] = site.Name
+		answer["pingSites."+strconv.Itoa(i)+".type"] = strconv.Itoa(site.Type)
+	}
 
 	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
 	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
 }
+
+// recordPings - keeps the ping site results a client sends with pnow Start, as players.0.props.{pingSite}
+// and one players.0.props.{ping-<site>} per measured site, on its connection and its sessions
+func (fM *FeslManager) recordPings(event GameSpy.EventClientTLSCommand) {
+	pings := make(map[string]int)
+	for _, site := range matchmaking.PingSites {
+		ping, err := strconv.Atoi(event.Command.Message["players.0.props.{ping-"+site.Name+"}"])
+		if err == nil && ping >= 0 {
+			pings[site.Name] = ping
+		}
+	}
+
+	pingSite := strings.Trim(event.Command.Message["players.0.props.{pingSite}"], "\"")
+	if !matchmaking.KnownPingSite(pingSite) {
+		pingSite = matchmaking.ClosestPingSite(pings)
+	}
+	if pingSite == "" {
+		return
+	}
+
+	state := map[string]interface{}{"pingSite": pingSite}
+	for site, ping := range pings {
+		state[auth.PingPrefix+site] = ping
+	}
+	event.Client.RedisState.SetM(state)
+
+	fM.sessions.SetPings(clientLkeys(event.Client), pingSite, pings)
+}
+
+// clientPings - the latencies a client measured to the ping sites
+func clientPings(client *GameSpy.ClientTLS) map[string]int {
+	pings := make(map[string]int)
+	for _, site := range matchmaking.PingSites {
+		if ping, err := strconv.Atoi(client.RedisState.Get(auth.PingPrefix + site.Name)); err == nil {
+			pings[site.Name] = ping
+		}
+	}
+
+	return pings
+}
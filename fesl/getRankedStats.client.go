@@ -0,0 +1,76 @@
+package fesl
+
+import (
+	"strconv"
+
+	"../GameSpy"
+	"../log"
+	"../stats"
+)
+
+// GetRankedStats - stats of a hero with its rank on the leaderboards of the asked keys
+func (fM *FeslManager) GetRankedStats(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	owner := event.Command.Message["owner"]
+	period, group := rankingFilter(event)
+
+	answer := make(map[string]string)
+	answer["TXN"] = "GetRankedStats"
+	answer["ownerId"] = owner
+	answer["ownerType"] = "1"
+
+	var keys []string
+	keyCount, _ := strconv.Atoi(event.Command.Message["keys.[]"])
+	for i := 0; i < keyCount; i++ {
+		keys = append(keys, event.Command.Message["keys."+strconv.Itoa(i)])
+	}
+
+	fM.addRankedStats(answer, "stats.", owner, keys, period, group)
+
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
+
+// addRankedStats - adds key, value and rank of every known key to answer. Keys without
+// a leaderboard, or heroes not on it, get the stored value with rank -1.
+func (fM *FeslManager) addRankedStats(answer map[string]string, prefix string, owner string, keys []string, period string, group string) {
+	values, err := fM.stats.Get("", owner, keys)
+	if err != nil {
+		log.Errorln("Failed gettings stats for hero "+owner, err.Error())
+	}
+
+	count := 0
+	for _, key := range keys {
+		if !stats.Definitions.Known(key) {
+			log.Noteln("Not sending unknown stat " + key)
+			continue
+		}
+
+		value, ok := values[key]
+		if !ok {
+			value = stats.Definitions.Default(key)
+		}
+		rank := "-1"
+
+		if stats.Definitions.Leaderboard(key) != nil {
+			ranking, err := Leaderboards.Rank(key, period, group, owner)
+			if err != nil {
+				log.Errorln("Failed getting rank of hero "+owner+" on "+key, err)
+			}
+			if ranking != nil {
+				value, rank = ranking.Value, strconv.FormatInt(ranking.Rank, 10)
+			}
+		}
+
+		answer[prefix+strconv.Itoa(count)+".key"] = key
+		answer[prefix+strconv.Itoa(count)+".value"] = value
+		answer[prefix+strconv.Itoa(count)+".text"] = value
+		answer[prefix+strconv.Itoa(count)+".rank"] = rank
+		count++
+	}
+	answer[prefix+"[]"] = strconv.Itoa(count)
+}
@@ -0,0 +1,40 @@
+package fesl
+
+import (
+	"strconv"
+
+	"../GameSpy"
+	"../log"
+)
+
+// GetRankedStatsForOwners - GetRankedStats for every hero listed in owners
+func (fM *FeslManager) GetRankedStatsForOwners(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	period, group := rankingFilter(event)
+
+	answer := make(map[string]string)
+	answer["TXN"] = "GetRankedStatsForOwners"
+
+	var keys []string
+	keyCount, _ := strconv.Atoi(event.Command.Message["keys.[]"])
+	for i := 0; i < keyCount; i++ {
+		keys = append(keys, event.Command.Message["keys."+strconv.Itoa(i)])
+	}
+
+	owners, _ := strconv.Atoi(event.Command.Message["owners.[]"])
+	for i := 0; i < owners; i++ {
+		owner := event.Command.Message["owners."+strconv.Itoa(i)+".ownerId"]
+
+		answer["rankedStats."+strconv.Itoa(i)+".ownerId"] = owner
+		answer["rankedStats."+strconv.Itoa(i)+".ownerType"] = "1"
+		fM.addRankedStats(answer, "rankedStats."+strconv.Itoa(i)+".rankedStats.", owner, keys, period, group)
+	}
+	answer["rankedStats.[]"] = strconv.Itoa(owners)
+
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
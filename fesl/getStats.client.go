@@ -5,6 +5,7 @@ import (
 
 	"../GameSpy"
 	"../log"
+	"../stats"
 )
 
 // GetStats - Get basic stats about a soldier/owner (account holder)
@@ -39,43 +40,52 @@ func (fM *FeslManager) GetStats(event GameSpy.EventClientTLSCommand) {
 	loginPacket["ownerId"] = owner
 	loginPacket["ownerType"] = "1"
 
-	// Generate our argument list for the statement -> heroID, userID, key1, key2, key3, ...
-	var args []interface{}
-	statsKeys := make(map[string]string)
-	args = append(args, owner)
-	args = append(args, userId)
-	keys, _ := strconv.Atoi(event.Command.Message["keys.[]"])
-	for i := 0; i < keys; i++ {
-		args = append(args, event.Command.Message["keys."+strconv.Itoa(i)+""])
-		statsKeys[event.Command.Message["keys."+strconv.Itoa(i)+""]] = strconv.Itoa(i)
+	var keys []string
+	keyCount, _ := strconv.Atoi(event.Command.Message["keys.[]"])
+	for i := 0; i < keyCount; i++ {
+		keys = append(keys, event.Command.Message["keys."+strconv.Itoa(i)+""])
 	}
 
-	rows, err := fM.getStatsStatement(keys).Query(args...)
+	values, err := fM.stats.Get(userId, owner, keys)
 	if err != nil {
 		log.Errorln("Failed gettings stats for hero "+owner, err.Error())
 	}
 
-	count := 0
-	for rows.Next() {
-		var userID, heroID, statsKey, statsValue string
-		err := rows.Scan(&userID, &heroID, &statsKey, &statsValue)
+	// Seasonal stats of a past season come from its archive, the others are the current ones
+	if season := event.Command.Message["season"]; season != "" {
+		seasonID, _ := strconv.ParseInt(season, 10, 64)
+		archived, err := Seasons.Archived(seasonID, userId, owner, keys)
 		if err != nil {
-			log.Errorln("Issue with database:", err.Error())
+			log.Errorln("Failed getting stats of hero "+owner+" in season "+season, err.Error())
 		}
 
-		loginPacket["stats."+strconv.Itoa(count)+".key"] = statsKey
-		loginPacket["stats."+strconv.Itoa(count)+".value"] = statsValue
-		loginPacket["stats."+strconv.Itoa(count)+".text"] = statsValue
-
-		delete(statsKeys, statsKey)
-		count++
+		for _, key := range keys {
+			if !stats.Definitions.Seasonal(key) {
+				continue
+			}
+			if value, ok := archived[key]; ok {
+				values[key] = value
+			} else {
+				delete(values, key)
+			}
+		}
 	}
 
-	// Send stats not found with default value of ""
-	for key := range statsKeys {
+	count := 0
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			// Send stats not found with their default value
+			if !stats.Definitions.Known(key) {
+				log.Noteln("Not sending unknown stat " + key)
+				continue
+			}
+			value = stats.Definitions.Default(key)
+		}
+
 		loginPacket["stats."+strconv.Itoa(count)+".key"] = key
-		loginPacket["stats."+strconv.Itoa(count)+".value"] = ""
-		loginPacket["stats."+strconv.Itoa(count)+".text"] = ""
+		loginPacket["stats."+strconv.Itoa(count)+".value"] = value
+		loginPacket["stats."+strconv.Itoa(count)+".text"] = value
 
 		count++
 	}
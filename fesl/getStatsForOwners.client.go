@@ -5,6 +5,7 @@ import (
 
 	"../GameSpy"
 	"../log"
+	"../stats"
 )
 
 // GetStatsForOwners - Gives a bunch of info for the Hero selection screen?
@@ -44,43 +45,32 @@ func (fM *FeslManager) GetStatsForOwners(event GameSpy.EventClientTLSCommand) {
 		loginPacket["stats."+strconv.Itoa(i-1)+".ownerId"] = ownerID
 		loginPacket["stats."+strconv.Itoa(i-1)+".ownerType"] = "1"
 
-		// Generate our argument list for the statement -> heroID, key1, key2, key3, ...
-		var args []interface{}
-		statsKeys := make(map[string]string)
-		args = append(args, ownerID)
-		args = append(args, userID)
-		keys, _ := strconv.Atoi(event.Command.Message["keys.[]"])
-		for i := 0; i < keys; i++ {
-			args = append(args, event.Command.Message["keys."+strconv.Itoa(i)+""])
-			statsKeys[event.Command.Message["keys."+strconv.Itoa(i)+""]] = strconv.Itoa(i)
+		var keys []string
+		keyCount, _ := strconv.Atoi(event.Command.Message["keys.[]"])
+		for i := 0; i < keyCount; i++ {
+			keys = append(keys, event.Command.Message["keys."+strconv.Itoa(i)+""])
 		}
 
-		rows, err := fM.getStatsStatement(keys).Query(args...)
+		values, err := fM.stats.Get(userID, ownerID, keys)
 		if err != nil {
 			log.Errorln("Failed gettings stats for hero "+ownerID, err.Error())
 		}
 
 		count := 0
-		for rows.Next() {
-			var userID, heroID, statsKey, statsValue string
-			err := rows.Scan(&userID, &heroID, &statsKey, &statsValue)
-			if err != nil {
-				log.Errorln("Issue with database:", err.Error())
+		for _, key := range keys {
+			value, ok := values[key]
+			if !ok {
+				// Send stats not found with their default value
+				if !stats.Definitions.Known(key) {
+					log.Noteln("Not sending unknown stat " + key)
+					continue
+				}
+				value = stats.Definitions.Default(key)
 			}
 
-			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".key"] = statsKey
-			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".value"] = statsValue
-			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".text"] = statsValue
-
-			delete(statsKeys, statsKey)
-			count++
-		}
-
-		// Send stats not found with default value of ""
-		for key := range statsKeys {
 			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".key"] = key
-			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".value"] = ""
-			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".text"] = ""
+			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".value"] = value
+			loginPacket["stats."+strconv.Itoa(i-1)+".stats."+strconv.Itoa(count)+".text"] = value
 
 			count++
 		}
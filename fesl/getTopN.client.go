@@ -0,0 +1,77 @@
+package fesl
+
+import (
+	"strconv"
+
+	"../GameSpy"
+	"../log"
+	"../stats"
+)
+
+// maxTopN - the most heroes one GetTopN answer lists
+const maxTopN = 100
+
+// rankingPeriods - periodId sent by the game
+var rankingPeriods = map[string]string{
+	"":  stats.PeriodAllTime,
+	"0": stats.PeriodAllTime,
+	"1": stats.PeriodWeekly,
+	"2": stats.PeriodSeason,
+}
+
+// GetTopN - the best heroes of a leaderboard, from minRank to maxRank
+func (fM *FeslManager) GetTopN(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	answer, _ := fM.topN(event, "GetTopN")
+
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
+
+// topN - answers the ranks asked for with minRank/maxRank, the rankings are returned for further stats
+func (fM *FeslManager) topN(event GameSpy.EventClientTLSCommand, txn string) (map[string]string, []*stats.Ranking) {
+	answer := make(map[string]string)
+	answer["TXN"] = txn
+
+	key := event.Command.Message["key"]
+	period, group := rankingFilter(event)
+
+	minRank, _ := strconv.ParseInt(event.Command.Message["minRank"], 10, 64)
+	maxRank, _ := strconv.ParseInt(event.Command.Message["maxRank"], 10, 64)
+	if minRank < 1 {
+		minRank = 1
+	}
+	if maxRank < minRank || maxRank-minRank >= maxTopN {
+		maxRank = minRank + maxTopN - 1
+	}
+
+	rankings, err := Leaderboards.Top(key, period, group, minRank, maxRank)
+	if err != nil {
+		log.Errorln("Failed getting leaderboard "+key+" "+period, err)
+	}
+
+	for i, ranking := range rankings {
+		answer["stats."+strconv.Itoa(i)+".owner"] = ranking.HeroID
+		answer["stats."+strconv.Itoa(i)+".name"] = ranking.Name
+		answer["stats."+strconv.Itoa(i)+".rank"] = strconv.FormatInt(ranking.Rank, 10)
+		answer["stats."+strconv.Itoa(i)+".value"] = ranking.Value
+	}
+	answer["stats.[]"] = strconv.Itoa(len(rankings))
+
+	return answer, rankings
+}
+
+// rankingFilter - the period (periodId) and team or faction (group) a ranking request asks for
+func rankingFilter(event GameSpy.EventClientTLSCommand) (string, string) {
+	period, ok := rankingPeriods[event.Command.Message["periodId"]]
+	if !ok {
+		log.Noteln("Unknown periodId " + event.Command.Message["periodId"] + ", ranking all-time")
+		period = stats.PeriodAllTime
+	}
+
+	return period, event.Command.Message["group"]
+}
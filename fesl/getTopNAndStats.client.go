@@ -0,0 +1,54 @@
+package fesl
+
+import (
+	"strconv"
+
+	"../GameSpy"
+	"../log"
+	"../stats"
+)
+
+// GetTopNAndStats - like GetTopN, with the stats asked for in keys of every listed hero
+func (fM *FeslManager) GetTopNAndStats(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	answer, rankings := fM.topN(event, "GetTopNAndStats")
+
+	var keys []string
+	keyCount, _ := strconv.Atoi(event.Command.Message["keys.[]"])
+	for i := 0; i < keyCount; i++ {
+		keys = append(keys, event.Command.Message["keys."+strconv.Itoa(i)])
+	}
+
+	for i, ranking := range rankings {
+		prefix := "stats." + strconv.Itoa(i) + ".stats."
+
+		values, err := fM.stats.Get("", ranking.HeroID, keys)
+		if err != nil {
+			log.Errorln("Failed gettings stats for hero "+ranking.HeroID, err.Error())
+		}
+
+		count := 0
+		for _, key := range keys {
+			value, ok := values[key]
+			if !ok {
+				if !stats.Definitions.Known(key) {
+					continue
+				}
+				value = stats.Definitions.Default(key)
+			}
+
+			answer[prefix+strconv.Itoa(count)+".key"] = key
+			answer[prefix+strconv.Itoa(count)+".value"] = value
+			answer[prefix+strconv.Itoa(count)+".text"] = value
+			count++
+		}
+		answer[prefix+"[]"] = strconv.Itoa(count)
+	}
+
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
@@ -2,11 +2,20 @@ package fesl
 
 import (
 	"../GameSpy"
-	"../lib"
+	"../auth"
 	"../log"
 )
 
-// NuLogin - master login command
+// Nucleus error codes used in NuLogin answers
+const (
+	errCodeAccountDisabled = "102"
+	errCodeAlreadyLoggedIn = "103"
+	errCodeNotEntitled     = "120"
+	errCodeWrongPassword   = "122"
+)
+
+// NuLogin - master login command, either with the encryptedInfo game token
+// from the web launcher or with nuid and password
 func (fM *FeslManager) NuLogin(event GameSpy.EventClientTLSCommand) {
 	if !event.Client.IsActive {
 		log.Noteln("Client left")
@@ -19,29 +28,64 @@ func (fM *FeslManager) NuLogin(event GameSpy.EventClientTLSCommand) {
 		return
 	}
 
-	var id, username, email, birthday, language, country, gameToken string
+	var id, username, email, gameToken, keyHash string
 
-	err := fM.stmtGetUserByGameToken.QueryRow(event.Command.Message["encryptedInfo"]).Scan(&id, &username, &email, &birthday, &language, &country, &gameToken)
-	if err != nil {
-		log.Noteln("User not worthy!", err)
-		loginPacket := make(map[string]string)
-		loginPacket["TXN"] = "NuLogin"
-		loginPacket["localizedMessage"] = "\"The user is not entitled to access this game\""
-		loginPacket["errorContainer.[]"] = "0"
-		loginPacket["errorCode"] = "120"
-		event.Client.WriteFESL(event.Command.Query, loginPacket, event.Command.PayloadID)
+	if event.Command.Message["encryptedInfo"] != "" {
+		var birthday, language, country string
+
+		err := fM.stmtGetUserByGameToken.QueryRow(event.Command.Message["encryptedInfo"]).Scan(&id, &username, &email, &birthday, &language, &country, &gameToken)
+		if err != nil {
+			log.Noteln("User not worthy!", err)
+			fM.sendLoginError(event, errCodeNotEntitled, "The user is not entitled to access this game")
+			return
+		}
+
+		keyHash = event.Command.Message["encryptedInfo"]
+	} else {
+		user, err := fM.credentials.Verify(event.Command.Message["nuid"], event.Command.Message["password"])
+		switch err {
+		case nil:
+		case auth.ErrUserNotFound, auth.ErrWrongPassword, auth.ErrNoPassword:
+			// Same answer for unknown users and wrong passwords, so nuids can't be probed
+			fM.sendLoginError(event, errCodeWrongPassword, "The username or password is incorrect")
+			return
+		case auth.ErrLockedOut:
+			fM.sendLoginError(event, errCodeAccountDisabled, "The account has been disabled")
+			return
+		default:
+			log.Errorln("Failed verifying credentials for "+event.Command.Message["nuid"], err)
+			fM.sendLoginError(event, errCodeNotEntitled, "The user is not entitled to access this game")
+			return
+		}
+
+		id = user.ID
+		username = user.Username
+		email = user.Email
+		gameToken = user.GameToken
+		keyHash = user.GameToken
+	}
+
+	if fM.rejectBanned(event, id, "", "") {
 		return
 	}
 
 	// Check if user is allowed to login
-	if !fM.userHasPermission(id, "game.login") {
+	if !fM.userHasPermission(id, auth.PermissionLogin) {
 		log.Noteln("User not worthy: " + username)
-		loginPacket := make(map[string]string)
-		loginPacket["TXN"] = "NuLogin"
-		loginPacket["localizedMessage"] = "\"Your user is currently not allowed to login.\""
-		loginPacket["errorContainer.[]"] = "0"
-		loginPacket["errorCode"] = "120"
-		event.Client.WriteFESL(event.Command.Query, loginPacket, event.Command.PayloadID)
+		fM.sendLoginError(event, errCodeNotEntitled, "Your user is currently not allowed to login.")
+		return
+	}
+
+	// Only one session per account, depending on the configured policy
+	lkey, err := fM.sessions.Create(id, id, "", username, clientLkeys(event.Client))
+	if err == auth.ErrSessionActive {
+		log.Noteln("User already logged in: " + username)
+		fM.sendLoginError(event, errCodeAlreadyLoggedIn, "The account is already logged in")
+		return
+	}
+	if err != nil {
+		log.Errorln("Failed creating session for "+username, err)
+		fM.sendLoginError(event, errCodeNotEntitled, "The user is not entitled to access this game")
 		return
 	}
 
@@ -50,40 +94,45 @@ func (fM *FeslManager) NuLogin(event GameSpy.EventClientTLSCommand) {
 	saveRedis["username"] = username
 	saveRedis["sessionID"] = gameToken
 	saveRedis["email"] = email
-	saveRedis["keyHash"] = event.Command.Message["encryptedInfo"]
+	saveRedis["keyHash"] = keyHash
 	event.Client.RedisState.SetM(saveRedis)
 
-	// Setup a new key for our persona
-	lkey := GameSpy.BF2RandomUnsafe(24)
-	lkeyRedis := new(lib.RedisObject)
-	lkeyRedis.New(fM.redis, "lkeys", lkey)
-	lkeyRedis.Set("id", id)
-	lkeyRedis.Set("userID", id)
-	lkeyRedis.Set("name", username)
-
 	loginPacket := make(map[string]string)
 	loginPacket["TXN"] = "NuLogin"
 	loginPacket["profileId"] = id
 	loginPacket["userId"] = id
 	loginPacket["nuid"] = username
 	loginPacket["lkey"] = lkey
+	if event.Command.Message["returnEncryptedInfo"] == "1" {
+		loginPacket["encryptedLoginInfo"] = gameToken
+	}
 	event.Client.RedisState.Set("lkeys", event.Client.RedisState.Get("lkeys")+";"+lkey)
 	event.Client.WriteFESL(event.Command.Query, loginPacket, event.Command.PayloadID)
 	fM.logAnswer(event.Command.Query, loginPacket, event.Command.PayloadID)
 }
 
+// sendLoginError - answers a NuLogin with one of the nucleus error codes
+func (fM *FeslManager) sendLoginError(event GameSpy.EventClientTLSCommand, code string, message string) {
+	loginPacket := make(map[string]string)
+	loginPacket["TXN"] = event.Command.Message["TXN"]
+	loginPacket["localizedMessage"] = "\"" + message + "\""
+	loginPacket["errorContainer.[]"] = "0"
+	loginPacket["errorCode"] = code
+	event.Client.WriteFESL(event.Command.Query, loginPacket, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, loginPacket, event.Command.PayloadID)
+}
+
 // NuLoginServer - login command for servers
 func (fM *FeslManager) NuLoginServer(event GameSpy.EventClientTLSCommand) {
 	var id, userID, servername, secretKey, username string
 
 	err := fM.stmtGetServerBySecret.QueryRow(event.Command.Message["password"]).Scan(&id, &userID, &servername, &secretKey, &username)
 	if err != nil {
-		loginPacket := make(map[string]string)
-		loginPacket["TXN"] = "NuLogin"
-		loginPacket["localizedMessage"] = "\"The password the user specified is incorrect\""
-		loginPacket["errorContainer.[]"] = "0"
-		loginPacket["errorCode"] = "122"
-		event.Client.WriteFESL(event.Command.Query, loginPacket, event.Command.PayloadID)
+		fM.sendLoginError(event, errCodeWrongPassword, "The password the user specified is incorrect")
+		return
+	}
+
+	if fM.rejectBanned(event, userID, "", id) {
 		return
 	}
 
@@ -96,12 +145,12 @@ func (fM *FeslManager) NuLoginServer(event GameSpy.EventClientTLSCommand) {
 	event.Client.RedisState.SetM(saveRedis)
 
 	// Setup a new key for our persona
-	lkey := GameSpy.BF2RandomUnsafe(24)
-	lkeyRedis := new(lib.RedisObject)
-	lkeyRedis.New(fM.redis, "lkeys", lkey)
-	lkeyRedis.Set("id", id)
-	lkeyRedis.Set("userID", userID)
-	lkeyRedis.Set("name", username)
+	lkey, err := fM.sessions.CreateServer(id, userID, id, username)
+	if err != nil {
+		log.Errorln("Failed creating session for server "+servername, err)
+		fM.sendLoginError(event, errCodeNotEntitled, "The user is not entitled to access this game")
+		return
+	}
 
 	loginPacket := make(map[string]string)
 	loginPacket["TXN"] = "NuLogin"
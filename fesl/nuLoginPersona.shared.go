@@ -2,7 +2,7 @@ package fesl
 
 import (
 	"../GameSpy"
-	"../lib"
+	"../auth"
 	"../log"
 )
 
@@ -26,13 +26,21 @@ func (fM *FeslManager) NuLoginPersona(event GameSpy.EventClientTLSCommand) {
 		return
 	}
 
-	// Setup a new key for our persona
-	lkey := GameSpy.BF2RandomUnsafe(24)
-	lkeyRedis := new(lib.RedisObject)
-	lkeyRedis.New(fM.redis, "lkeys", lkey)
-	lkeyRedis.Set("id", id)
-	lkeyRedis.Set("userID", userID)
-	lkeyRedis.Set("name", heroName)
+	if fM.rejectBanned(event, userID, id, "") {
+		return
+	}
+
+	// Only one session per hero, depending on the configured policy
+	lkey, err := fM.sessions.Create(id, userID, id, heroName, clientLkeys(event.Client))
+	if err == auth.ErrSessionActive {
+		log.Noteln("Persona already logged in: " + heroName)
+		fM.sendLoginError(event, errCodeAlreadyLoggedIn, "The persona is already logged in")
+		return
+	}
+	if err != nil {
+		log.Errorln("Failed creating session for persona "+heroName, err)
+		return
+	}
 
 	saveRedis := make(map[string]interface{})
 	saveRedis["heroID"] = id
@@ -58,12 +66,11 @@ func (fM *FeslManager) NuLoginPersonaServer(event GameSpy.EventClientTLSCommand)
 	}
 
 	// Setup a new key for our persona
-	lkey := GameSpy.BF2RandomUnsafe(24)
-	lkeyRedis := new(lib.RedisObject)
-	lkeyRedis.New(fM.redis, "lkeys", lkey)
-	lkeyRedis.Set("id", userID)
-	lkeyRedis.Set("userID", userID)
-	lkeyRedis.Set("name", servername)
+	lkey, err := fM.sessions.CreateServer(userID, userID, id, servername)
+	if err != nil {
+		log.Errorln("Failed creating session for server "+servername, err)
+		return
+	}
 
 	loginPacket := make(map[string]string)
 	loginPacket["TXN"] = "NuLoginPersona"
@@ -0,0 +1,18 @@
+package fesl
+
+import (
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+// PartyAccept - the hero joins the party in partyId that invited it
+func (fM *FeslManager) PartyAccept(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	party, err := matchmaking.AcceptInvite(fM.redis, event.Command.Message["partyId"], event.Client.RedisState.Get("heroID"))
+	fM.answerParty(event, party, err)
+}
@@ -0,0 +1,18 @@
+package fesl
+
+import (
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+// PartyCreate - the hero starts a party it leads
+func (fM *FeslManager) PartyCreate(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	party, err := matchmaking.CreateParty(fM.redis, event.Client.RedisState.Get("heroID"))
+	fM.answerParty(event, party, err)
+}
@@ -0,0 +1,81 @@
+package fesl
+
+import (
+	"strconv"
+
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+// errCodePartyRefused - the party request wasn't possible, localizedMessage says why
+const errCodePartyRefused = "400"
+
+// PartyGet - the party of the hero and the parties it is invited to
+func (fM *FeslManager) PartyGet(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	heroID := event.Client.RedisState.Get("heroID")
+
+	var party *matchmaking.Party
+	if partyID := matchmaking.PartyOf(fM.redis, heroID); partyID != "" {
+		var err error
+		party, err = matchmaking.GetParty(fM.redis, partyID)
+		if err != nil {
+			log.Errorln("Failed getting party "+partyID, err)
+		}
+	}
+
+	invites, err := matchmaking.Invites(fM.redis, heroID)
+	if err != nil {
+		log.Errorln("Failed getting party invites of hero "+heroID, err)
+	}
+
+	answer := partyAnswer(party)
+	answer["TXN"] = "PartyGet"
+	for i, partyID := range invites {
+		answer["invites."+strconv.Itoa(i)] = partyID
+	}
+	answer["invites.[]"] = strconv.Itoa(len(invites))
+
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
+
+// answerParty - answers a party TXN with the party it changed, or why it couldn't
+func (fM *FeslManager) answerParty(event GameSpy.EventClientTLSCommand, party *matchmaking.Party, err error) {
+	answer := partyAnswer(party)
+	if err != nil {
+		log.Noteln("Refusing "+event.Command.Message["TXN"]+" of hero "+event.Client.RedisState.Get("heroID")+":", err)
+
+		answer = make(map[string]string)
+		answer["localizedMessage"] = "\"" + err.Error() + "\""
+		answer["errorContainer.[]"] = "0"
+		answer["errorCode"] = errCodePartyRefused
+	}
+	answer["TXN"] = event.Command.Message["TXN"]
+
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
+
+// partyAnswer - the fields describing a party, only an empty member list without one
+func partyAnswer(party *matchmaking.Party) map[string]string {
+	answer := make(map[string]string)
+	if party == nil {
+		answer["members.[]"] = "0"
+		return answer
+	}
+
+	answer["partyId"] = party.ID
+	answer["leader"] = party.Leader()
+	for i, heroID := range party.Members {
+		answer["members."+strconv.Itoa(i)] = heroID
+	}
+	answer["members.[]"] = strconv.Itoa(len(party.Members))
+
+	return answer
+}
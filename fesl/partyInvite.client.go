@@ -0,0 +1,48 @@
+package fesl
+
+import (
+	"database/sql"
+	"errors"
+
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+var (
+	// errHeroNotFound - the invited hero doesn't exist
+	errHeroNotFound = errors.New("hero not found")
+	// errHeroOffline - the invited hero isn't logged in
+	errHeroOffline = errors.New("hero is not online")
+)
+
+// PartyInvite - the party leader invites the hero in owner
+func (fM *FeslManager) PartyInvite(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	heroID := event.Command.Message["owner"]
+
+	var id, userID, heroName, online string
+	err := fM.stmtGetHeroeByID.QueryRow(heroID).Scan(&id, &userID, &heroName, &online)
+	if err == sql.ErrNoRows {
+		fM.answerParty(event, nil, errHeroNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorln("Failed getting hero "+heroID, err)
+		fM.answerParty(event, nil, err)
+		return
+	}
+
+	// Invites of heroes nobody plays would only hold a party slot until they time out
+	if !fM.sessions.HeroOnline(heroID) {
+		fM.answerParty(event, nil, errHeroOffline)
+		return
+	}
+
+	party, err := matchmaking.InviteToParty(fM.redis, event.Client.RedisState.Get("heroID"), heroID)
+	fM.answerParty(event, party, err)
+}
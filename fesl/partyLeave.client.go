@@ -0,0 +1,18 @@
+package fesl
+
+import (
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+// PartyLeave - the hero leaves its party, the next member leads if it was the leader
+func (fM *FeslManager) PartyLeave(event GameSpy.EventClientTLSCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	err := matchmaking.LeaveParty(fM.redis, event.Client.RedisState.Get("heroID"))
+	fM.answerParty(event, nil, err)
+}
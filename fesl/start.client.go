@@ -4,6 +4,7 @@ import (
 	"strings"
 
 	"../GameSpy"
+	"../auth"
 	"../log"
 )
 
@@ -15,32 +16,25 @@ func (fM *FeslManager) Start(event GameSpy.EventClientTLSCommand) {
 	}
 
 	// Check if user is allowed to matchmake
-	if !fM.userHasPermission(event.Client.RedisState.Get("uID"), "game.matchmake") {
+	if !fM.userHasPermission(event.Client.RedisState.Get("uID"), auth.PermissionMatchmake) {
 		log.Noteln("User not worthy: " + event.Client.RedisState.Get("username"))
 		return
 	}
 
 	// Check if user has op rocket equipped
-	rows, err := fM.getStatsStatement(2).Query(event.Client.RedisState.Get("heroID"), event.Client.RedisState.Get("uID"), "c_eqp", "c_apr")
+	stats, err := fM.stats.Get(event.Client.RedisState.Get("uID"), event.Client.RedisState.Get("heroID"), []string{"c_eqp", "c_apr"})
 	if err != nil {
 		log.Errorln("Failed gettings stats for hero "+event.Client.RedisState.Get("heroID"), err.Error())
 	}
 
-	stats := make(map[string]string)
-	for rows.Next() {
-		var userID, heroID, statsKey, statsValue string
-		err := rows.Scan(&userID, &heroID, &statsKey, &statsValue)
-		if err != nil {
-			log.Errorln("Issue with database:", err.Error())
-		}
-		stats[statsKey] = statsValue
-	}
-
 	if strings.Contains(stats["c_eqp"], "3018") {
 		log.Noteln("User trying to matchmake with op launcher")
 		return
 	}
 
+	// Status matchmakes by what the client measured
+	fM.recordPings(event)
+
 	log.Noteln("START CALLED")
 	log.Noteln(event.Command.Message["partition.partition"])
 	answer := make(map[string]string)
@@ -4,14 +4,19 @@ import (
 	//"encoding/binary"
 	//"fmt"
 	//"net"
-	//"strconv"
+	"strconv"
 	//"strings"
 
 	"../GameSpy"
+	"../auth"
 	"../log"
 	"../matchmaking"
+	"../stats"
 )
 
+// maxStatusGames - how many candidate games Status offers, the best fit first
+const maxStatusGames = 5
+
 // Status - Basic fesl call to get overall service status (called before pnow?)
 func (fM *FeslManager) Status(event GameSpy.EventClientTLSCommand) {
 	if !event.Client.IsActive {
@@ -20,7 +25,7 @@ func (fM *FeslManager) Status(event GameSpy.EventClientTLSCommand) {
 	}
 
 	// Check if user is allowed to matchmake
-	if !fM.userHasPermission(event.Client.RedisState.Get("uID"), "game.matchmake") {
+	if !fM.userHasPermission(event.Client.RedisState.Get("uID"), auth.PermissionMatchmake) {
 		log.Noteln("User not worthy: " + event.Client.RedisState.Get("username"))
 		fM.sendDenied(event)
 		return
@@ -36,19 +41,97 @@ func (fM *FeslManager) Status(event GameSpy.EventClientTLSCommand) {
 	answer["props.{}.[]"] = "2"
 	answer["props.{resultType}"] = "JOIN"
 
-	// Find latest game (do better later)
-	//ipint := binary.BigEndian.Uint32(event.Client.IpAddr.(*net.TCPAddr).IP.To4())
-	gameID := matchmaking.FindAvailableGIDs()
+	heroID := event.Client.RedisState.Get("heroID")
+	region := event.Client.RedisState.Get("pingSite")
+	pings := clientPings(event.Client)
+
+	var candidates []matchmaking.Candidate
+	if partyID := matchmaking.PartyOf(fM.redis, heroID); partyID != "" {
+		candidates = fM.partyCandidates(heroID, partyID, region, pings)
+	} else {
+		player := fM.matchmakingPlayer(event.Client.RedisState.Get("uID"), heroID, region)
+		player.Pings = pings
+		candidates = matchmaking.FindGames(fM.redis, []matchmaking.Player{player}, maxStatusGames)
+	}
 
-	answer["props.{games}.0.lid"] = "1"
-	answer["props.{games}.0.fit"] = "1001"
-	answer["props.{games}.0.gid"] = gameID
-	answer["props.{games}.[]"] = "1"
+	games := 0
+	for _, candidate := range candidates {
+		// The game may have been removed since it was found
+		game := matchmaking.Games.Get(candidate.GID)
+		if game == nil {
+			continue
+		}
+
+		answer["props.{games}."+strconv.Itoa(games)+".lid"] = game.LobbyID
+		answer["props.{games}."+strconv.Itoa(games)+".fit"] = strconv.Itoa(candidate.Fit)
+		answer["props.{games}."+strconv.Itoa(games)+".gid"] = candidate.GID
+		games++
+	}
+	answer["props.{games}.[]"] = strconv.Itoa(games)
 
 	event.Client.WriteFESL("pnow", answer, 0x80000000)
 	fM.logAnswer("pnow", answer, 0x80000000)
 }
 
+// partyCandidates - the leader matchmakes for the whole party and reserves a slot for every member on the best game,
+// the members are offered the game reserved for them
+func (fM *FeslManager) partyCandidates(heroID string, partyID string, region string, pings map[string]int) []matchmaking.Candidate {
+	party, err := matchmaking.GetParty(fM.redis, partyID)
+	if err != nil {
+		log.Errorln("Failed getting party "+partyID, err)
+		return nil
+	}
+
+	if gid := matchmaking.ReservedGame(fM.redis, heroID); gid != "" {
+		return []matchmaking.Candidate{{GID: gid, Score: 1, Fit: 1000}}
+	}
+
+	if party.Leader() != heroID {
+		log.Noteln("Hero " + heroID + " waits for the leader of party " + partyID + " to find a game")
+		return nil
+	}
+
+	var players []matchmaking.Player
+	for _, member := range party.Members {
+		players = append(players, fM.matchmakingPlayer("", member, ""))
+	}
+	players[0].Region = region
+	players[0].Pings = pings
+
+	// Another party may take the room meanwhile, the reservation only succeeds if everyone still fits
+	for _, candidate := range matchmaking.FindGames(fM.redis, players, maxStatusGames) {
+		reserved, err := matchmaking.ReserveIfFree(fM.redis, candidate.GID, party.Members)
+		if err != nil {
+			log.Errorln("Failed reserving slots for party "+partyID+" on game "+candidate.GID, err)
+			return nil
+		}
+		if !reserved {
+			continue
+		}
+
+		log.Noteln("Reserved " + strconv.Itoa(len(players)) + " slots for party " + partyID + " on game " + candidate.GID)
+		return []matchmaking.Candidate{candidate}
+	}
+
+	log.Noteln("No game has room for the " + strconv.Itoa(len(players)) + " heroes of party " + partyID)
+	return nil
+}
+
+// matchmakingPlayer - what the matchmaker needs to know about a hero
+func (fM *FeslManager) matchmakingPlayer(userID string, heroID string, region string) matchmaking.Player {
+	heroStats, err := fM.stats.Get(userID, heroID, []string{"elo", "c_team"})
+	if err != nil {
+		log.Errorln("Failed gettings stats for hero "+heroID, err.Error())
+	}
+
+	return matchmaking.Player{
+		HeroID: heroID,
+		Team:   heroStats["c_team"],
+		Elo:    matchmakingElo(heroStats["elo"]),
+		Region: region,
+	}
+}
+
 func (fM *FeslManager) sendDenied(event GameSpy.EventClientTLSCommand) {
 	answer := make(map[string]string)
 	answer["TXN"] = "Status"
@@ -61,3 +144,13 @@ func (fM *FeslManager) sendDenied(event GameSpy.EventClientTLSCommand) {
 	event.Client.WriteFESL("pnow", answer, 0x80000000)
 	fM.logAnswer("pnow", answer, 0x80000000)
 }
+
+// matchmakingElo - the ELO of a hero, its default if it never played a ranked game
+func matchmakingElo(elo string) float64 {
+	if elo == "" {
+		elo = stats.Definitions.Default("elo")
+	}
+
+	value, _ := strconv.ParseFloat(elo, 64)
+	return value
+}
@@ -5,14 +5,12 @@ import (
 
 	"../GameSpy"
 	"../log"
+	"../matchmaking"
+	"../stats"
 )
 
-type stat struct {
-	text  string
-	value float64
-}
-
-// UpdateStats - updates stats about a soldier
+// UpdateStats - updates stats about a soldier. The whole request is applied in one transaction,
+// if any key is rejected nothing is written and the rejected keys are listed in the answer.
 func (fM *FeslManager) UpdateStats(event GameSpy.EventClientTLSCommand) {
 	if !event.Client.IsActive {
 		log.Noteln("Client left")
@@ -24,6 +22,11 @@ func (fM *FeslManager) UpdateStats(event GameSpy.EventClientTLSCommand) {
 
 	userId := event.Client.RedisState.Get("uID")
 
+	writer := stats.WriterClient
+	if event.Client.RedisState.Get("clientType") == "server" {
+		writer = stats.WriterServer
+	}
+
 	users, _ := strconv.Atoi(event.Command.Message["u.[]"])
 
 	if users == 0 {
@@ -31,6 +34,9 @@ func (fM *FeslManager) UpdateStats(event GameSpy.EventClientTLSCommand) {
 		users = 1
 	}
 
+	var updates []*stats.HeroUpdate
+	var rejected []stats.Rejection
+
 	for i := 0; i < users; i++ {
 		owner, ok := event.Command.Message["u."+strconv.Itoa(i)+".o"]
 		if event.Client.RedisState.Get("clientType") == "server" {
@@ -50,128 +56,86 @@ func (fM *FeslManager) UpdateStats(event GameSpy.EventClientTLSCommand) {
 			return
 		}
 
-		stats := make(map[string]*stat)
+		update := &stats.HeroUpdate{UserID: userId, HeroID: owner, Source: writer}
+		if writer == stats.WriterServer {
+			serverID := event.Client.RedisState.Get("sID")
+			update.Source = writer + ":" + serverID
+			update.GID = matchmaking.GameOfServer(fM.redis, serverID)
+		} else {
+			update.GID = matchmaking.GameOfHero(fM.redis, owner)
+		}
+
+		// Game servers only report the heroes playing on their game
+		onServer := writer != stats.WriterServer || matchmaking.PlaysOn(fM.redis, owner, update.GID)
 
-		// Get current stats from DB
-		// Generate our argument list for the statement -> heroID, userID, key1, key2, key3, ...
-		var argsGet []interface{}
-		statsKeys := make(map[string]string)
-		argsGet = append(argsGet, owner)
-		argsGet = append(argsGet, userId)
 		keys, _ := strconv.Atoi(event.Command.Message["u."+strconv.Itoa(i)+".s.[]"])
 		for j := 0; j < keys; j++ {
-			argsGet = append(argsGet, event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".k"])
-			statsKeys[event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".k"]] = strconv.Itoa(j)
-		}
+			prefix := "u." + strconv.Itoa(i) + ".s." + strconv.Itoa(j) + "."
 
-		rows, err := fM.getStatsStatement(keys).Query(argsGet...)
-		if err != nil {
-			log.Errorln("Failed gettings stats for hero "+owner, err.Error())
-		}
+			key := event.Command.Message[prefix+"k"]
+			text := event.Command.Message[prefix+"t"]
 
-		count := 0
-		for rows.Next() {
-			var userID, heroID, statsKey, statsValue string
-			err := rows.Scan(&userID, &heroID, &statsKey, &statsValue)
-			if err != nil {
-				log.Errorln("Issue with database:", err.Error())
+			if !onServer {
+				rejected = append(rejected, stats.Rejection{HeroID: owner, Key: key, Err: stats.ErrNotOnServer})
+				continue
 			}
 
-			intValue, err := strconv.ParseFloat(statsValue, 64)
-			if err != nil {
-				intValue = 0
+			var change *stats.Change
+			var err error
+			if text != "" {
+				change, err = stats.Definitions.PrepareText(key, writer, text)
+			} else {
+				change, err = stats.Definitions.Prepare(key, writer, event.Command.Message[prefix+"v"], event.Command.Message[prefix+"ut"])
 			}
-			stats[statsKey] = &stat{
-				text:  statsValue,
-				value: intValue,
+			if err == stats.ErrDerivedStat {
+				// The game reports levels and XP it computed itself, ours are what counts
+				log.Noteln("Ignoring derived stat " + key + " sent for hero " + owner)
+				continue
+			}
+			if err != nil {
+				rejected = append(rejected, stats.Rejection{HeroID: owner, Key: key, Err: err})
+				continue
 			}
 
-			delete(statsKeys, statsKey)
-			count++
+			update.Changes = append(update.Changes, change)
 		}
 
-		// Send stats not found with default value of ""
-		for key := range statsKeys {
-			stats[key] = &stat{
-				text:  "",
-				value: 0,
-			}
+		updates = append(updates, update)
+	}
 
-			count++
+	// Don't touch the database if we already know the request gets rejected
+	if len(rejected) == 0 {
+		var err error
+		rejected, err = fM.stats.Apply(updates)
+		if err != nil {
+			log.Errorln("Failed updating stats for user "+userId, err.Error())
+			fM.answerRejectedStats(event, nil)
+			return
 		}
-		// end Get current stats from DB
+	}
 
-		// Generate our argument list for the statement -> userId, owner, key1, value1, userId, owner, key2, value2, userId, owner, ...
-		var args []interface{}
-		keys, _ = strconv.Atoi(event.Command.Message["u."+strconv.Itoa(i)+".s.[]"])
-		for j := 0; j < keys; j++ {
+	if len(rejected) > 0 {
+		fM.answerRejectedStats(event, rejected)
+		return
+	}
 
-			if event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".ut"] != "3" {
-				log.Noteln("Update new Type:", event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".k"], event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".t"], event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".ut"], event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".v"], event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".pt"])
-			}
+	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
+	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
+}
 
-			key := event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".k"]
-			value := event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".t"]
-
-			if value == "" {
-				log.Noteln("Updating stat", key+":", event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".v"], "+", stats[key].value)
-				// We are dealing with a number
-				value = event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".v"]
-
-				// ut seems to be 3 when we need to add up (xp has ut 0 when you level'ed up, otherwise 3)
-				if event.Command.Message["u."+strconv.Itoa(i)+".s."+strconv.Itoa(j)+".ut"] == "3" {
-					intValue, err := strconv.ParseFloat(value, 64)
-					if err != nil {
-						// Couldn't transfer it to a number, skip updating this stat
-						log.Errorln("Skipping stat "+key, err)
-
-						answer := make(map[string]string)
-						answer["TXN"] = "UpdateStats"
-
-						event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
-						fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
-						return
-					}
-
-					if intValue <= 0 || event.Client.RedisState.Get("clientType") == "server" || key == "c_ltp" || key == "c_sln" || key == "c_ltm" || key == "c_slm" || key == "c_wmid0" || key == "c_wmid1" || key == "c_tut" || key == "c_wmid2" {
-						// Only allow increasing numbers (like HeroPoints) by the server for now
-						newValue := stats[key].value + intValue
-
-						if key == "c_wallet_hero" && newValue < 0 {
-							log.Errorln("Not allowed to process stat. c_wallet_hero lower than 0", key)
-							answer := make(map[string]string)
-							answer["TXN"] = "UpdateStats"
-							event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
-							fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
-							return
-						}
-
-						value = strconv.FormatFloat(newValue, 'f', 4, 64)
-					} else {
-						log.Errorln("Not allowed to process stat", key)
-						answer := make(map[string]string)
-						answer["TXN"] = "UpdateStats"
-						event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
-						fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
-						return
-					}
-				}
-			}
+// answerRejectedStats - tells the game that nothing was written and why
+func (fM *FeslManager) answerRejectedStats(event GameSpy.EventClientTLSCommand, rejected []stats.Rejection) {
+	answer := make(map[string]string)
+	answer["TXN"] = "UpdateStats"
 
-			// We need to append 3 values for each insert/update,
-			// owner, key and value
-			log.Noteln("Updating stats:", userId, owner, key, value)
-			args = append(args, userId)
-			args = append(args, owner)
-			args = append(args, key)
-			args = append(args, value)
-		}
+	for i, rejection := range rejected {
+		log.Errorln("Not allowed to process stat "+rejection.Key+" of hero "+rejection.HeroID+":", rejection.Err)
 
-		_, err = fM.setStatsStatement(keys).Exec(args...)
-		if err != nil {
-			log.Errorln("Failed setting stats for hero "+owner, err.Error())
-		}
+		answer["rejected."+strconv.Itoa(i)+".o"] = rejection.HeroID
+		answer["rejected."+strconv.Itoa(i)+".k"] = rejection.Key
+		answer["rejected."+strconv.Itoa(i)+".reason"] = rejection.Err.Error()
 	}
+	answer["rejected.[]"] = strconv.Itoa(len(rejected))
 
 	event.Client.WriteFESL(event.Command.Query, answer, event.Command.PayloadID)
 	fM.logAnswer(event.Command.Query, answer, event.Command.PayloadID)
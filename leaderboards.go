@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/NeonRG/RG_Backend-V2/stats"
+
+	"github.com/gorilla/mux"
+)
+
+// maxLeaderboardPage - the most heroes one request to /leaderboards/{key} lists
+const maxLeaderboardPage = 100
+
+// registerLeaderboardRoutes - the public leaderboards shown on our community website
+func registerLeaderboardRoutes(r *mux.Router) {
+	r.HandleFunc("/leaderboards", listLeaderboardsHandler).Methods("GET")
+	r.HandleFunc("/leaderboards/{key}", leaderboardHandler).Methods("GET")
+	r.HandleFunc("/leaderboards/{key}/heroes/{heroID}", leaderboardRankHandler).Methods("GET")
+}
+
+func listLeaderboardsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"leaderboards": stats.Definitions.Leaderboards,
+		"periods":      stats.Periods,
+	})
+}
+
+// leaderboardHandler - one page of a leaderboard, ?period=alltime|weekly|season&group=&offset=&limit=
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	period, group := leaderboardFilter(r)
+
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > maxLeaderboardPage {
+		limit = maxLeaderboardPage
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	rankings, err := leaderboards.Top(vars["key"], period, group, offset+1, offset+limit)
+	if err != nil {
+		writeLeaderboardError(w, err)
+		return
+	}
+
+	total, err := leaderboards.Count(vars["key"], period, group)
+	if err != nil {
+		writeLeaderboardError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":      vars["key"],
+		"period":   period,
+		"group":    group,
+		"total":    total,
+		"rankings": rankings,
+	})
+}
+
+// leaderboardRankHandler - where one hero stands
+func leaderboardRankHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	period, group := leaderboardFilter(r)
+
+	ranking, err := leaderboards.Rank(vars["key"], period, group, vars["heroID"])
+	if err != nil {
+		writeLeaderboardError(w, err)
+		return
+	}
+	if ranking == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "hero is not ranked"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ranking)
+}
+
+func leaderboardFilter(r *http.Request) (string, string) {
+	period := r.FormValue("period")
+	if period == "" {
+		period = stats.PeriodAllTime
+	}
+
+	return period, r.FormValue("group")
+}
+
+func writeLeaderboardError(w http.ResponseWriter, err error) {
+	switch err {
+	case stats.ErrUnknownLeaderboard:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case stats.ErrUnknownPeriod:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
@@ -5,6 +5,18 @@ import (
 	"github.com/go-redis/redis"
 )
 
+var updateScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+return redis.call("HMSET", KEYS[1], unpack(ARGV))`)
+
+var incrScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+return redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])`)
+
 // RedisObject Stores a hash-map in redis, provides basic crud-like actions
 type RedisObject struct {
 	redis      *redis.Client
@@ -23,6 +35,12 @@ func (rS *RedisObject) Get(key string) string {
 	return stringCmd.Val()
 }
 
+// GetAll - Get the whole hash-map
+func (rS *RedisObject) GetAll() map[string]string {
+	stringStringMapCmd := rS.redis.HGetAll(rS.identifier)
+	return stringStringMapCmd.Val()
+}
+
 // HKeys - Get a list of the keys in the hash-map
 func (rS *RedisObject) HKeys() []string {
 	stringSliceCmd := rS.redis.HKeys(rS.identifier)
@@ -41,6 +59,33 @@ func (rS *RedisObject) SetM(set map[string]interface{}) error {
 	return statusCmd.Err()
 }
 
+// Update - runs HMSET unless the hash-map was deleted, so late updates don't bring it back
+func (rS *RedisObject) Update(set map[string]interface{}) error {
+	if len(set) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(set)*2)
+	for key, value := range set {
+		args = append(args, key, value)
+	}
+
+	err := updateScript.Run(rS.redis, []string{rS.identifier}, args...).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+// Incr - runs HINCRBY unless the hash-map was deleted, returns the new value
+func (rS *RedisObject) Incr(key string, by int64) (int64, error) {
+	value, err := incrScript.Run(rS.redis, []string{rS.identifier}, key, by).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return value, err
+}
+
 // Delete - Deletes this key
 func (rS *RedisObject) Delete() error {
 	statusCmd := rS.redis.Del(rS.identifier)
@@ -9,12 +9,17 @@ import (
 	"os/signal"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/NeonRG/RG_Backend-V2/GameSpy"
+	"github.com/NeonRG/RG_Backend-V2/auth"
+	"github.com/NeonRG/RG_Backend-V2/bus"
 	"github.com/NeonRG/RG_Backend-V2/core"
 	"github.com/NeonRG/RG_Backend-V2/fesl"
 	"github.com/NeonRG/RG_Backend-V2/log"
 	"github.com/NeonRG/RG_Backend-V2/matchmaking"
+	"github.com/NeonRG/RG_Backend-V2/moderation"
+	"github.com/NeonRG/RG_Backend-V2/stats"
 	"github.com/NeonRG/RG_Backend-V2/theater"
 
 	"github.com/go-redis/redis"
@@ -60,10 +65,43 @@ var (
 		MysqlUser:   "loginserver",
 		MysqlDb:     "loginserver",
 		MysqlPw:     "",
+
+		LoginMaxAttempts:    5,
+		LoginLockoutMinutes: 15,
+		SessionTTLMinutes:   30,
+		SessionPolicy:       auth.PolicyKick,
+
+		PermissionCacheMinutes: 5,
+
+		StatsDefinitions:     "stats.yml",
+		StatsCache:           true,
+		StatsCacheTTLMinutes: 30,
+		StatsFlushSeconds:    5,
+
+		LeaderboardMinutes: 5,
+
+		Matchmaking:        matchmaking.DefaultWeights,
+		GameTimeoutSeconds: 60,
+
+		PingSites:    matchmaking.DefaultPingSites,
+		MinPingSites: 2,
 	}
 
 	mem runtime.MemStats
 
+	redisClient *redis.Client
+
+	credentials *auth.Credentials
+	sessions    *auth.Sessions
+	permissions *auth.Permissions
+	bans        *moderation.Bans
+	serverBans  *moderation.ServerBans
+	statsStore  stats.StatsStore
+
+	leaderboards *stats.Leaderboards
+	seasons      *stats.Seasons
+	lobbies      *matchmaking.Lobbies
+
 	AppName = "HeroesServer"
 
 	Shard string
@@ -89,13 +127,41 @@ func sessionHandler(w http.ResponseWriter, r *http.Request) {
 	if serverKey != "" {
 		log.Noteln("Server " + serverKey + " authenticating.")
 		fmt.Fprintf(w, "<success><token>"+serverKey+"</token></success>")
-	} else {
-		userKey, err := r.Cookie("magma")
-		if err != nil {
+		return
+	}
+
+	// Username/password login, checked against the same credentials as NuLogin
+	nuid, password, ok := r.BasicAuth()
+	if !ok && r.FormValue("nuid") != "" {
+		nuid, password, ok = r.FormValue("nuid"), r.FormValue("password"), true
+	}
+	if ok {
+		user, err := credentials.Verify(nuid, password)
+		switch err {
+		case nil:
+			log.Noteln("User " + user.Username + " authenticated with password.")
+			fmt.Fprint(w, "<success><token code=\"NEW_TOKEN\">"+user.GameToken+"</token></success>")
+		case auth.ErrLockedOut:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<error code=\"ACCOUNT_DISABLED\"></error>")
+		case auth.ErrUserNotFound, auth.ErrWrongPassword, auth.ErrNoPassword:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "<error code=\"INVALID_CREDENTIALS\"></error>")
+		default:
+			log.Errorln("Failed verifying credentials for "+nuid, err)
+			w.WriteHeader(http.StatusInternalServerError)
 		}
-		log.Noteln("<success><token code=\"NEW_TOKEN\">" + userKey.Value + "</token></success>")
-		fmt.Fprintf(w, "<success><token code=\"NEW_TOKEN\">"+userKey.Value+"</token></success>")
+		return
+	}
+
+	userKey, err := r.Cookie("magma")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "<error code=\"INVALID_CREDENTIALS\"></error>")
+		return
 	}
+	log.Noteln("<success><token code=\"NEW_TOKEN\">" + userKey.Value + "</token></success>")
+	fmt.Fprintf(w, "<success><token code=\"NEW_TOKEN\">"+userKey.Value+"</token></success>")
 }
 
 func entitlementsHandler(w http.ResponseWriter, r *http.Request) {
@@ -185,25 +251,10 @@ func main() {
 	r.HandleFunc("/nucleus/wallets/{heroID}", walletsHandler)
 	r.HandleFunc("/ofb/products", offersHandler)
 
-	r.HandleFunc("/", emtpyHandler)
-
-	if localMode {
-		go func() {
-			log.Noteln(http.ListenAndServe("0.0.0.0:8080", r))
-		}()
-		go func() {
-			log.Noteln(http.ListenAndServeTLS("0.0.0.0:443", certFileFlag, keyFileFlag, r))
-		}()
-	} else {
+	registerAdminRoutes(r)
+	registerLeaderboardRoutes(r)
 
-		go func() {
-			log.Noteln(http.ListenAndServe("0.0.0.0:8080", r))
-		}()
-		go func() {
-			log.Noteln(http.ListenAndServeTLS("0.0.0.0:443", certFileFlag, keyFileFlag, r))
-		}()
-	}
-	// Startup done
+	r.HandleFunc("/", emtpyHandler)
 
 	// DB Connection
 	dbConnection := new(core.DB)
@@ -213,7 +264,7 @@ func main() {
 	}
 
 	// Redis Connection
-	redisClient := redis.NewClient(&redis.Options{
+	redisClient = redis.NewClient(&redis.Options{
 		Addr:     MyConfig.RedisServer,
 		Password: MyConfig.RedisPassword,
 		DB:       MyConfig.RedisDB,
@@ -223,6 +274,58 @@ func main() {
 		log.Fatalln("Error connecting to redis:", err)
 	}
 
+	auth.MaxLoginAttempts = MyConfig.LoginMaxAttempts
+	auth.LockoutDuration = time.Minute * time.Duration(MyConfig.LoginLockoutMinutes)
+	credentials = new(auth.Credentials)
+	credentials.New(dbSQL, redisClient)
+
+	auth.SessionTTL = time.Minute * time.Duration(MyConfig.SessionTTLMinutes)
+	if !auth.ValidPolicy(MyConfig.SessionPolicy) {
+		log.Fatalln("SessionPolicy needs to be " + auth.PolicyKick + ", " + auth.PolicyRefuse + " or " + auth.PolicyAllow)
+	}
+	auth.SessionPolicy = MyConfig.SessionPolicy
+	sessions = new(auth.Sessions)
+	sessions.New(redisClient)
+
+	auth.PermissionCacheTTL = time.Minute * time.Duration(MyConfig.PermissionCacheMinutes)
+	permissions = new(auth.Permissions)
+	permissions.New(dbSQL, redisClient)
+
+	bans = new(moderation.Bans)
+	bans.New(dbSQL, redisClient)
+	serverBans = new(moderation.ServerBans)
+	serverBans.New(dbSQL)
+
+	err = stats.Definitions.Load(MyConfig.StatsDefinitions)
+	if err != nil {
+		log.Fatalln("Error loading stat definitions:", err)
+	}
+	statsDatabase := new(stats.MySQLStore)
+	statsDatabase.New(dbSQL)
+	statsStore = statsDatabase
+
+	if MyConfig.StatsCache {
+		if MyConfig.StatsFlushSeconds <= 0 {
+			log.Fatalln("StatsFlushSeconds needs to be at least 1")
+		}
+		stats.CacheTTL = time.Minute * time.Duration(MyConfig.StatsCacheTTLMinutes)
+		stats.FlushInterval = time.Second * time.Duration(MyConfig.StatsFlushSeconds)
+		statsCache := new(stats.RedisStore)
+		statsCache.CheckConsistency = MyConfig.StatsConsistencyCheck
+		statsCache.New(redisClient, statsDatabase)
+		statsStore = statsCache
+	}
+
+	seasons = new(stats.Seasons)
+	seasons.New(dbSQL, redisClient, statsStore)
+
+	if MyConfig.LeaderboardMinutes <= 0 {
+		log.Fatalln("LeaderboardMinutes needs to be at least 1")
+	}
+	stats.LeaderboardInterval = time.Minute * time.Duration(MyConfig.LeaderboardMinutes)
+	leaderboards = new(stats.Leaderboards)
+	leaderboards.New(dbSQL, redisClient)
+
 	// Influx Connection
 	metricConnection := new(core.InfluxDB)
 	err = metricConnection.New(MyConfig.InfluxDBHost, MyConfig.InfluxDBDatabase, MyConfig.InfluxDBUser, MyConfig.InfluxDBPassword, AppName, Version)
@@ -240,23 +343,92 @@ func main() {
 	Shard := GameSpy.BF2RandomUnsafe(6)
 	log.Noteln("Starting up as shard: " + Shard)
 	matchmaking.Shard = Shard
+	matchmaking.Scoring = MyConfig.Matchmaking
+	matchmaking.GameTimeout = time.Second * time.Duration(MyConfig.GameTimeoutSeconds)
+	// Shards confirm they are alive every ReloadInterval, a shorter timeout would reap the games of live shards
+	if matchmaking.GameTimeout <= 2*matchmaking.ReloadInterval {
+		log.Fatalln("GameTimeoutSeconds needs to be more than", 2*matchmaking.ReloadInterval)
+	}
+	// Keys of a game outlive it until the reaper had its chance
+	auth.GameKeysTTL = matchmaking.GameTimeout * 2
+	for mode, policy := range MyConfig.TeamBalance {
+		if policy.WhenFull != matchmaking.BalanceQueue && policy.WhenFull != matchmaking.BalanceRedirect {
+			log.Fatalln("Team balance policy of " + mode + " needs whenFull " + matchmaking.BalanceQueue + " or " + matchmaking.BalanceRedirect)
+		}
+		matchmaking.BalancePolicies[mode] = policy
+	}
+	for _, site := range MyConfig.PingSites {
+		if site.Name == "" || site.Addr == "" {
+			log.Fatalln("Ping sites need a name and an addr")
+		}
+	}
+	if MyConfig.MinPingSites < 0 {
+		log.Fatalln("MinPingSites can't be negative")
+	}
+	if MyConfig.MinPingSites > len(MyConfig.PingSites) {
+		log.Fatalln("MinPingSites is more than the number of ping sites configured")
+	}
+	matchmaking.PingSites = MyConfig.PingSites
+	matchmaking.MinPingSites = MyConfig.MinPingSites
+	for serverID, region := range MyConfig.ServerRegions {
+		if !matchmaking.KnownPingSite(region) {
+			log.Fatalln("Server " + serverID + " is in unknown region " + region)
+		}
+		matchmaking.ServerRegions[serverID] = region
+	}
+	matchmaking.Games.New(redisClient)
+	lobbies = new(matchmaking.Lobbies)
+	lobbies.New(dbSQL)
 	theater.Shard = Shard
+	if localMode {
+		localBus := new(bus.Local)
+		localBus.New(Shard)
+		theater.Bus = localBus
+	} else {
+		redisBus := new(bus.Redis)
+		redisBus.New(Shard, redisClient)
+		theater.Bus = redisBus
+	}
 	fesl.Shard = Shard
+	fesl.Leaderboards = leaderboards
+	fesl.Seasons = seasons
 
 	feslManager := new(fesl.FeslManager)
-	feslManager.New("FM", "18270", certFileFlag, keyFileFlag, false, dbSQL, redisClient, metricConnection, localMode)
+	feslManager.New("FM", "18270", certFileFlag, keyFileFlag, false, dbSQL, redisClient, statsStore, metricConnection, localMode)
 	serverManager := new(fesl.FeslManager)
-	serverManager.New("SFM", "18051", certFileFlag, keyFileFlag, true, dbSQL, redisClient, metricConnection, localMode)
+	serverManager.New("SFM", "18051", certFileFlag, keyFileFlag, true, dbSQL, redisClient, statsStore, metricConnection, localMode)
 
 	theaterManager := new(theater.TheaterManager)
-	theaterManager.New("TM", "18275", dbSQL, redisClient, metricConnection, localMode)
+	theaterManager.New("TM", "18275", dbSQL, redisClient, statsStore, metricConnection, localMode)
 	servertheaterManager := new(theater.TheaterManager)
-	servertheaterManager.New("STM", "18056", dbSQL, redisClient, metricConnection, localMode)
+	servertheaterManager.New("STM", "18056", dbSQL, redisClient, statsStore, metricConnection, localMode)
+
+	// The HTTP handlers use the connections above, so only start listening now
+	if localMode {
+		go func() {
+			log.Noteln(http.ListenAndServe("0.0.0.0:8080", r))
+		}()
+		go func() {
+			log.Noteln(http.ListenAndServeTLS("0.0.0.0:443", certFileFlag, keyFileFlag, r))
+		}()
+	} else {
+
+		go func() {
+			log.Noteln(http.ListenAndServe("0.0.0.0:8080", r))
+		}()
+		go func() {
+			log.Noteln(http.ListenAndServeTLS("0.0.0.0:443", certFileFlag, keyFileFlag, r))
+		}()
+	}
+	// Startup done
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	for sig := range c {
 		log.Noteln("Captured" + sig.String() + ". Shutting down.")
+		if err := statsStore.Flush(); err != nil {
+			log.Errorln("Failed flushing stats on shutdown", err)
+		}
 		os.Exit(0)
 	}
 }
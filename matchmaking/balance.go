@@ -0,0 +1,96 @@
+package matchmaking
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// What happens to heroes whose faction can't join a game right now
+const (
+	// BalanceQueue - they wait in the queue of the game until their faction may join
+	BalanceQueue = "queue"
+	// BalanceRedirect - they are sent to the best other game their faction may join, or queue if there is none
+	BalanceRedirect = "redirect"
+)
+
+// BalancePolicy - how the teams of a game mode are kept even when heroes join
+type BalancePolicy struct {
+	// MaxDifference is how many players one team may have more than the other, 0 doesn't limit it
+	MaxDifference int `yaml:"maxDifference"`
+	// FactionCaps is the most players a faction (c_team) may have, factions without a cap are only held back by MaxDifference
+	FactionCaps map[string]int `yaml:"factionCaps"`
+	// WhenFull is BalanceQueue or BalanceRedirect
+	WhenFull string `yaml:"whenFull"`
+}
+
+// DefaultBalancePolicy - used for game modes without a policy of their own
+var DefaultBalancePolicy = BalancePolicy{MaxDifference: 2, WhenFull: BalanceQueue}
+
+// BalancePolicies - the policy of each game mode, set from the config
+var BalancePolicies = map[string]BalancePolicy{}
+
+// GameModeKey - the gdata key a game server announces its game mode in
+var GameModeKey = "B-U-gamemode"
+
+// PolicyFor returns the balance policy of a game mode
+func PolicyFor(mode string) BalancePolicy {
+	if policy, ok := BalancePolicies[mode]; ok {
+		return policy
+	}
+
+	return DefaultBalancePolicy
+}
+
+// TeamFits tells whether one more hero of team keeps the teams within policy, counts are the players per team
+func TeamFits(policy BalancePolicy, counts map[string]int, team string) bool {
+	// Heroes without a faction can't unbalance anything
+	if team == "" {
+		return true
+	}
+
+	own, other := 0, 0
+	for playing, count := range counts {
+		switch playing {
+		case "":
+		case team:
+			own += count
+		default:
+			other += count
+		}
+	}
+
+	if limit, ok := policy.FactionCaps[team]; ok && limit > 0 && own >= limit {
+		return false
+	}
+
+	return policy.MaxDifference <= 0 || own+1-other <= policy.MaxDifference
+}
+
+// CanJoinTeam tells whether a hero of team may join gid without breaking the balance policy of its game mode
+func CanJoinTeam(redis *redis.Client, gid string, team string) (bool, error) {
+	game := Games.Get(gid)
+	if game == nil {
+		return false, nil
+	}
+
+	counts, err := TeamCounts(redis, gid)
+	if err != nil {
+		return false, err
+	}
+
+	return TeamFits(PolicyFor(game.Mode), counts, team), nil
+}
+
+// TeamCounts returns the live number of players per team of gid
+func TeamCounts(redis *redis.Client, gid string) (map[string]int, error) {
+	players, err := Roster(redis, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, player := range players {
+		counts[player.Team]++
+	}
+
+	return counts, nil
+}
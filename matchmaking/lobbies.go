@@ -0,0 +1,147 @@
+package matchmaking
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+
+	"../log"
+)
+
+// ErrLobbyNotFound - there is no lobby with that id
+var ErrLobbyNotFound = errors.New("lobby not found")
+
+// Lobby - a theater lobby, every game is created in one
+type Lobby struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Locale string `json:"locale"`
+	// MaxGames is how many games may be created in the lobby
+	MaxGames int `json:"maxGames"`
+	// NumGames is how many live games of all shards are in the lobby
+	NumGames int `json:"numGames"`
+}
+
+// Lobbies - the lobbies stored in game_lobbies
+type Lobbies struct {
+	db *sql.DB
+
+	// Database Statements
+	stmtGetLobbies *sql.Stmt
+	stmtGetLobby   *sql.Stmt
+	stmtAddLobby   *sql.Stmt
+}
+
+const lobbyColumns = "id, name, locale, max_games"
+
+// New prepares the statements used for lobbies
+func (l *Lobbies) New(db *sql.DB) {
+	var err error
+
+	l.db = db
+
+	l.stmtGetLobbies, err = l.db.Prepare(
+		"SELECT " + lobbyColumns +
+			"	FROM game_lobbies" +
+			"	ORDER BY id")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetLobbies.", err.Error())
+	}
+
+	l.stmtGetLobby, err = l.db.Prepare(
+		"SELECT " + lobbyColumns +
+			"	FROM game_lobbies" +
+			"	WHERE id = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetLobby.", err.Error())
+	}
+
+	l.stmtAddLobby, err = l.db.Prepare(
+		"INSERT INTO game_lobbies" +
+			"	(name, locale, max_games, created_at)" +
+			"	VALUES (?, ?, ?, NOW())")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddLobby.", err.Error())
+	}
+}
+
+// List returns every lobby with its number of games
+func (l *Lobbies) List() ([]*Lobby, error) {
+	rows, err := l.stmtGetLobbies.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lobbies := []*Lobby{}
+	for rows.Next() {
+		lobby := new(Lobby)
+		if err := rows.Scan(&lobby.ID, &lobby.Name, &lobby.Locale, &lobby.MaxGames); err != nil {
+			return nil, err
+		}
+		lobbies = append(lobbies, lobby)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, game := range Games.List() {
+		counts[game.LobbyID]++
+	}
+	for _, lobby := range lobbies {
+		lobby.NumGames = counts[lobby.ID]
+	}
+
+	return lobbies, nil
+}
+
+// Get returns one lobby with its number of games
+func (l *Lobbies) Get(id string) (*Lobby, error) {
+	lobby := new(Lobby)
+	err := l.stmtGetLobby.QueryRow(id).Scan(&lobby.ID, &lobby.Name, &lobby.Locale, &lobby.MaxGames)
+	if err == sql.ErrNoRows {
+		return nil, ErrLobbyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lobby.NumGames = len(l.Games(id))
+	return lobby, nil
+}
+
+// Add creates a lobby, ID is filled in
+func (l *Lobbies) Add(lobby *Lobby) error {
+	result, err := l.stmtAddLobby.Exec(lobby.Name, lobby.Locale, lobby.MaxGames)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	lobby.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+// Games returns the live games of all shards in the lobby, ordered by GID
+func (l *Lobbies) Games(id string) []*Game {
+	var games []*Game
+	for _, game := range Games.List() {
+		if game.LobbyID == id {
+			games = append(games, game)
+		}
+	}
+
+	sort.Slice(games, func(i, j int) bool {
+		a, _ := strconv.Atoi(games[i].GID)
+		b, _ := strconv.Atoi(games[j].GID)
+		return a < b
+	})
+
+	return games
+}
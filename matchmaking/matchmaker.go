@@ -0,0 +1,267 @@
+package matchmaking
+
+import (
+	"math"
+	"sort"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// Weights - how much each criterion counts when games are scored for a player, 0 ignores it
+type Weights struct {
+	// FreeSlots prefers games that have room but are already populated over empty ones
+	FreeSlots float64 `yaml:"freeSlots"`
+	// Elo prefers games whose average ELO is close to the player's
+	Elo float64 `yaml:"elo"`
+	// TeamBalance prefers games where the player's team is the smaller one
+	TeamBalance float64 `yaml:"teamBalance"`
+	// Region prefers games in the player's region (ping site)
+	Region float64 `yaml:"region"`
+
+	// EloRange is the ELO difference at which a game stops counting as close at all
+	EloRange float64 `yaml:"eloRange"`
+	// PingRange is the latency in ms at which a game in another region stops counting as close at all
+	PingRange float64 `yaml:"pingRange"`
+}
+
+// DefaultWeights - used unless the config says otherwise
+var DefaultWeights = Weights{FreeSlots: 1, Elo: 2, TeamBalance: 1, Region: 3, EloRange: 400, PingRange: 300}
+
+// Scoring - the weights FindGames uses
+var Scoring = DefaultWeights
+
+// gdata keys game servers announce settings of their game in
+var (
+	// RegionKey - the region (ping site) the server is in
+	RegionKey = "B-U-region"
+	// PasswordKey - the password of a private game as in GameServer.password, never stored in gdata.
+	// Clients send it under the same key in EGAM.
+	PasswordKey = "PASSWORD"
+	// ReservedSlotsKey - how many slots are kept for admins and whitelisted heroes
+	ReservedSlotsKey = "B-U-reservedSlots"
+)
+
+// Player - what the matchmaker knows about a hero looking for, or playing in, a game
+type Player struct {
+	HeroID string `json:"heroID"`
+	// Team is c_team (1 national, 2 royal), "" if unknown
+	Team string `json:"team"`
+	// Elo is 0 if unknown
+	Elo float64 `json:"elo"`
+	// Region is the ping site closest to the player, "" if unknown
+	Region string `json:"region,omitempty"`
+	// Pings are the latencies in ms the player measured to the ping sites
+	Pings map[string]int `json:"pings,omitempty"`
+
+	// Name, JoinedAt and Keys are only known of heroes on a roster
+	Name string `json:"name,omitempty"`
+	// JoinedAt is the unix time the game server let the hero in
+	JoinedAt int64 `json:"joinedAt,omitempty"`
+	// Keys are what the game server reported about the hero (UPLA)
+	Keys map[string]string `json:"keys,omitempty"`
+}
+
+// Game - a registered game
+type Game struct {
+	GID string `json:"gid"`
+	// Shard whose theater the game server is connected to
+	Shard   string `json:"shard"`
+	LobbyID string `json:"lid"`
+	// ServerID is the game_servers.id of the host
+	ServerID   string `json:"serverID"`
+	Map        string `json:"map"`
+	Mode       string `json:"mode"`
+	MaxPlayers int    `json:"maxPlayers"`
+	Region     string `json:"region"`
+	// Private games need a password, the matchmaker never offers them
+	Private bool `json:"private"`
+	// ReservedSlots of MaxPlayers are kept for admins and whitelisted heroes
+	ReservedSlots int `json:"reservedSlots"`
+	// Heartbeat is the unix time the shard last confirmed the game
+	Heartbeat int64 `json:"heartbeat"`
+
+	// Players is only filled in by the matchmaker
+	Players []Player `json:"players,omitempty"`
+}
+
+// Candidate - a game the player fits into, Fit is Score scaled to 0-1000 for the pnow answer
+type Candidate struct {
+	GID   string
+	Score float64
+	Fit   int
+}
+
+// FindGames returns up to limit games of any shard with a free slot for each of players, the best fit first.
+// players is one player, or a party whose leader comes first.
+func FindGames(redis *redis.Client, players []Player, limit int) []Candidate {
+	var candidates []Candidate
+
+	for _, game := range Games.List() {
+		// Private games are only joined with their password
+		if game.Private {
+			continue
+		}
+
+		free, err := FreeSlots(redis, game.GID, false)
+		if err != nil {
+			log.Errorln("Failed counting free slots of game "+game.GID, err)
+			continue
+		}
+		if free < len(players) {
+			continue
+		}
+
+		roster, err := Roster(redis, game.GID)
+		if err != nil {
+			log.Errorln("Failed getting players of game "+game.GID, err)
+			continue
+		}
+		game.Players = roster
+
+		if !partyFits(game, players) {
+			continue
+		}
+
+		score := ScoreParty(game, players, Scoring)
+		candidates = append(candidates, Candidate{GID: game.GID, Score: score, Fit: int(math.Round(score * 1000))})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].GID < candidates[j].GID
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	return candidates
+}
+
+// partyFits - players may all join game without breaking the balance policy of its game mode
+func partyFits(game *Game, players []Player) bool {
+	policy := PolicyFor(game.Mode)
+
+	counts := make(map[string]int)
+	for _, playing := range game.Players {
+		counts[playing.Team]++
+	}
+
+	for _, player := range players {
+		if !TeamFits(policy, counts, player.Team) {
+			return false
+		}
+		counts[player.Team]++
+	}
+
+	return true
+}
+
+// Score rates how well player fits into game from 0 to 1, the weighted average of every criterion
+func Score(game *Game, player Player, weights Weights) float64 {
+	total := weights.FreeSlots + weights.Elo + weights.TeamBalance + weights.Region
+	if total <= 0 {
+		return 0
+	}
+
+	score := weights.FreeSlots*freeSlotsScore(game) +
+		weights.Elo*eloScore(game, player, weights.EloRange) +
+		weights.TeamBalance*balanceScore(game, player) +
+		weights.Region*regionScore(game, player, weights.PingRange)
+
+	return score / total
+}
+
+// ScoreParty rates how well players fit into game together, every member is scored as if the ones before
+// had already joined. Parties of one faction so prefer games where that faction can stay together.
+func ScoreParty(game *Game, players []Player, weights Weights) float64 {
+	if len(players) == 0 {
+		return 0
+	}
+
+	joined := *game
+	joined.Players = append([]Player(nil), game.Players...)
+
+	score := 0.0
+	for _, player := range players {
+		score += Score(&joined, player, weights)
+		joined.Players = append(joined.Players, player)
+	}
+
+	return score / float64(len(players))
+}
+
+// freeSlotsScore - how full the game is, full games never get this far
+func freeSlotsScore(game *Game) float64 {
+	if game.MaxPlayers <= 0 {
+		return 0
+	}
+
+	return float64(len(game.Players)) / float64(game.MaxPlayers)
+}
+
+// eloScore - 1 for the same average ELO, 0 from eloRange apart. Unknown ELOs are neutral.
+func eloScore(game *Game, player Player, eloRange float64) float64 {
+	sum, count := 0.0, 0
+	for _, playing := range game.Players {
+		if playing.Elo != 0 {
+			sum += playing.Elo
+			count++
+		}
+	}
+	if count == 0 || player.Elo == 0 || eloRange <= 0 {
+		return 0.5
+	}
+
+	difference := math.Abs(sum/float64(count) - player.Elo)
+	return math.Max(0, 1-difference/eloRange)
+}
+
+// balanceScore - 1 if joining keeps the teams even or evens them out, less the more uneven they get
+func balanceScore(game *Game, player Player) float64 {
+	if player.Team == "" {
+		return 0.5
+	}
+
+	own, other := 0, 0
+	for _, playing := range game.Players {
+		switch playing.Team {
+		case "":
+		case player.Team:
+			own++
+		default:
+			other++
+		}
+	}
+
+	difference := own + 1 - other
+	if difference <= 1 {
+		return 1
+	}
+
+	half := math.Max(1, float64(game.MaxPlayers)/2)
+	return math.Max(0, 1-float64(difference-1)/half)
+}
+
+// regionScore - 1 in the player's region, elsewhere less the higher the player's ping to the game's region,
+// 0 from pingRange on or without a ping. Neutral if either region is unknown.
+func regionScore(game *Game, player Player, pingRange float64) float64 {
+	switch {
+	case game.Region == "" || player.Region == "":
+		return 0.5
+	case game.Region == player.Region:
+		return 1
+	}
+
+	ping, ok := player.Pings[game.Region]
+	if !ok || pingRange <= 0 {
+		return 0
+	}
+
+	// Never as good as the player's own region
+	return math.Max(0, 1-float64(ping)/pingRange) * 0.9
+}
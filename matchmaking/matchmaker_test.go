@@ -0,0 +1,109 @@
+package matchmaking_test
+
+import (
+	"testing"
+
+	"./matchmaking"
+)
+
+func TestScore(t *testing.T) {
+	weights := matchmaking.DefaultWeights
+
+	player := matchmaking.Player{HeroID: "1", Team: "1", Elo: 1000, Region: "gva"}
+	near := &matchmaking.Game{GID: "1", MaxPlayers: 4, Region: "gva", Players: []matchmaking.Player{
+		{HeroID: "2", Team: "2", Elo: 1050},
+	}}
+	far := &matchmaking.Game{GID: "2", MaxPlayers: 4, Region: "nrt", Players: []matchmaking.Player{
+		{HeroID: "3", Team: "1", Elo: 1800},
+	}}
+
+	if matchmaking.Score(near, player, weights) <= matchmaking.Score(far, player, weights) {
+		t.Error("a game in the player's region with a close ELO and the smaller team should score higher")
+	}
+
+	onlyRegion := matchmaking.Weights{Region: 1}
+	if score := matchmaking.Score(far, player, onlyRegion); score != 0 {
+		t.Errorf("Score in another region with only the region weighted = %v, want 0", score)
+	}
+	if score := matchmaking.Score(near, player, matchmaking.Weights{}); score != 0 {
+		t.Errorf("Score without weights = %v, want 0", score)
+	}
+}
+
+func TestScorePing(t *testing.T) {
+	weights := matchmaking.Weights{Region: 1, PingRange: 300}
+	player := matchmaking.Player{HeroID: "1", Region: "gva", Pings: map[string]int{"gva": 20, "iad": 90, "nrt": 250}}
+
+	home := &matchmaking.Game{GID: "1", MaxPlayers: 4, Region: "gva"}
+	near := &matchmaking.Game{GID: "2", MaxPlayers: 4, Region: "iad"}
+	far := &matchmaking.Game{GID: "3", MaxPlayers: 4, Region: "nrt"}
+	unmeasured := &matchmaking.Game{GID: "4", MaxPlayers: 4, Region: "syd"}
+
+	if matchmaking.Score(home, player, weights) <= matchmaking.Score(near, player, weights) {
+		t.Error("a game in the player's region should score higher than one in another region")
+	}
+	if matchmaking.Score(near, player, weights) <= matchmaking.Score(far, player, weights) {
+		t.Error("a game with a lower ping should score higher")
+	}
+	if score := matchmaking.Score(unmeasured, player, weights); score != 0 {
+		t.Errorf("Score in a region the player has no ping to = %v, want 0", score)
+	}
+}
+
+func TestScoreTeamBalance(t *testing.T) {
+	weights := matchmaking.Weights{TeamBalance: 1}
+	game := &matchmaking.Game{GID: "1", MaxPlayers: 8, Players: []matchmaking.Player{
+		{HeroID: "2", Team: "1"},
+		{HeroID: "3", Team: "1"},
+		{HeroID: "4", Team: "1"},
+	}}
+
+	royal := matchmaking.Score(game, matchmaking.Player{HeroID: "5", Team: "2"}, weights)
+	national := matchmaking.Score(game, matchmaking.Player{HeroID: "5", Team: "1"}, weights)
+	if royal != 1 || national >= royal {
+		t.Errorf("joining the smaller team scored %v, the bigger one %v", royal, national)
+	}
+}
+
+func TestScoreParty(t *testing.T) {
+	weights := matchmaking.Weights{TeamBalance: 1}
+
+	party := []matchmaking.Player{{HeroID: "1", Team: "1"}, {HeroID: "2", Team: "1"}}
+	even := &matchmaking.Game{GID: "1", MaxPlayers: 8, Players: []matchmaking.Player{
+		{HeroID: "3", Team: "1"}, {HeroID: "4", Team: "2"},
+	}}
+	short := &matchmaking.Game{GID: "2", MaxPlayers: 8, Players: []matchmaking.Player{
+		{HeroID: "5", Team: "2"}, {HeroID: "6", Team: "2"},
+	}}
+
+	if matchmaking.ScoreParty(short, party, weights) <= matchmaking.ScoreParty(even, party, weights) {
+		t.Error("a party should prefer the game where its faction is short of players")
+	}
+	if len(even.Players) != 2 {
+		t.Errorf("ScoreParty changed the game, %v players instead of 2", len(even.Players))
+	}
+}
+
+func TestTeamFits(t *testing.T) {
+	policy := matchmaking.BalancePolicy{MaxDifference: 2, FactionCaps: map[string]int{"2": 3}}
+
+	tests := []struct {
+		counts map[string]int
+		team   string
+		want   bool
+	}{
+		{map[string]int{}, "1", true},
+		{map[string]int{"1": 1}, "1", true},
+		{map[string]int{"1": 2}, "1", false},
+		{map[string]int{"1": 4, "2": 2}, "1", false},
+		{map[string]int{"1": 4, "2": 2}, "2", true},
+		{map[string]int{"1": 5, "2": 3}, "2", false},
+		{map[string]int{"1": 9}, "", true},
+	}
+
+	for _, test := range tests {
+		if got := matchmaking.TeamFits(policy, test.counts, test.team); got != test.want {
+			t.Errorf("TeamFits(%v, %q) = %v, want %v", test.counts, test.team, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package matchmaking
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrPartyNotFound - everyone left the party, or it never existed
+	ErrPartyNotFound = errors.New("party not found")
+	// ErrInParty - heroes have to leave their party before they start or join another one
+	ErrInParty = errors.New("hero is already in a party")
+	// ErrNotInParty - the hero plays alone
+	ErrNotInParty = errors.New("hero is not in a party")
+	// ErrNotLeader - only the leader invites and matchmakes
+	ErrNotLeader = errors.New("only the party leader may do that")
+	// ErrNotInvited - the invite never existed or timed out
+	ErrNotInvited = errors.New("hero wasn't invited to the party")
+	// ErrPartyFull - the party has MaxPartySize members
+	ErrPartyFull = errors.New("party is full")
+)
+
+var (
+	// MaxPartySize - how many heroes, the leader included, may matchmake together
+	MaxPartySize = 4
+	// InviteTimeout - how long an invite can be accepted
+	InviteTimeout = time.Minute * 5
+)
+
+// Redis hash of the party each hero is in, and the counter party IDs come from
+const (
+	partyHeroesKey  = "parties:heroes"
+	partyCounterKey = "counters:party"
+)
+
+// Party - heroes who want to play on the same game, Members[0] is the leader
+type Party struct {
+	ID      string
+	Members []string
+}
+
+// Leader - the hero who matchmakes for the party
+func (p *Party) Leader() string {
+	return p.Members[0]
+}
+
+// CreateParty starts a party led by heroID
+func CreateParty(redis *redis.Client, heroID string) (*Party, error) {
+	if PartyOf(redis, heroID) != "" {
+		return nil, ErrInParty
+	}
+
+	id, err := redis.Incr(partyCounterKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	party := &Party{ID: strconv.FormatInt(id, 10), Members: []string{heroID}}
+
+	// Another party may have been created for heroID in the meantime
+	created, err := redis.HSetNX(partyHeroesKey, heroID, party.ID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrInParty
+	}
+
+	return party, redis.RPush(partyMembersKey(party.ID), heroID).Err()
+}
+
+// GetParty returns the party, ErrPartyNotFound once everyone left it
+func GetParty(redis *redis.Client, partyID string) (*Party, error) {
+	members, err := redis.LRange(partyMembersKey(partyID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, ErrPartyNotFound
+	}
+
+	return &Party{ID: partyID, Members: members}, nil
+}
+
+// PartyOf returns the ID of the party heroID is in, "" if it plays alone
+func PartyOf(redis *redis.Client, heroID string) string {
+	return redis.HGet(partyHeroesKey, heroID).Val()
+}
+
+// InviteToParty - leaderID invites heroID to its party
+func InviteToParty(redis *redis.Client, leaderID string, heroID string) (*Party, error) {
+	party, err := GetParty(redis, PartyOf(redis, leaderID))
+	if err == ErrPartyNotFound {
+		return nil, ErrNotInParty
+	}
+	if err != nil {
+		return nil, err
+	}
+	if party.Leader() != leaderID {
+		return nil, ErrNotLeader
+	}
+	if len(party.Members) >= MaxPartySize {
+		return nil, ErrPartyFull
+	}
+
+	if err := redis.SAdd(partyInvitesKey(heroID), party.ID).Err(); err != nil {
+		return nil, err
+	}
+
+	return party, redis.Expire(partyInvitesKey(heroID), InviteTimeout).Err()
+}
+
+// Invites returns the IDs of the parties heroID is invited to
+func Invites(redis *redis.Client, heroID string) ([]string, error) {
+	return redis.SMembers(partyInvitesKey(heroID)).Result()
+}
+
+// AcceptInvite - heroID joins the party that invited it
+func AcceptInvite(client *redis.Client, partyID string, heroID string) (*Party, error) {
+	invited, err := client.SIsMember(partyInvitesKey(heroID), partyID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !invited {
+		return nil, ErrNotInvited
+	}
+
+	// The party must not fill up or disband while heroID joins
+	join := func(tx *redis.Tx) error {
+		members, err := tx.LLen(partyMembersKey(partyID)).Result()
+		if err != nil {
+			return err
+		}
+		if members == 0 {
+			return ErrPartyNotFound
+		}
+		if int(members) >= MaxPartySize {
+			return ErrPartyFull
+		}
+
+		if tx.HExists(partyHeroesKey, heroID).Val() {
+			return ErrInParty
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(partyHeroesKey, heroID, partyID)
+			pipe.RPush(partyMembersKey(partyID), heroID)
+			pipe.SRem(partyInvitesKey(heroID), partyID)
+			return nil
+		})
+		return err
+	}
+
+	err = client.Watch(join, partyMembersKey(partyID), partyHeroesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetParty(client, partyID)
+}
+
+// LeaveParty - heroID leaves its party, if it led it the member who joined next leads now
+func LeaveParty(client *redis.Client, heroID string) error {
+	partyID := PartyOf(client, heroID)
+	if partyID == "" {
+		return ErrNotInParty
+	}
+
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LRem(partyMembersKey(partyID), 0, heroID)
+		pipe.HDel(partyHeroesKey, heroID)
+		return nil
+	})
+
+	return err
+}
+
+func partyMembersKey(partyID string) string {
+	return "parties:" + partyID + ":members"
+}
+
+func partyInvitesKey(heroID string) string {
+	return "parties:invites:" + heroID
+}
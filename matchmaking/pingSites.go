@@ -0,0 +1,64 @@
+package matchmaking
+
+// PingSite - an endpoint clients measure their latency to. Game servers are tagged with the name of the
+// ping site closest to them, that name is the region of their games.
+type PingSite struct {
+	Name string `yaml:"name" json:"name"`
+	Addr string `yaml:"addr" json:"addr"`
+	// Type is passed on to clients as is
+	Type int `yaml:"type" json:"type"`
+}
+
+// DefaultPingSites - used unless the config lists its own
+var DefaultPingSites = []PingSite{
+	{Name: "gva", Addr: "45.77.66.233"},
+	{Name: "nrt", Addr: "45.77.76.193"},
+}
+
+var (
+	// PingSites - announced by GetPingSites, regions and latencies of other sites are ignored
+	PingSites = DefaultPingSites
+	// MinPingSites - how many of PingSites clients measure at least
+	MinPingSites = 2
+	// ServerRegions - game_servers.id to the ping site the server is at, overrides the region the server announces
+	ServerRegions = make(map[string]string)
+)
+
+// KnownPingSite tells whether name is one of PingSites
+func KnownPingSite(name string) bool {
+	for _, site := range PingSites {
+		if site.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RegionOf returns the region of the games of serverID, which announced region (B-U-region). "" if unknown.
+func RegionOf(serverID string, announced string) string {
+	if region, ok := ServerRegions[serverID]; ok {
+		return region
+	}
+	if KnownPingSite(announced) {
+		return announced
+	}
+
+	return ""
+}
+
+// ClosestPingSite returns the known ping site with the lowest latency in pings, "" if there is none
+func ClosestPingSite(pings map[string]int) string {
+	closest := ""
+	for _, site := range PingSites {
+		ping, ok := pings[site.Name]
+		if !ok {
+			continue
+		}
+		if closest == "" || ping < pings[closest] {
+			closest = site.Name
+		}
+	}
+
+	return closest
+}
@@ -0,0 +1,196 @@
+package matchmaking
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis hashes remembering which game heroes play on and game servers host, shared by all shards
+const (
+	heroGamesKey   = "games:heroes"
+	serverGamesKey = "games:servers"
+)
+
+// LeftGameGrace - how long game servers may still report stats of a hero that left their game
+var LeftGameGrace = time.Minute * 5
+
+// JoinedGame - the game server let player into gid (PENT), team and elo are what the matchmaker balances by
+func JoinedGame(redis *redis.Client, gid string, player Player) error {
+	if err := ReleaseReservation(redis, gid, player.HeroID); err != nil {
+		return err
+	}
+	if err := redis.ZRem(joiningKey(gid), player.HeroID).Err(); err != nil {
+		return err
+	}
+
+	if player.JoinedAt == 0 {
+		player.JoinedAt = time.Now().Unix()
+	}
+	player.Keys = nil
+
+	entry, err := json.Marshal(player)
+	if err != nil {
+		return err
+	}
+	if err := redis.HSet(rosterKey(gid), player.HeroID, entry).Err(); err != nil {
+		return err
+	}
+
+	return redis.HSet(heroGamesKey, player.HeroID, gid).Err()
+}
+
+// UpdatePlayer - the game server reported keys about heroID (UPLA), they replace the ones reported before
+func UpdatePlayer(redis *redis.Client, gid string, heroID string, keys map[string]string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]interface{}, len(keys))
+	for key, value := range keys {
+		fields[heroID+":"+key] = value
+	}
+
+	return redis.HMSet(playerKeysKey(gid), fields).Err()
+}
+
+// LeftGame - heroID left gid (PLVT), a game it joined since then is left alone
+func LeftGame(redis *redis.Client, gid string, heroID string) error {
+	if removed, err := redis.HDel(rosterKey(gid), heroID).Result(); err != nil || removed == 0 {
+		return err
+	}
+
+	fields, _ := redis.HKeys(playerKeysKey(gid)).Result()
+	var keys []string
+	for _, field := range fields {
+		if strings.HasPrefix(field, heroID+":") {
+			keys = append(keys, field)
+		}
+	}
+	if len(keys) > 0 {
+		redis.HDel(playerKeysKey(gid), keys...)
+	}
+
+	// The server may report the last stats of the hero after it left
+	redis.Set(leftGameKey(heroID), gid, LeftGameGrace)
+
+	if GameOfHero(redis, heroID) != gid {
+		return nil
+	}
+	return redis.HDel(heroGamesKey, heroID).Err()
+}
+
+// EndedGame - the server of gid shut down, its players, queue and reservations are gone with it
+func EndedGame(redis *redis.Client, gid string) error {
+	return redis.Del(rosterKey(gid), playerKeysKey(gid), queueKey(gid), queueShardsKey(gid), reservedKey(gid), joiningKey(gid), whitelistKey(gid)).Err()
+}
+
+// Roster returns every hero playing on gid, without their keys
+func Roster(redis *redis.Client, gid string) ([]Player, error) {
+	roster, err := redis.HGetAll(rosterKey(gid)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var players []Player
+	for heroID, entry := range roster {
+		var player Player
+		if err := json.Unmarshal([]byte(entry), &player); err != nil {
+			log.Errorln("Invalid roster entry of hero "+heroID+" on game "+gid, err)
+		}
+		player.HeroID = heroID
+		players = append(players, player)
+	}
+
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].JoinedAt < players[j].JoinedAt
+	})
+
+	return players, nil
+}
+
+// FullRoster returns every hero playing on gid along with the keys the game server reported about them
+func FullRoster(redis *redis.Client, gid string) ([]Player, error) {
+	players, err := Roster(redis, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := redis.HGetAll(playerKeysKey(gid)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]map[string]string)
+	for field, value := range fields {
+		i := strings.Index(field, ":")
+		if i < 0 {
+			continue
+		}
+
+		heroID := field[:i]
+		if keys[heroID] == nil {
+			keys[heroID] = make(map[string]string)
+		}
+		keys[heroID][field[i+1:]] = value
+	}
+
+	for i := range players {
+		players[i].Keys = keys[players[i].HeroID]
+	}
+
+	return players, nil
+}
+
+// PlayerCount returns how many heroes play on gid
+func PlayerCount(redis *redis.Client, gid string) (int, error) {
+	count, err := redis.HLen(rosterKey(gid)).Result()
+	return int(count), err
+}
+
+// HostingGame - serverID (game_servers.id) created gid (CGAM), an empty gid means it shut down
+func HostingGame(redis *redis.Client, serverID string, gid string) error {
+	if gid == "" {
+		return redis.HDel(serverGamesKey, serverID).Err()
+	}
+
+	return redis.HSet(serverGamesKey, serverID, gid).Err()
+}
+
+// GameOfHero returns the GID heroID plays on, "" if it isn't in a game
+func GameOfHero(redis *redis.Client, heroID string) string {
+	return redis.HGet(heroGamesKey, heroID).Val()
+}
+
+// PlaysOn reports whether heroID plays on gid or left it within LeftGameGrace
+func PlaysOn(redis *redis.Client, heroID string, gid string) bool {
+	if gid == "" {
+		return false
+	}
+
+	return GameOfHero(redis, heroID) == gid || redis.Get(leftGameKey(heroID)).Val() == gid
+}
+
+// GameOfServer returns the GID serverID hosts, "" if it isn't hosting
+func GameOfServer(redis *redis.Client, serverID string) string {
+	return redis.HGet(serverGamesKey, serverID).Val()
+}
+
+func rosterKey(gid string) string {
+	return "games:" + gid + ":players"
+}
+
+// Keys the game server reported about the heroes on gid, fields are <heroID>:<key>
+func playerKeysKey(gid string) string {
+	return "games:" + gid + ":playerKeys"
+}
+
+// The game heroID left last, kept for LeftGameGrace
+func leftGameKey(heroID string) string {
+	return "games:left:" + heroID
+}
@@ -0,0 +1,78 @@
+package matchmaking
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// QueuedPlayer - a hero waiting for a slot on a full game
+type QueuedPlayer struct {
+	HeroID string
+	// Shard whose theater the hero's client is connected to
+	Shard string
+	// Position is 1 for the hero waiting longest
+	Position int
+}
+
+// Enqueue puts heroID at the end of the queue of gid and returns its position,
+// a hero that is already queued keeps its place
+func Enqueue(client *redis.Client, gid string, heroID string, shard string) (int, error) {
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAddNX(queueKey(gid), redis.Z{Score: float64(time.Now().UnixNano()), Member: heroID})
+		pipe.HSet(queueShardsKey(gid), heroID, shard)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rank, err := client.ZRank(queueKey(gid), heroID).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rank) + 1, nil
+}
+
+// Dequeue takes heroID out of the queue of gid, false if it wasn't queued
+func Dequeue(redis *redis.Client, gid string, heroID string) (bool, error) {
+	removed, err := redis.ZRem(queueKey(gid), heroID).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	return true, redis.HDel(queueShardsKey(gid), heroID).Err()
+}
+
+// Queue returns everyone waiting for gid, in order
+func Queue(redis *redis.Client, gid string) ([]QueuedPlayer, error) {
+	heroIDs, err := redis.ZRange(queueKey(gid), 0, -1).Result()
+	if err != nil || len(heroIDs) == 0 {
+		return nil, err
+	}
+
+	shards, err := redis.HMGet(queueShardsKey(gid), heroIDs...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	queue := make([]QueuedPlayer, len(heroIDs))
+	for i, heroID := range heroIDs {
+		queue[i] = QueuedPlayer{HeroID: heroID, Position: i + 1}
+		if shard, ok := shards[i].(string); ok {
+			queue[i].Shard = shard
+		}
+	}
+
+	return queue, nil
+}
+
+func queueKey(gid string) string {
+	return "games:" + gid + ":queue"
+}
+
+// Which shard each queued hero waits on
+func queueShardsKey(gid string) string {
+	return "games:" + gid + ":queue:shards"
+}
@@ -0,0 +1,404 @@
+package matchmaking
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"../GameSpy"
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// GamesChannel - redis pub/sub channel announcing the GID of every registered, updated or removed game
+const GamesChannel = "games:changed"
+
+// Set of the GIDs of every registered game
+const activeGamesKey = "games:active"
+
+// ErrGameRemoved - the game was removed, changes to it are dropped
+var ErrGameRemoved = errors.New("game removed")
+
+var (
+	// ReloadInterval - how often a shard reloads every game and confirms it is still alive
+	ReloadInterval = time.Second * 10
+	// GameTimeout - games whose server sent nothing (PING, UGAM) for this long are left out of matchmaking and reaped,
+	// shards that didn't confirm they are alive for this long are dead
+	GameTimeout = time.Minute
+)
+
+// updateScript changes a game only while it is registered, so an update racing the reaper can't bring
+// a removed game back. KEYS are activeGamesKey, the game hash and its password key. ARGV is the GID,
+// "set", "del" or "keep" for the password, the password hash, whether to announce the change and the
+// field/value pairs. Returns 0 if the game isn't registered.
+var updateScript = redis.NewScript(`
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 or redis.call("EXISTS", KEYS[2]) == 0 then
+	return 0
+end
+
+redis.call("HMSET", KEYS[2], unpack(ARGV, 5))
+if ARGV[2] == "set" then
+	redis.call("SET", KEYS[3], ARGV[3])
+elseif ARGV[2] == "del" then
+	redis.call("DEL", KEYS[3])
+end
+if ARGV[4] == "1" then
+	redis.call("PUBLISH", "` + GamesChannel + `", ARGV[1])
+end
+return 1`)
+
+// GameRegistry - every game of every shard, stored in redis. Each shard keeps an index of all games,
+// updated through GamesChannel, and the connections of the game servers connected to it.
+type GameRegistry struct {
+	redis *redis.Client
+
+	mutex       sync.RWMutex
+	games       map[string]*Game
+	connections map[string]*GameSpy.Client
+}
+
+// Games - the registry of this shard
+var Games = new(GameRegistry)
+
+// New loads the games of all shards and keeps them up to date
+func (r *GameRegistry) New(redis *redis.Client) {
+	r.redis = redis
+	r.games = make(map[string]*Game)
+	r.connections = make(map[string]*GameSpy.Client)
+
+	pubsub := r.redis.Subscribe(GamesChannel)
+	r.alive()
+	r.reload()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			r.refresh(msg.Payload)
+		}
+	}()
+
+	go func() {
+		for range time.NewTicker(ReloadInterval).C {
+			r.alive()
+			// Catches up on notifications missed while redis was unreachable
+			r.reload()
+		}
+	}()
+}
+
+// Register adds a game hosted by client on this shard, private games get password
+func (r *GameRegistry) Register(gid string, client *GameSpy.Client, game *Game, password string) error {
+	game.GID = gid
+	game.Shard = Shard
+	game.Heartbeat = time.Now().Unix()
+	game.Private = password != ""
+
+	r.mutex.Lock()
+	r.connections[gid] = client
+	r.games[gid] = game
+	r.mutex.Unlock()
+
+	_, err := r.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(gameKey(gid), map[string]interface{}{
+			"shard":         game.Shard,
+			"lid":           game.LobbyID,
+			"serverID":      game.ServerID,
+			"map":           game.Map,
+			"mode":          game.Mode,
+			"maxPlayers":    game.MaxPlayers,
+			"region":        game.Region,
+			"private":       game.Private,
+			"reservedSlots": game.ReservedSlots,
+			"heartbeat":     game.Heartbeat,
+		})
+		setPassword(pipe, gid, password)
+		pipe.SAdd(activeGamesKey, gid)
+		pipe.Publish(GamesChannel, gid)
+		return nil
+	})
+
+	return err
+}
+
+// Update takes over what a game server changed about its game, gdata uses the keys of CGAM/UGAM
+func (r *GameRegistry) Update(gid string, gdata map[string]string) error {
+	fields := map[string]interface{}{"heartbeat": time.Now().Unix()}
+	if maxPlayers, err := strconv.Atoi(gdata["MAX-PLAYERS"]); err == nil {
+		fields["maxPlayers"] = maxPlayers
+	}
+	if gameMap, ok := gdata["B-U-map"]; ok {
+		fields["map"] = gameMap
+	}
+	if mode, ok := gdata[GameModeKey]; ok {
+		fields["mode"] = mode
+	}
+	// The caller resolved the region with RegionOf already
+	if region, ok := gdata[RegionKey]; ok {
+		fields["region"] = region
+	}
+	if reservedSlots, err := strconv.Atoi(gdata[ReservedSlotsKey]); err == nil {
+		fields["reservedSlots"] = reservedSlots
+	}
+	passwordMode, passwordHash := "keep", ""
+	if password, ok := gdata[PasswordKey]; ok {
+		fields["private"] = password != ""
+		passwordMode = "del"
+		if password != "" {
+			passwordMode, passwordHash = "set", hashPassword(gid, password)
+		}
+	}
+
+	return r.update(gid, fields, passwordMode, passwordHash, true)
+}
+
+// update writes fields of a registered game, a game removed meanwhile stays removed
+func (r *GameRegistry) update(gid string, fields map[string]interface{}, passwordMode string, passwordHash string, announce bool) error {
+	published := "0"
+	if announce {
+		published = "1"
+	}
+
+	args := []interface{}{gid, passwordMode, passwordHash, published}
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+
+	updated, err := updateScript.Run(r.redis, []string{activeGamesKey, gameKey(gid), passwordKey(gid)}, args...).Int64()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrGameRemoved
+	}
+
+	return nil
+}
+
+// Remove drops a game whose server shut down
+func (r *GameRegistry) Remove(gid string) error {
+	r.mutex.Lock()
+	delete(r.connections, gid)
+	delete(r.games, gid)
+	r.mutex.Unlock()
+
+	_, err := r.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(gameKey(gid), passwordKey(gid))
+		pipe.SRem(activeGamesKey, gid)
+		pipe.Publish(GamesChannel, gid)
+		return nil
+	})
+
+	return err
+}
+
+// CheckPassword tells whether password lets heroes into gid, any password does for public games
+func (r *GameRegistry) CheckPassword(gid string, password string) bool {
+	stored, err := r.redis.Get(passwordKey(gid)).Result()
+	if err == redis.Nil {
+		return true
+	}
+	if err != nil {
+		log.Errorln("Failed getting password of game "+gid, err)
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashPassword(gid, password)), []byte(stored)) == 1
+}
+
+// Connection returns the connection of the server hosting gid, if it is connected to this shard
+func (r *GameRegistry) Connection(gid string) (*GameSpy.Client, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	client, ok := r.connections[gid]
+	return client, ok
+}
+
+// Get returns a copy of the game, nil if it isn't registered
+func (r *GameRegistry) Get(gid string) *Game {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	game, ok := r.games[gid]
+	if !ok {
+		return nil
+	}
+
+	copied := *game
+	return &copied
+}
+
+// List returns copies of every game of every shard that had a heartbeat within GameTimeout
+func (r *GameRegistry) List() []*Game {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	alive := time.Now().Add(-GameTimeout).Unix()
+
+	var games []*Game
+	for _, game := range r.games {
+		if game.Heartbeat < alive {
+			continue
+		}
+
+		copied := *game
+		games = append(games, &copied)
+	}
+
+	return games
+}
+
+// Heartbeat - the server of gid just sent something, so it is still there
+func (r *GameRegistry) Heartbeat(gid string) error {
+	return r.update(gid, map[string]interface{}{"heartbeat": time.Now().Unix()}, "keep", "", false)
+}
+
+// Stale returns the games of all shards whose server sent nothing for GameTimeout
+func (r *GameRegistry) Stale() []*Game {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	alive := time.Now().Add(-GameTimeout).Unix()
+
+	var games []*Game
+	for _, game := range r.games {
+		if game.Heartbeat < alive {
+			copied := *game
+			games = append(games, &copied)
+		}
+	}
+
+	return games
+}
+
+// ShardAlive tells whether shard confirmed it is running within GameTimeout
+func (r *GameRegistry) ShardAlive(shard string) bool {
+	return r.redis.Exists(shardKey(shard)).Val() == 1
+}
+
+// alive confirms this shard is running
+func (r *GameRegistry) alive() {
+	if err := r.redis.Set(shardKey(Shard), time.Now().Unix(), GameTimeout).Err(); err != nil {
+		log.Errorln("Failed confirming shard "+Shard+" is alive", err)
+	}
+}
+
+// reload reads every registered game from redis
+func (r *GameRegistry) reload() {
+	gids, err := r.redis.SMembers(activeGamesKey).Result()
+	if err != nil {
+		log.Errorln("Failed loading registered games", err)
+		return
+	}
+
+	games := make(map[string]*Game)
+	for _, gid := range gids {
+		game, err := r.load(gid)
+		if err != nil {
+			log.Errorln("Failed loading game "+gid, err)
+			continue
+		}
+		if game != nil {
+			games[gid] = game
+		}
+	}
+
+	r.mutex.Lock()
+	r.games = games
+	r.mutex.Unlock()
+}
+
+// refresh reads one game from redis after a notification
+func (r *GameRegistry) refresh(gid string) {
+	game, err := r.load(gid)
+	if err != nil {
+		log.Errorln("Failed loading game "+gid, err)
+		return
+	}
+
+	r.mutex.Lock()
+	if game != nil {
+		r.games[gid] = game
+		r.mutex.Unlock()
+		return
+	}
+
+	delete(r.games, gid)
+	client, connected := r.connections[gid]
+	delete(r.connections, gid)
+	r.mutex.Unlock()
+
+	// Another shard reaped a game whose server is connected here, the connection is as dead as the game
+	if connected {
+		client.Close()
+	}
+}
+
+// load returns the game stored in redis, nil if it was removed
+func (r *GameRegistry) load(gid string) (*Game, error) {
+	var active *redis.BoolCmd
+	var hash *redis.StringStringMapCmd
+	_, err := r.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		active = pipe.SIsMember(activeGamesKey, gid)
+		hash = pipe.HGetAll(gameKey(gid))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A hash left behind by an update racing Remove doesn't make the game registered
+	data := hash.Val()
+	if !active.Val() || len(data) == 0 {
+		return nil, nil
+	}
+
+	game := &Game{
+		GID:      gid,
+		Shard:    data["shard"],
+		LobbyID:  data["lid"],
+		ServerID: data["serverID"],
+		Map:      data["map"],
+		Mode:     data["mode"],
+		Region:   data["region"],
+	}
+	game.MaxPlayers, _ = strconv.Atoi(data["maxPlayers"])
+	game.ReservedSlots, _ = strconv.Atoi(data["reservedSlots"])
+	game.Private, _ = strconv.ParseBool(data["private"])
+	game.Heartbeat, _ = strconv.ParseInt(data["heartbeat"], 10, 64)
+
+	return game, nil
+}
+
+func shardKey(shard string) string {
+	return "shards:" + shard
+}
+
+func gameKey(gid string) string {
+	return "games:" + gid
+}
+
+// setPassword - an empty password makes the game public
+func setPassword(pipe redis.Pipeliner, gid string, password string) {
+	if password == "" {
+		pipe.Del(passwordKey(gid))
+		return
+	}
+
+	pipe.Set(passwordKey(gid), hashPassword(gid, password), 0)
+}
+
+// hashPassword salts with the GID, games sharing a password don't share the hash
+func hashPassword(gid string, password string) string {
+	sum := sha256.Sum256([]byte(gid + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Kept apart from the game hash, which every shard loads
+func passwordKey(gid string) string {
+	return "games:" + gid + ":password"
+}
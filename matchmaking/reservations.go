@@ -0,0 +1,175 @@
+package matchmaking
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ReservationTimeout - how long a reserved slot waits for its hero to join
+var ReservationTimeout = time.Minute * 2
+
+// Redis hash of the GID each reserved hero may join
+const reservationsKey = "games:reservations"
+
+// Reservation - a slot held on a game for one hero
+type Reservation struct {
+	HeroID string `json:"heroID"`
+	// ExpiresAt is the unix time the slot is given up if the hero didn't join
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// Reserve holds a slot on gid for each of heroIDs, full-game checks count them until they join or time out
+func Reserve(client *redis.Client, gid string, heroIDs []string) error {
+	return ReserveFor(client, gid, heroIDs, ReservationTimeout)
+}
+
+// ReserveFor holds a slot on gid for each of heroIDs for ttl, like tournament tooling does for whole matches
+func ReserveFor(client *redis.Client, gid string, heroIDs []string, ttl time.Duration) error {
+	expires := float64(time.Now().Add(ttl).Unix())
+
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, heroID := range heroIDs {
+			pipe.ZAdd(reservedKey(gid), redis.Z{Score: expires, Member: heroID})
+			pipe.HSet(reservationsKey, heroID, gid)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// reserveScript counts the free slots of a game and reserves them in one step, so two parties can't
+// both take the last slots. KEYS are the roster, joining and reserved sets of the game and reservationsKey.
+// ARGV is now, the expiry of the reservations, the slots unprivileged heroes may take (-1 for no limit),
+// the GID and the heroes. Returns 0 without reserving anything if they don't all fit.
+var reserveScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", "(" .. ARGV[1])
+
+local capacity = tonumber(ARGV[3])
+if capacity >= 0 then
+	local taken = redis.call("HLEN", KEYS[1]) + redis.call("ZCARD", KEYS[2]) + redis.call("ZCARD", KEYS[3])
+	local wanted = 0
+	for i = 5, #ARGV do
+		if not redis.call("ZSCORE", KEYS[3], ARGV[i]) then
+			wanted = wanted + 1
+		end
+	end
+	if taken + wanted > capacity then
+		return 0
+	end
+end
+
+for i = 5, #ARGV do
+	redis.call("ZADD", KEYS[3], ARGV[2], ARGV[i])
+	redis.call("HSET", KEYS[4], ARGV[i], ARGV[4])
+end
+return 1`)
+
+// ReserveIfFree holds a slot on gid for each of heroIDs like Reserve, but only if all of them fit.
+// It returns false without reserving anything when the game doesn't have the room.
+func ReserveIfFree(client *redis.Client, gid string, heroIDs []string) (bool, error) {
+	game := Games.Get(gid)
+	if game == nil {
+		return false, nil
+	}
+
+	capacity := -1
+	if game.MaxPlayers > 0 {
+		capacity = game.MaxPlayers - game.ReservedSlots
+	}
+
+	now := time.Now()
+	args := []interface{}{now.Unix(), now.Add(ReservationTimeout).Unix(), capacity, gid}
+	for _, heroID := range heroIDs {
+		args = append(args, heroID)
+	}
+
+	reserved, err := reserveScript.Run(client, []string{rosterKey(gid), joiningKey(gid), reservedKey(gid), reservationsKey}, args...).Int64()
+	return reserved == 1, err
+}
+
+// Reserved returns how many slots of gid are held for heroes that didn't join yet
+func Reserved(redis *redis.Client, gid string) (int, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := redis.ZRemRangeByScore(reservedKey(gid), "-inf", "("+now).Err(); err != nil {
+		return 0, err
+	}
+
+	count, err := redis.ZCard(reservedKey(gid)).Result()
+	return int(count), err
+}
+
+// Reservations returns the slots held on gid
+func Reservations(redis *redis.Client, gid string) ([]Reservation, error) {
+	if _, err := Reserved(redis, gid); err != nil {
+		return nil, err
+	}
+
+	held, err := redis.ZRangeWithScores(reservedKey(gid), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := []Reservation{}
+	for _, z := range held {
+		reservations = append(reservations, Reservation{HeroID: z.Member.(string), ExpiresAt: int64(z.Score)})
+	}
+
+	return reservations, nil
+}
+
+// ReservedGame returns the GID a slot is held on for heroID, "" if there is none
+func ReservedGame(redis *redis.Client, heroID string) string {
+	gid := redis.HGet(reservationsKey, heroID).Val()
+	if gid == "" {
+		return ""
+	}
+
+	expires, err := redis.ZScore(reservedKey(gid), heroID).Result()
+	if err != nil || int64(expires) < time.Now().Unix() {
+		redis.HDel(reservationsKey, heroID)
+		return ""
+	}
+
+	return gid
+}
+
+// ReleaseReservation - heroID joined gid and its slot counts as a player now, or the reservation got cancelled
+func ReleaseReservation(redis *redis.Client, gid string, heroID string) error {
+	if redis.HGet(reservationsKey, heroID).Val() == gid {
+		redis.HDel(reservationsKey, heroID)
+	}
+
+	return redis.ZRem(reservedKey(gid), heroID).Err()
+}
+
+// Whitelist returns the heroes allowed to use the reserved slots of gid, besides admins
+func Whitelist(redis *redis.Client, gid string) ([]string, error) {
+	return redis.SMembers(whitelistKey(gid)).Result()
+}
+
+// Whitelisted tells whether heroID may use the reserved slots of gid
+func Whitelisted(redis *redis.Client, gid string, heroID string) bool {
+	return redis.SIsMember(whitelistKey(gid), heroID).Val()
+}
+
+// AddToWhitelist lets heroID use the reserved slots of gid
+func AddToWhitelist(redis *redis.Client, gid string, heroID string) error {
+	return redis.SAdd(whitelistKey(gid), heroID).Err()
+}
+
+// RemoveFromWhitelist takes back what AddToWhitelist allowed
+func RemoveFromWhitelist(redis *redis.Client, gid string, heroID string) error {
+	return redis.SRem(whitelistKey(gid), heroID).Err()
+}
+
+func reservedKey(gid string) string {
+	return "games:" + gid + ":reserved"
+}
+
+func whitelistKey(gid string) string {
+	return "games:" + gid + ":whitelist"
+}
@@ -0,0 +1,152 @@
+package matchmaking
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// JoiningTimeout - how long a hero sent to a game (EGEG) holds its slot before entering it (PENT)
+var JoiningTimeout = time.Minute
+
+// joiningScript checks for a free slot and takes it in one step, so two heroes can't both get the last one.
+// KEYS are the roster, joining and reserved sets of the game. ARGV is now, the expiry of the slot, the slots
+// the hero may take (-1 for no limit) and the hero. Heroes already holding a slot or a reservation keep it.
+// Returns 0 if the game is full.
+var joiningScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", "(" .. ARGV[1])
+
+local held = redis.call("ZSCORE", KEYS[2], ARGV[4]) or redis.call("ZSCORE", KEYS[3], ARGV[4])
+local capacity = tonumber(ARGV[3])
+if not held and capacity >= 0 then
+	local taken = redis.call("HLEN", KEYS[1]) + redis.call("ZCARD", KEYS[2]) + redis.call("ZCARD", KEYS[3])
+	if taken >= capacity then
+		return 0
+	end
+end
+
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[4])
+return 1`)
+
+// Joining - heroID is sent to gid, its slot is taken until it enters or JoiningTimeout passes.
+// Returns false without taking a slot if gid is full, the ReservedSlots only count for privileged heroes.
+func Joining(client *redis.Client, gid string, heroID string, privileged bool) (bool, error) {
+	game := Games.Get(gid)
+	if game == nil {
+		return false, nil
+	}
+
+	capacity := -1
+	if game.MaxPlayers > 0 {
+		capacity = game.MaxPlayers
+		if !privileged {
+			capacity -= game.ReservedSlots
+		}
+	}
+
+	now := time.Now()
+	args := []interface{}{now.Unix(), now.Add(JoiningTimeout).Unix(), capacity, heroID}
+
+	joined, err := joiningScript.Run(client, []string{rosterKey(gid), joiningKey(gid), reservedKey(gid)}, args...).Int64()
+	return joined == 1, err
+}
+
+// JoinFailed - the game server refused heroID, its slot is free again
+func JoinFailed(redis *redis.Client, gid string, heroID string) error {
+	return redis.ZRem(joiningKey(gid), heroID).Err()
+}
+
+// FreeSlots returns how many more heroes fit into gid. Players, heroes on their way in and reservations
+// take a slot each, the ReservedSlots of the game are only free for privileged heroes.
+func FreeSlots(redis *redis.Client, gid string, privileged bool) (int, error) {
+	game := Games.Get(gid)
+	if game == nil {
+		return 0, nil
+	}
+	if game.MaxPlayers <= 0 {
+		// The server didn't tell, so it doesn't hold anyone back
+		return math.MaxInt32, nil
+	}
+
+	players, err := redis.HLen(rosterKey(gid)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	joining, err := joiningCount(redis, gid)
+	if err != nil {
+		return 0, err
+	}
+
+	reserved, err := Reserved(redis, gid)
+	if err != nil {
+		return 0, err
+	}
+
+	free := game.MaxPlayers - int(players) - joining - reserved
+	if !privileged {
+		free -= game.ReservedSlots
+	}
+
+	return free, nil
+}
+
+// Full tells whether a hero can't get into gid right now. Unprivileged heroes also wait if others queue already.
+func Full(redis *redis.Client, gid string, privileged bool) (bool, error) {
+	if !privileged {
+		queued, err := redis.ZCard(queueKey(gid)).Result()
+		if err != nil || queued > 0 {
+			return true, err
+		}
+	}
+
+	free, err := FreeSlots(redis, gid, privileged)
+	return free <= 0, err
+}
+
+// Occupancy - the live number of heroes on a game
+type Occupancy struct {
+	Players int
+	// Joining heroes were sent to the game but didn't enter yet
+	Joining int
+	// Teams counts the players by c_team
+	Teams map[string]int
+}
+
+// OccupancyOf returns how many heroes play on and join gid
+func OccupancyOf(redis *redis.Client, gid string) (*Occupancy, error) {
+	teams, err := TeamCounts(redis, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	joining, err := joiningCount(redis, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	occupancy := &Occupancy{Joining: joining, Teams: teams}
+	for _, count := range teams {
+		occupancy.Players += count
+	}
+
+	return occupancy, nil
+}
+
+// joiningCount - heroes on their way into gid, dropping those whose JoiningTimeout passed
+func joiningCount(redis *redis.Client, gid string) (int, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := redis.ZRemRangeByScore(joiningKey(gid), "-inf", "("+now).Err(); err != nil {
+		return 0, err
+	}
+
+	joining, err := redis.ZCard(joiningKey(gid)).Result()
+	return int(joining), err
+}
+
+func joiningKey(gid string) string {
+	return "games:" + gid + ":joining"
+}
@@ -0,0 +1,342 @@
+package moderation
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// Ban types, matching the bans.type column
+const (
+	BanAccount = "account"
+	BanHero    = "hero"
+	BanIP      = "ip"
+	BanServer  = "server"
+)
+
+// BansChannel - redis pub/sub channel announcing new bans to every shard
+const BansChannel = "bans:issued"
+
+var (
+	// ErrInvalidBan - type or target of a ban are not valid
+	ErrInvalidBan = errors.New("invalid ban")
+	// ErrBanNotFound - no active ban with that id
+	ErrBanNotFound = errors.New("ban not found")
+)
+
+// Ban - a ban on an account, hero, IP/CIDR or game server
+type Ban struct {
+	ID          int64  `json:"id"`
+	Type        string `json:"type"`
+	Target      string `json:"target"`
+	Reason      string `json:"reason"`
+	ModeratorID string `json:"moderatorID"`
+	// ExpiresAt is a unix timestamp, 0 for permanent bans
+	ExpiresAt int64 `json:"expiresAt"`
+	CreatedAt int64 `json:"createdAt"`
+}
+
+// Permanent reports whether the ban never expires
+func (ban *Ban) Permanent() bool {
+	return ban.ExpiresAt == 0
+}
+
+// Matches reports whether the ban covers a connection with the given identities
+func (ban *Ban) Matches(userID string, heroID string, serverID string, ip net.IP) bool {
+	switch ban.Type {
+	case BanAccount:
+		return userID != "" && ban.Target == userID
+	case BanHero:
+		return heroID != "" && ban.Target == heroID
+	case BanServer:
+		return serverID != "" && ban.Target == serverID
+	case BanIP:
+		return ip != nil && ipMatches(ban.Target, ip)
+	}
+
+	return false
+}
+
+var banMessages = map[string][2]string{
+	"en": {"You are banned permanently. Reason: %reason%", "You are banned until %until%. Reason: %reason%"},
+	"de": {"Du wurdest permanent gesperrt. Grund: %reason%", "Du bist gesperrt bis %until%. Grund: %reason%"},
+	"fr": {"Vous êtes banni définitivement. Raison : %reason%", "Vous êtes banni jusqu'au %until%. Raison : %reason%"},
+	"es": {"Has sido expulsado permanentemente. Motivo: %reason%", "Has sido expulsado hasta %until%. Motivo: %reason%"},
+}
+
+// Message returns the ban notice in the language of locale (like enUS or de_DE), falling back to english
+func (ban *Ban) Message(locale string) string {
+	language := strings.ToLower(locale)
+	if len(language) > 2 {
+		language = language[:2]
+	}
+
+	messages, ok := banMessages[language]
+	if !ok {
+		messages = banMessages["en"]
+	}
+
+	message := messages[0]
+	if !ban.Permanent() {
+		message = messages[1]
+	}
+
+	reason := ban.Reason
+	if reason == "" {
+		reason = "-"
+	}
+
+	message = strings.Replace(message, "%until%", time.Unix(ban.ExpiresAt, 0).UTC().Format("2006-01-02 15:04 MST"), -1)
+	message = strings.Replace(message, "%reason%", reason, -1)
+
+	return message
+}
+
+// Bans - issues, lifts and checks bans
+type Bans struct {
+	db    *sql.DB
+	redis *redis.Client
+
+	// Database Statements
+	stmtAddBan          *sql.Stmt
+	stmtLiftBan         *sql.Stmt
+	stmtGetActiveBan    *sql.Stmt
+	stmtGetActiveBans   *sql.Stmt
+	stmtGetActiveIPBans *sql.Stmt
+	stmtGetBansByTarget *sql.Stmt
+}
+
+const banColumns = "id, type, target, reason, IFNULL(moderator_id, ''), IFNULL(UNIX_TIMESTAMP(expires_at), 0), IFNULL(UNIX_TIMESTAMP(created_at), 0)"
+const banActive = "lifted_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())"
+
+// New prepares the statements used for bans
+func (b *Bans) New(db *sql.DB, redis *redis.Client) {
+	var err error
+
+	b.db = db
+	b.redis = redis
+
+	b.stmtAddBan, err = b.db.Prepare(
+		"INSERT INTO bans" +
+			"	(type, target, reason, moderator_id, expires_at, created_at, updated_at)" +
+			"	VALUES (?, ?, ?, NULLIF(?, ''), IF(? = 0, NULL, FROM_UNIXTIME(?)), NOW(), NOW())")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddBan.", err.Error())
+	}
+
+	b.stmtLiftBan, err = b.db.Prepare(
+		"UPDATE bans SET" +
+			"	lifted_at = NOW()," +
+			"	updated_at = NOW()" +
+			"	WHERE id = ? AND lifted_at IS NULL")
+	if err != nil {
+		log.Fatalln("Error preparing stmtLiftBan.", err.Error())
+	}
+
+	b.stmtGetActiveBan, err = b.db.Prepare(
+		"SELECT " + banColumns +
+			"	FROM bans" +
+			"	WHERE type = ? AND target = ? AND " + banActive +
+			"	ORDER BY expires_at IS NULL DESC, expires_at DESC" +
+			"	LIMIT 1")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetActiveBan.", err.Error())
+	}
+
+	b.stmtGetActiveBans, err = b.db.Prepare(
+		"SELECT " + banColumns +
+			"	FROM bans" +
+			"	WHERE " + banActive +
+			"	ORDER BY id DESC")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetActiveBans.", err.Error())
+	}
+
+	b.stmtGetActiveIPBans, err = b.db.Prepare(
+		"SELECT " + banColumns +
+			"	FROM bans" +
+			"	WHERE type = 'ip' AND " + banActive)
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetActiveIPBans.", err.Error())
+	}
+
+	b.stmtGetBansByTarget, err = b.db.Prepare(
+		"SELECT " + banColumns +
+			"	FROM bans" +
+			"	WHERE type = ? AND target = ?" +
+			"	ORDER BY id DESC")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetBansByTarget.", err.Error())
+	}
+}
+
+// Add stores a new ban and tells every shard to disconnect whoever it covers
+func (b *Bans) Add(ban *Ban) error {
+	switch ban.Type {
+	case BanAccount, BanHero, BanServer:
+		if _, err := strconv.Atoi(ban.Target); err != nil {
+			return ErrInvalidBan
+		}
+	case BanIP:
+		if !validIPTarget(ban.Target) {
+			return ErrInvalidBan
+		}
+	default:
+		return ErrInvalidBan
+	}
+
+	result, err := b.stmtAddBan.Exec(ban.Type, ban.Target, ban.Reason, ban.ModeratorID, ban.ExpiresAt, ban.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	ban.ID, _ = result.LastInsertId()
+	ban.CreatedAt = time.Now().Unix()
+
+	log.Noteln("Ban " + strconv.FormatInt(ban.ID, 10) + " issued on " + ban.Type + " " + ban.Target + " by moderator " + ban.ModeratorID + ": " + ban.Reason)
+
+	payload, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+
+	return b.redis.Publish(BansChannel, string(payload)).Err()
+}
+
+// Lift ends a ban early
+func (b *Bans) Lift(id string) error {
+	result, err := b.stmtLiftBan.Exec(id)
+	if err != nil {
+		return err
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return ErrBanNotFound
+	}
+
+	return nil
+}
+
+// Active lists all bans currently in effect
+func (b *Bans) Active() ([]*Ban, error) {
+	return b.query(b.stmtGetActiveBans)
+}
+
+// History lists all bans, active or not, of a target
+func (b *Bans) History(banType string, target string) ([]*Ban, error) {
+	return b.query(b.stmtGetBansByTarget, banType, target)
+}
+
+// Check returns the active ban for target, or nil if there is none
+func (b *Bans) Check(banType string, target string) (*Ban, error) {
+	if target == "" {
+		return nil, nil
+	}
+
+	bans, err := b.query(b.stmtGetActiveBan, banType, target)
+	if err != nil || len(bans) == 0 {
+		return nil, err
+	}
+
+	return bans[0], nil
+}
+
+// CheckIP returns the active ban covering ip, or nil if there is none
+func (b *Bans) CheckIP(ip net.IP) (*Ban, error) {
+	bans, err := b.query(b.stmtGetActiveIPBans)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ban := range bans {
+		if ipMatches(ban.Target, ip) {
+			return ban, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// CheckAll returns the first active ban covering any of the given identities, or nil
+func (b *Bans) CheckAll(userID string, heroID string, serverID string, ip net.IP) (*Ban, error) {
+	checks := [][2]string{{BanAccount, userID}, {BanHero, heroID}, {BanServer, serverID}}
+	for _, check := range checks {
+		ban, err := b.Check(check[0], check[1])
+		if err != nil || ban != nil {
+			return ban, err
+		}
+	}
+
+	if ip == nil {
+		return nil, nil
+	}
+
+	return b.CheckIP(ip)
+}
+
+// Issued subscribes to BansChannel and returns every ban issued from now on
+func (b *Bans) Issued() <-chan *Ban {
+	bans := make(chan *Ban, 100)
+
+	pubsub := b.redis.Subscribe(BansChannel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			ban := new(Ban)
+			if err := json.Unmarshal([]byte(msg.Payload), ban); err != nil {
+				log.Errorln("Invalid ban announcement", msg.Payload, err)
+				continue
+			}
+			bans <- ban
+		}
+	}()
+
+	return bans
+}
+
+func (b *Bans) query(stmt *sql.Stmt, args ...interface{}) ([]*Ban, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []*Ban{}
+	for rows.Next() {
+		ban := new(Ban)
+		err := rows.Scan(&ban.ID, &ban.Type, &ban.Target, &ban.Reason, &ban.ModeratorID, &ban.ExpiresAt, &ban.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
+
+func validIPTarget(target string) bool {
+	if strings.Contains(target, "/") {
+		_, _, err := net.ParseCIDR(target)
+		return err == nil
+	}
+
+	return net.ParseIP(target) != nil
+}
+
+func ipMatches(target string, ip net.IP) bool {
+	if strings.Contains(target, "/") {
+		_, network, err := net.ParseCIDR(target)
+		return err == nil && network.Contains(ip)
+	}
+
+	banned := net.ParseIP(target)
+	return banned != nil && banned.Equal(ip)
+}
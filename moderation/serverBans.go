@@ -0,0 +1,152 @@
+package moderation
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"../log"
+)
+
+// ServerBan - a hero banned from one game server
+type ServerBan struct {
+	ID          int64  `json:"id"`
+	ServerID    string `json:"serverID"`
+	HeroID      string `json:"heroID"`
+	Reason      string `json:"reason"`
+	ModeratorID string `json:"moderatorID"`
+	// ExpiresAt is a unix timestamp, 0 for permanent bans
+	ExpiresAt int64 `json:"expiresAt"`
+	CreatedAt int64 `json:"createdAt"`
+}
+
+// ServerBans - issues, lifts and checks bans from single game servers
+type ServerBans struct {
+	db *sql.DB
+
+	// Database Statements
+	stmtAddServerBan        *sql.Stmt
+	stmtLiftServerBan       *sql.Stmt
+	stmtGetActiveServerBan  *sql.Stmt
+	stmtGetActiveServerBans *sql.Stmt
+}
+
+const serverBanColumns = "id, server_id, hero_id, reason, IFNULL(moderator_id, ''), IFNULL(UNIX_TIMESTAMP(expires_at), 0), IFNULL(UNIX_TIMESTAMP(created_at), 0)"
+
+// New prepares the statements used for server bans
+func (b *ServerBans) New(db *sql.DB) {
+	var err error
+
+	b.db = db
+
+	b.stmtAddServerBan, err = b.db.Prepare(
+		"INSERT INTO server_bans" +
+			"	(server_id, hero_id, reason, moderator_id, expires_at, created_at, updated_at)" +
+			"	VALUES (?, ?, ?, NULLIF(?, ''), IF(? = 0, NULL, FROM_UNIXTIME(?)), NOW(), NOW())")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddServerBan.", err.Error())
+	}
+
+	b.stmtLiftServerBan, err = b.db.Prepare(
+		"UPDATE server_bans SET" +
+			"	lifted_at = NOW()," +
+			"	updated_at = NOW()" +
+			"	WHERE server_id = ? AND hero_id = ? AND " + banActive)
+	if err != nil {
+		log.Fatalln("Error preparing stmtLiftServerBan.", err.Error())
+	}
+
+	b.stmtGetActiveServerBan, err = b.db.Prepare(
+		"SELECT " + serverBanColumns +
+			"	FROM server_bans" +
+			"	WHERE server_id = ? AND hero_id = ? AND " + banActive +
+			"	ORDER BY expires_at IS NULL DESC, expires_at DESC" +
+			"	LIMIT 1")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetActiveServerBan.", err.Error())
+	}
+
+	b.stmtGetActiveServerBans, err = b.db.Prepare(
+		"SELECT " + serverBanColumns +
+			"	FROM server_bans" +
+			"	WHERE server_id = ? AND " + banActive +
+			"	ORDER BY id DESC")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetActiveServerBans.", err.Error())
+	}
+}
+
+// Add bans a hero from a game server, kicking it is up to the caller
+func (b *ServerBans) Add(ban *ServerBan) error {
+	if _, err := strconv.Atoi(ban.ServerID); err != nil {
+		return ErrInvalidBan
+	}
+	if _, err := strconv.Atoi(ban.HeroID); err != nil {
+		return ErrInvalidBan
+	}
+
+	result, err := b.stmtAddServerBan.Exec(ban.ServerID, ban.HeroID, ban.Reason, ban.ModeratorID, ban.ExpiresAt, ban.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	ban.ID, _ = result.LastInsertId()
+	ban.CreatedAt = time.Now().Unix()
+
+	log.Noteln("Hero " + ban.HeroID + " banned from server " + ban.ServerID + " by moderator " + ban.ModeratorID + ": " + ban.Reason)
+	return nil
+}
+
+// Lift ends the bans of heroID from serverID early
+func (b *ServerBans) Lift(serverID string, heroID string) error {
+	result, err := b.stmtLiftServerBan.Exec(serverID, heroID)
+	if err != nil {
+		return err
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return ErrBanNotFound
+	}
+
+	return nil
+}
+
+// Active lists the bans of serverID currently in effect
+func (b *ServerBans) Active(serverID string) ([]*ServerBan, error) {
+	return b.query(b.stmtGetActiveServerBans, serverID)
+}
+
+// Check returns the active ban of heroID from serverID, or nil if there is none
+func (b *ServerBans) Check(serverID string, heroID string) (*ServerBan, error) {
+	if serverID == "" || heroID == "" {
+		return nil, nil
+	}
+
+	bans, err := b.query(b.stmtGetActiveServerBan, serverID, heroID)
+	if err != nil || len(bans) == 0 {
+		return nil, err
+	}
+
+	return bans[0], nil
+}
+
+func (b *ServerBans) query(stmt *sql.Stmt, args ...interface{}) ([]*ServerBan, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []*ServerBan{}
+	for rows.Next() {
+		ban := new(ServerBan)
+		err := rows.Scan(&ban.ID, &ban.ServerID, &ban.HeroID, &ban.Reason, &ban.ModeratorID, &ban.ExpiresAt, &ban.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
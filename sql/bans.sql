@@ -0,0 +1,14 @@
+-- Bans on accounts, heroes, IPs/CIDRs and game servers
+CREATE TABLE IF NOT EXISTS `bans` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `type` enum('account','hero','ip','server') NOT NULL,
+  `target` varchar(64) NOT NULL COMMENT 'users.id, game_heroes.id, IP or CIDR, game_servers.id',
+  `reason` varchar(255) NOT NULL DEFAULT '',
+  `moderator_id` int(10) unsigned DEFAULT NULL COMMENT 'users.id of the moderator',
+  `expires_at` timestamp NULL DEFAULT NULL COMMENT 'NULL for permanent bans',
+  `lifted_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `bans_type_target_index` (`type`,`target`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
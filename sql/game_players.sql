@@ -0,0 +1,11 @@
+-- Heroes playing on each game (PENT until PLVT), the keys game servers report about them stay in game_server_player_stats
+CREATE TABLE IF NOT EXISTS `game_players` (
+  `gid` int(10) unsigned NOT NULL,
+  `shard` varchar(64) NOT NULL,
+  `pid` int(10) unsigned NOT NULL,
+  `hero_name` varchar(64) NOT NULL DEFAULT '',
+  `team` tinyint(3) unsigned NOT NULL DEFAULT 0,
+  `joined_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`gid`, `shard`, `pid`),
+  KEY `pid` (`pid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
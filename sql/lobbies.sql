@@ -0,0 +1,12 @@
+-- Theater lobbies listed by LLST, game servers create their games in one of them (CGAM LID)
+CREATE TABLE IF NOT EXISTS `game_lobbies` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(64) NOT NULL,
+  `locale` varchar(16) NOT NULL DEFAULT 'en_US',
+  `max_games` int(10) unsigned NOT NULL DEFAULT 10000,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- The lobby every game was created in so far
+INSERT IGNORE INTO `game_lobbies` (`id`, `name`, `locale`, `max_games`) VALUES (1, 'bfwestPC02', 'en_US', 10000);
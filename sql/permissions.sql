@@ -0,0 +1,23 @@
+-- Game servers need game.server to create games (CGAM). It is granted through the gameserver role
+-- to every account owning a game server, run this again after adding servers for new accounts.
+INSERT INTO `permissions` (`slug`, `name`, `created_at`, `updated_at`)
+  SELECT 'game.server', 'Host game servers', NOW(), NOW() FROM DUAL
+  WHERE NOT EXISTS (SELECT 1 FROM `permissions` WHERE `slug` = 'game.server');
+
+INSERT INTO `roles` (`slug`, `name`, `created_at`, `updated_at`)
+  SELECT 'gameserver', 'Game server', NOW(), NOW() FROM DUAL
+  WHERE NOT EXISTS (SELECT 1 FROM `roles` WHERE `slug` = 'gameserver');
+
+INSERT INTO `permission_role` (`permission_id`, `role_id`)
+  SELECT `permissions`.`id`, `roles`.`id`
+    FROM `permissions`, `roles`
+    WHERE `permissions`.`slug` = 'game.server' AND `roles`.`slug` = 'gameserver'
+      AND NOT EXISTS (SELECT 1 FROM `permission_role`
+        WHERE `permission_role`.`permission_id` = `permissions`.`id` AND `permission_role`.`role_id` = `roles`.`id`);
+
+INSERT INTO `role_user` (`role_id`, `user_id`, `created_at`, `updated_at`)
+  SELECT DISTINCT `roles`.`id`, `game_servers`.`user_id`, NOW(), NOW()
+    FROM `game_servers`, `roles`
+    WHERE `roles`.`slug` = 'gameserver'
+      AND NOT EXISTS (SELECT 1 FROM `role_user`
+        WHERE `role_user`.`role_id` = `roles`.`id` AND `role_user`.`user_id` = `game_servers`.`user_id`);
@@ -0,0 +1,11 @@
+-- Competitive seasons, seasonal stats are archived into game_stats_season_<id> and reset when a season ends
+CREATE TABLE IF NOT EXISTS `game_seasons` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(64) NOT NULL,
+  `starts_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `ends_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `archived_at` timestamp NULL DEFAULT NULL COMMENT 'NULL until the season was archived and reset',
+  `phase` varchar(16) NOT NULL DEFAULT '' COMMENT 'how far ending got: archived, rewarded or ended',
+  PRIMARY KEY (`id`),
+  KEY `game_seasons_ends_at_index` (`ends_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,14 @@
+-- Heroes banned from one game server, unlike bans they can still play everywhere else
+CREATE TABLE IF NOT EXISTS `server_bans` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `server_id` int(10) unsigned NOT NULL COMMENT 'game_servers.id',
+  `hero_id` int(10) unsigned NOT NULL COMMENT 'game_heroes.id',
+  `reason` varchar(255) NOT NULL DEFAULT '',
+  `moderator_id` int(10) unsigned DEFAULT NULL COMMENT 'users.id of the moderator',
+  `expires_at` timestamp NULL DEFAULT NULL COMMENT 'NULL for permanent bans',
+  `lifted_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `server_bans_server_hero_index` (`server_id`,`hero_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
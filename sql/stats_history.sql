@@ -0,0 +1,14 @@
+-- Append-only history of every accepted game_stats change, never updated or deleted by the backend
+CREATE TABLE IF NOT EXISTS `game_stats_history` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` int(10) unsigned NOT NULL,
+  `heroID` int(10) unsigned NOT NULL,
+  `statsKey` varchar(255) NOT NULL,
+  `old_value` varchar(255) DEFAULT NULL COMMENT 'NULL if the stat did not exist yet',
+  `new_value` varchar(255) DEFAULT NULL COMMENT 'NULL if the stat was removed by a rollback',
+  `source` varchar(64) NOT NULL COMMENT 'client, server:<game_servers.id> or admin:<who>',
+  `gid` int(10) unsigned DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `game_stats_history_hero_index` (`heroID`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,431 @@
+package stats
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Stat types
+const (
+	TypeInt   = "int"
+	TypeFloat = "float"
+	TypeText  = "text"
+)
+
+// Update modes, how a new value is combined with the stored one
+const (
+	ModeSet = "set"
+	ModeAdd = "add"
+	ModeMax = "max"
+	ModeMin = "min"
+)
+
+// Writers, who sent an update
+const (
+	WriterClient = "client"
+	WriterServer = "server"
+	WriterAdmin  = "admin"
+)
+
+var (
+	// ErrUnknownStat - the key is not defined and there is no fallback definition
+	ErrUnknownStat = errors.New("unknown stat")
+	// ErrNotWritable - the writer may not change this stat (or not raise it)
+	ErrNotWritable = errors.New("stat not writable")
+	// ErrInvalidValue - the value doesn't match the type of the stat
+	ErrInvalidValue = errors.New("invalid stat value")
+	// ErrOutOfBounds - the resulting value would be lower than min or higher than max
+	ErrOutOfBounds = errors.New("stat out of bounds")
+)
+
+// Definition - type, update mode, writers, bounds and default of a game_stats key
+type Definition struct {
+	Key     string   `yaml:"key"`
+	Type    string   `yaml:"type"`
+	Mode    string   `yaml:"mode"`
+	Writers []string `yaml:"writers"`
+	// Increase lists the writers allowed to raise the value with an add, defaults to Writers
+	Increase []string `yaml:"increase"`
+	Min      *float64 `yaml:"min"`
+	Max      *float64 `yaml:"max"`
+	Default  string   `yaml:"default"`
+	// MinLevel - the hero level that unlocks writing this stat, 0 for always
+	MinLevel int `yaml:"minLevel"`
+	// Ignore lists writers whose updates are dropped without rejecting the request
+	Ignore []string `yaml:"ignore"`
+}
+
+// Registry - the stat schema enforced by UpdateStats, GetStats and GetStatsForOwners
+type Registry struct {
+	// UpdateTypes maps the ut sent with UpdateStats to a mode, other ut use the mode of the stat
+	UpdateTypes map[string]string `yaml:"updateTypes"`
+	// Fallback applies to keys that are not listed, without it those keys are rejected
+	Fallback *Definition  `yaml:"fallback"`
+	Stats    []Definition `yaml:"stats"`
+	// Progression turns XP into levels, nil leaves levels to the game
+	Progression *Progression `yaml:"progression"`
+	// Leaderboards are the stats heroes are ranked by
+	Leaderboards []Leaderboard `yaml:"leaderboards"`
+	// Season lists the stats reset every season, nil if there are no seasons
+	Season *SeasonConfig `yaml:"seasons"`
+
+	byKey map[string]*Definition
+}
+
+// Definitions - the registry used by the backend, loaded on startup
+var Definitions = new(Registry)
+
+// Load reads the registry from a yml file
+func (r *Registry) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return r.Parse(data)
+}
+
+// Parse reads the registry from yml and checks every definition
+func (r *Registry) Parse(data []byte) error {
+	parsed := Registry{}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	parsed.byKey = make(map[string]*Definition)
+	for i := range parsed.Stats {
+		definition := &parsed.Stats[i]
+		if err := definition.check(); err != nil {
+			return err
+		}
+		parsed.byKey[definition.Key] = definition
+	}
+	if parsed.Fallback != nil {
+		if err := parsed.Fallback.check(); err != nil {
+			return err
+		}
+	}
+	if parsed.Progression != nil {
+		if err := parsed.Progression.check(); err != nil {
+			return err
+		}
+	} else {
+		for _, definition := range parsed.Stats {
+			if definition.MinLevel > 0 {
+				return errors.New("stats: minLevel of " + definition.Key + " needs a progression")
+			}
+		}
+	}
+	for _, board := range parsed.Leaderboards {
+		if err := parsed.checkLeaderboard(board); err != nil {
+			return err
+		}
+	}
+	if parsed.Season != nil {
+		if err := parsed.checkSeason(); err != nil {
+			return err
+		}
+	}
+	for ut, mode := range parsed.UpdateTypes {
+		if !validMode(mode) {
+			return errors.New("stats: unknown mode " + mode + " for ut " + ut)
+		}
+	}
+
+	*r = parsed
+	return nil
+}
+
+// Lookup returns the definition of key, the fallback or nil
+func (r *Registry) Lookup(key string) *Definition {
+	if definition, ok := r.byKey[key]; ok {
+		return definition
+	}
+
+	return r.Fallback
+}
+
+// Leaderboard returns the leaderboard ranking key, nil if there is none
+func (r *Registry) Leaderboard(key string) *Leaderboard {
+	for i := range r.Leaderboards {
+		if r.Leaderboards[i].Key == key {
+			return &r.Leaderboards[i]
+		}
+	}
+
+	return nil
+}
+
+// Known reports whether key may be read or written at all
+func (r *Registry) Known(key string) bool {
+	return r.Lookup(key) != nil
+}
+
+// Default returns the value reported for key when it was never written
+func (r *Registry) Default(key string) string {
+	definition := r.Lookup(key)
+	if definition == nil {
+		return ""
+	}
+
+	return definition.Default
+}
+
+// Change - a validated update of one stat, applied by combining Value with the stored value per Mode
+type Change struct {
+	Key  string
+	Mode string
+	// Value is the value sent by the game, the delta for ModeAdd
+	Value string
+	// Number is Value parsed, 0 for text stats
+	Number float64
+
+	definition *Definition
+	text       bool
+}
+
+// Prepare validates a numeric update (sent as .v) of key by writer, ut is the update type sent by the game
+func (r *Registry) Prepare(key string, writer string, value string, ut string) (*Change, error) {
+	if r.Ignored(key, writer) {
+		return nil, ErrDerivedStat
+	}
+
+	definition, err := r.writable(key, writer)
+	if err != nil {
+		return nil, err
+	}
+
+	if definition.Type == TypeText {
+		return &Change{Key: key, Mode: ModeSet, Value: value, definition: definition, text: true}, nil
+	}
+
+	number, err := definition.parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := definition.Mode
+	if utMode, ok := r.UpdateTypes[ut]; ok {
+		mode = utMode
+	}
+
+	if mode == ModeAdd && number > 0 && !contains(definition.increaseWriters(), writer) {
+		return nil, ErrNotWritable
+	}
+
+	return &Change{Key: key, Mode: mode, Value: value, Number: number, definition: definition}, nil
+}
+
+// PrepareText validates a text update (sent as .t instead of .v) of key by writer.
+// Keys covered by the fallback take any text, listed numeric stats reject it.
+func (r *Registry) PrepareText(key string, writer string, text string) (*Change, error) {
+	if r.Ignored(key, writer) {
+		return nil, ErrDerivedStat
+	}
+
+	definition, err := r.writable(key, writer)
+	if err != nil {
+		return nil, err
+	}
+	if definition != r.Fallback && definition.Type != TypeText {
+		return nil, ErrInvalidValue
+	}
+
+	return &Change{Key: key, Mode: ModeSet, Value: text, definition: definition, text: true}, nil
+}
+
+// Apply validates an update of key sent by writer and returns the value to store.
+// current is the stored value ("" if there is none), ut the update type sent by the game.
+func (r *Registry) Apply(key string, writer string, current string, value string, ut string) (string, error) {
+	change, err := r.Prepare(key, writer, value, ut)
+	if err != nil {
+		return "", err
+	}
+
+	return change.Result(current)
+}
+
+// Result combines the change with current ("" if there is none, the default is used then)
+func (c *Change) Result(current string) (string, error) {
+	result, text := c.combine(current)
+	if err := c.definition.bounds(result); err != nil {
+		return "", err
+	}
+
+	return text, nil
+}
+
+// Initial returns the value inserted when the stat doesn't exist yet, the change applied to the default.
+// It isn't checked against the bounds, Check does that once the database combined the values.
+func (c *Change) Initial() string {
+	_, text := c.combine("")
+	return text
+}
+
+func (c *Change) combine(current string) (float64, string) {
+	if c.text {
+		return 0, c.Value
+	}
+
+	if current == "" {
+		current = c.definition.Default
+	}
+	stored, err := c.definition.parse(current)
+	if err != nil {
+		// Garbage in the database shouldn't block every future update
+		stored, current = 0, c.definition.format(0)
+	}
+
+	// Values that are stored as sent keep the formatting of the game
+	result, text := c.Number, c.Value
+	switch c.Mode {
+	case ModeAdd:
+		result = stored + c.Number
+		text = c.definition.format(result)
+	case ModeMax:
+		if stored >= c.Number {
+			result, text = stored, current
+		}
+	case ModeMin:
+		if stored <= c.Number {
+			result, text = stored, current
+		}
+	}
+
+	return result, text
+}
+
+// Check validates a value the database computed for the change (like statsValue + delta)
+// and returns it in the format the game expects
+func (c *Change) Check(stored string) (string, error) {
+	if c.text {
+		return stored, nil
+	}
+
+	number, err := c.definition.parse(stored)
+	if err != nil {
+		return "", err
+	}
+	if err := c.definition.bounds(number); err != nil {
+		return "", err
+	}
+
+	if c.Mode == ModeAdd {
+		return c.definition.format(number), nil
+	}
+
+	return stored, nil
+}
+
+// Ignored reports whether updates of key by writer are dropped, like levels reported by the game
+func (r *Registry) Ignored(key string, writer string) bool {
+	if r.Derived(key) && writer != WriterAdmin {
+		return true
+	}
+
+	definition := r.Lookup(key)
+	return definition != nil && contains(definition.Ignore, writer)
+}
+
+func (r *Registry) writable(key string, writer string) (*Definition, error) {
+	definition := r.Lookup(key)
+	if definition == nil {
+		return nil, ErrUnknownStat
+	}
+	if !contains(definition.Writers, writer) {
+		return nil, ErrNotWritable
+	}
+
+	return definition, nil
+}
+
+func (r *Registry) checkLeaderboard(board Leaderboard) error {
+	definition := r.Lookup(board.Key)
+	if definition == nil || definition.Type == TypeText {
+		return errors.New("stats: leaderboard " + board.Key + " needs a numeric stat")
+	}
+	if board.GroupBy != "" && !r.Known(board.GroupBy) {
+		return errors.New("stats: leaderboard " + board.Key + " is grouped by unknown stat " + board.GroupBy)
+	}
+
+	return nil
+}
+
+func (d *Definition) check() error {
+	if d.Type == "" {
+		d.Type = TypeFloat
+	}
+	if d.Mode == "" {
+		d.Mode = ModeSet
+	}
+
+	switch {
+	case d.Type != TypeInt && d.Type != TypeFloat && d.Type != TypeText:
+		return errors.New("stats: unknown type " + d.Type + " for " + d.Key)
+	case !validMode(d.Mode):
+		return errors.New("stats: unknown mode " + d.Mode + " for " + d.Key)
+	case d.Type == TypeText && d.Mode != ModeSet:
+		return errors.New("stats: text stat " + d.Key + " can only be set")
+	case d.MinLevel < 0:
+		return errors.New("stats: negative minLevel for " + d.Key)
+	}
+
+	return nil
+}
+
+func (d *Definition) bounds(value float64) error {
+	if d.Min != nil && value < *d.Min {
+		return ErrOutOfBounds
+	}
+	if d.Max != nil && value > *d.Max {
+		return ErrOutOfBounds
+	}
+
+	return nil
+}
+
+func (d *Definition) increaseWriters() []string {
+	if d.Increase == nil {
+		return d.Writers
+	}
+
+	return d.Increase
+}
+
+func (d *Definition) parse(value string) (float64, error) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, ErrInvalidValue
+	}
+	if d.Type == TypeInt && number != math.Trunc(number) {
+		return 0, ErrInvalidValue
+	}
+
+	return number, nil
+}
+
+func (d *Definition) format(value float64) string {
+	if d.Type == TypeInt {
+		return strconv.FormatInt(int64(value), 10)
+	}
+
+	return strconv.FormatFloat(value, 'f', 4, 64)
+}
+
+func validMode(mode string) bool {
+	return mode == ModeSet || mode == ModeAdd || mode == ModeMax || mode == ModeMin
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,208 @@
+package stats_test
+
+import (
+	"testing"
+
+	"./stats"
+)
+
+const testDefinitions = `
+updateTypes:
+  "3": add
+fallback:
+  writers: [client, server]
+  increase: [server]
+stats:
+  - key: c_wallet_hero
+    mode: add
+    writers: [client, server]
+    increase: [server]
+    min: 0
+    default: "0"
+  - key: c_team
+    type: int
+    writers: [client, server]
+    min: 1
+    max: 2
+  - key: elo
+    writers: [server]
+    default: "1000"
+  - key: best
+    mode: max
+    writers: [server]
+`
+
+func loadRegistry(t *testing.T) *stats.Registry {
+	registry := new(stats.Registry)
+	if err := registry.Parse([]byte(testDefinitions)); err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	return registry
+}
+
+func TestApply(t *testing.T) {
+	registry := loadRegistry(t)
+
+	tests := []struct {
+		key, writer, current, value, ut string
+		want                            string
+		err                             error
+	}{
+		{"c_wallet_hero", stats.WriterServer, "10.0000", "5", "3", "15.0000", nil},
+		{"c_wallet_hero", stats.WriterClient, "10.0000", "-4", "3", "6.0000", nil},
+		{"c_wallet_hero", stats.WriterClient, "10.0000", "4", "3", "", stats.ErrNotWritable},
+		{"c_wallet_hero", stats.WriterClient, "10.0000", "-11", "3", "", stats.ErrOutOfBounds},
+		{"c_wallet_hero", stats.WriterClient, "", "1000", "0", "", stats.ErrNotWritable},
+		{"c_team", stats.WriterClient, "1", "2", "0", "2", nil},
+		{"c_team", stats.WriterClient, "1", "3", "0", "", stats.ErrOutOfBounds},
+		{"c_team", stats.WriterClient, "1", "1.5", "0", "", stats.ErrInvalidValue},
+		{"elo", stats.WriterClient, "", "2000", "0", "", stats.ErrNotWritable},
+		{"best", stats.WriterServer, "20", "10", "0", "20", nil},
+		{"best", stats.WriterServer, "20", "30", "0", "30", nil},
+		{"unlisted", stats.WriterClient, "1.0000", "-1", "3", "0.0000", nil},
+		{"unlisted", stats.WriterClient, "", "abc", "0", "", stats.ErrInvalidValue},
+	}
+
+	for _, test := range tests {
+		got, err := registry.Apply(test.key, test.writer, test.current, test.value, test.ut)
+		if err != test.err || got != test.want {
+			t.Errorf("Apply(%s, %s, %q, %q, ut %s) = %q, %v; want %q, %v", test.key, test.writer, test.current, test.value, test.ut, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestDefaultsAndUnknownKeys(t *testing.T) {
+	registry := loadRegistry(t)
+
+	if registry.Default("elo") != "1000" {
+		t.Errorf("Default(elo) = %q, want 1000", registry.Default("elo"))
+	}
+	if !registry.Known("anything") {
+		t.Errorf("Known(anything) = false, want true with a fallback")
+	}
+
+	strict := new(stats.Registry)
+	if err := strict.Parse([]byte("stats:\n  - key: elo\n    writers: [server]\n")); err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	if strict.Known("anything") {
+		t.Errorf("Known(anything) = true, want false without a fallback")
+	}
+	if _, err := strict.Apply("anything", stats.WriterServer, "", "1", "0"); err != stats.ErrUnknownStat {
+		t.Errorf("Apply of unknown key returned %v, want ErrUnknownStat", err)
+	}
+}
+
+func TestShippedDefinitions(t *testing.T) {
+	if err := new(stats.Registry).Load("../stats.yml"); err != nil {
+		t.Errorf("stats.yml doesn't load: %s", err)
+	}
+}
+
+func TestParseRejectsInvalidDefinitions(t *testing.T) {
+	invalid := []string{
+		"stats:\n  - key: a\n    type: bool\n",
+		"stats:\n  - key: a\n    mode: multiply\n",
+		"stats:\n  - key: a\n    type: text\n    mode: add\n",
+		"updateTypes:\n  \"3\": subtract\n",
+		"stats:\n  - key: a\n    type: text\nleaderboards:\n  - key: a\n",
+		"stats:\n  - key: a\nleaderboards:\n  - key: a\n    groupBy: b\n",
+		"stats:\n  - key: a\n  - key: b\nleaderboards:\n  - key: a\nseasons:\n  rewards:\n    - {leaderboard: a, from: 1, to: 1, key: b, value: \"1\"}\n",
+	}
+
+	for _, data := range invalid {
+		if err := new(stats.Registry).Parse([]byte(data)); err == nil {
+			t.Errorf("Parse accepted invalid definitions:\n%s", data)
+		}
+	}
+}
+
+func TestChangeInitialAndCheck(t *testing.T) {
+	registry := loadRegistry(t)
+
+	spend, err := registry.Prepare("c_wallet_hero", stats.WriterClient, "-4", "3")
+	if err != nil {
+		t.Fatalf("Prepare failed: %s", err)
+	}
+	if spend.Initial() != "-4.0000" {
+		t.Errorf("Initial() = %q, want -4.0000", spend.Initial())
+	}
+	if value, err := spend.Check("6"); err != nil || value != "6.0000" {
+		t.Errorf("Check(6) = %q, %v; want 6.0000, nil", value, err)
+	}
+	if _, err := spend.Check("-4"); err != stats.ErrOutOfBounds {
+		t.Errorf("Check(-4) returned %v, want ErrOutOfBounds", err)
+	}
+
+	team, err := registry.PrepareText("c_team", stats.WriterClient, "red")
+	if err != stats.ErrInvalidValue || team != nil {
+		t.Errorf("PrepareText on a numeric stat returned %v, want ErrInvalidValue", err)
+	}
+	if _, err := registry.PrepareText("unlisted", stats.WriterClient, "red"); err != nil {
+		t.Errorf("PrepareText on a fallback stat returned %v, want nil", err)
+	}
+}
+
+const testProgression = `
+stats:
+  - key: xp
+    mode: add
+    writers: [server]
+    ignore: [client]
+    default: "0"
+  - key: level
+    writers: [admin]
+    default: "1"
+  - key: wallet
+    mode: add
+    writers: [server]
+    default: "0"
+  - key: slot
+    writers: [client]
+    minLevel: 3
+progression:
+  xpKey: xp
+  levelKey: level
+  rewardKey: wallet
+  levels:
+    - {level: 2, xp: 100, reward: 10}
+    - {level: 3, xp: 300, reward: 20}
+`
+
+func TestProgression(t *testing.T) {
+	registry := new(stats.Registry)
+	if err := registry.Parse([]byte(testProgression)); err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	if level := registry.Progression.LevelFor(299); level != 2 {
+		t.Errorf("LevelFor(299) = %d, want 2", level)
+	}
+
+	changes := registry.Progress(map[string]string{"xp": "350", "level": "1"})
+	got := make(map[string]string)
+	for _, change := range changes {
+		got[change.Key] = change.Mode + " " + change.Value
+	}
+	if got["level"] != "set 3" || got["wallet"] != "add 30" || len(got) != 2 {
+		t.Errorf("Progress = %v, want level set 3 and wallet add 30", got)
+	}
+	if changes := registry.Progress(map[string]string{"xp": "350", "level": "3"}); changes != nil {
+		t.Errorf("Progress at the reached level = %v, want none", changes)
+	}
+
+	if _, err := registry.Prepare("level", stats.WriterServer, "5", "0"); err != stats.ErrDerivedStat {
+		t.Errorf("Prepare(level) by server returned %v, want ErrDerivedStat", err)
+	}
+	if _, err := registry.Prepare("level", stats.WriterAdmin, "5", "0"); err != nil {
+		t.Errorf("Prepare(level) by admin returned %v, want nil", err)
+	}
+	if _, err := registry.Prepare("xp", stats.WriterClient, "500", "0"); err != stats.ErrDerivedStat {
+		t.Errorf("Prepare(xp) by client returned %v, want ErrDerivedStat", err)
+	}
+
+	if registry.Unlocked("slot", "2") || !registry.Unlocked("slot", "3") {
+		t.Error("slot should unlock at level 3")
+	}
+}
@@ -0,0 +1,210 @@
+package stats
+
+import (
+	"database/sql"
+	"time"
+
+	"../log"
+)
+
+// HistoryEntry - one accepted change of a stat
+type HistoryEntry struct {
+	ID     int64  `json:"id"`
+	UserID string `json:"userID"`
+	HeroID string `json:"heroID"`
+	Key    string `json:"key"`
+	// OldValue is nil if the stat didn't exist before, NewValue is nil if a rollback removed it
+	OldValue  *string `json:"oldValue"`
+	NewValue  *string `json:"newValue"`
+	Source    string  `json:"source"`
+	GID       string  `json:"gid,omitempty"`
+	CreatedAt int64   `json:"createdAt"`
+}
+
+const historyColumns = "id, user_id, heroID, statsKey, old_value, new_value, source, IFNULL(gid, ''), UNIX_TIMESTAMP(created_at)"
+
+func (m *MySQLStore) prepareHistoryStatements() {
+	var err error
+
+	m.stmtLockStat, err = m.db.Prepare(
+		"SELECT statsValue" +
+			"	FROM game_stats" +
+			"	WHERE user_id = ? AND heroID = ? AND statsKey = ?" +
+			"	FOR UPDATE")
+	if err != nil {
+		log.Fatalln("Error preparing stmtLockStat.", err.Error())
+	}
+
+	m.stmtDeleteStat, err = m.db.Prepare(
+		"DELETE FROM game_stats WHERE user_id = ? AND heroID = ? AND statsKey = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtDeleteStat.", err.Error())
+	}
+
+	m.stmtAddHistory, err = m.db.Prepare(
+		"INSERT INTO game_stats_history" +
+			"	(user_id, heroID, statsKey, old_value, new_value, source, gid, created_at)" +
+			"	VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), FROM_UNIXTIME(?))")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddHistory.", err.Error())
+	}
+
+	m.stmtGetHistory, err = m.db.Prepare(
+		"SELECT " + historyColumns +
+			"	FROM game_stats_history" +
+			"	WHERE heroID = ?" +
+			"	ORDER BY id DESC" +
+			"	LIMIT ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetHistory.", err.Error())
+	}
+
+	m.stmtGetHistorySince, err = m.db.Prepare(
+		"SELECT " + historyColumns +
+			"	FROM game_stats_history" +
+			"	WHERE heroID = ? AND created_at > FROM_UNIXTIME(?)" +
+			"	ORDER BY id ASC")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetHistorySince.", err.Error())
+	}
+}
+
+// History lists the latest changes of a hero, newest first
+func (m *MySQLStore) History(heroID string, limit int) ([]*HistoryEntry, error) {
+	rows, err := m.stmtGetHistory.Query(heroID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanHistory(rows)
+}
+
+// Rollback restores every stat of heroID to its value at the given time and records that as
+// changes by source. Stats that didn't exist back then are removed. Returns the restored keys.
+func (m *MySQLStore) Rollback(heroID string, to time.Time, source string) ([]string, error) {
+	rows, err := m.stmtGetHistorySince.Query(heroID, to.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := scanHistory(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first change after the point in time knows the value we want back
+	var keys []string
+	restore := make(map[string]*HistoryEntry)
+	for _, entry := range entries {
+		if _, ok := restore[entry.Key]; !ok {
+			restore[entry.Key] = entry
+			keys = append(keys, entry.Key)
+		}
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		entry := restore[key]
+
+		err = m.restore(tx, entry, source)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return keys, tx.Commit()
+}
+
+// Reset deletes keys of every hero in one transaction and records their removal in the history
+func (m *MySQLStore) Reset(keys []string, source string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO game_stats_history"+
+		"	(user_id, heroID, statsKey, old_value, new_value, source, created_at)"+
+		"	SELECT user_id, heroID, statsKey, statsValue, NULL, ?, NOW()"+
+		"	FROM game_stats"+
+		"	WHERE statsKey IN ("+placeholders(len(keys))+")", append([]interface{}{source}, args...)...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM game_stats WHERE statsKey IN ("+placeholders(len(keys))+")", args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *MySQLStore) restore(tx *sql.Tx, entry *HistoryEntry, source string) error {
+	current, err := m.lock(tx, entry.UserID, entry.HeroID, entry.Key)
+	if err != nil {
+		return err
+	}
+
+	if entry.OldValue == nil {
+		_, err = tx.Stmt(m.stmtDeleteStat).Exec(entry.UserID, entry.HeroID, entry.Key)
+	} else {
+		_, err = tx.Stmt(m.stmtSetStat).Exec(entry.UserID, entry.HeroID, entry.Key, *entry.OldValue, *entry.OldValue)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Stmt(m.stmtAddHistory).Exec(entry.UserID, entry.HeroID, entry.Key, current, entry.OldValue, source, "", time.Now().Unix())
+	return err
+}
+
+// lock reads the stored value of a stat and locks its row until the transaction ends
+func (m *MySQLStore) lock(tx *sql.Tx, userID string, heroID string, key string) (sql.NullString, error) {
+	var value sql.NullString
+
+	err := tx.Stmt(m.stmtLockStat).QueryRow(userID, heroID, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return value, nil
+	}
+
+	return value, err
+}
+
+func scanHistory(rows *sql.Rows) ([]*HistoryEntry, error) {
+	defer rows.Close()
+
+	entries := []*HistoryEntry{}
+	for rows.Next() {
+		entry := new(HistoryEntry)
+		var oldValue, newValue sql.NullString
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.HeroID, &entry.Key, &oldValue, &newValue, &entry.Source, &entry.GID, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if oldValue.Valid {
+			entry.OldValue = &oldValue.String
+		}
+		if newValue.Valid {
+			entry.NewValue = &newValue.String
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
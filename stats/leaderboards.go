@@ -0,0 +1,409 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+// Periods a leaderboard ranks over
+const (
+	PeriodAllTime = "alltime"
+	PeriodWeekly  = "weekly"
+	PeriodSeason  = "season"
+)
+
+var (
+	// ErrUnknownLeaderboard - no leaderboard is configured for the key
+	ErrUnknownLeaderboard = errors.New("unknown leaderboard")
+	// ErrUnknownPeriod - the period isn't one of alltime, weekly or season
+	ErrUnknownPeriod = errors.New("unknown period")
+
+	// LeaderboardInterval - how often the leaderboards are computed again from MySQL
+	LeaderboardInterval = time.Minute * 5
+)
+
+// Periods - every period a leaderboard is computed for
+var Periods = []string{PeriodAllTime, PeriodWeekly, PeriodSeason}
+
+const (
+	leaderboardNamesKey = "leaderboards:names"
+	leaderboardKeysKey  = "leaderboards:keys"
+	leaderboardLockKey  = "leaderboards:rebuilding"
+
+	// Group of the leaderboard covering every hero
+	allGroup = "all"
+)
+
+// Leaderboard - a stat heroes are ranked by, listed in stats.yml
+type Leaderboard struct {
+	Key string `yaml:"key" json:"key"`
+	// Ascending ranks the lowest value first, like deaths
+	Ascending bool `yaml:"ascending" json:"ascending"`
+	// GroupBy is a stat splitting the ranking, like c_team. Heroes are ranked in the group they are in now.
+	GroupBy string `yaml:"groupBy" json:"groupBy,omitempty"`
+}
+
+// Ranking - the position of a hero on a leaderboard
+type Ranking struct {
+	HeroID string `json:"heroID"`
+	Name   string `json:"name"`
+	Rank   int64  `json:"rank"`
+	Value  string `json:"value"`
+}
+
+// Leaderboards - rankings precomputed from MySQL into redis sorted sets every LeaderboardInterval.
+// All-time ranks the stored value, weekly and season rank the gain of add stats and
+// the current value of other stats changed during the period.
+type Leaderboards struct {
+	db    *sql.DB
+	redis *redis.Client
+
+	// Database Statements
+	stmtGetAllTime *sql.Stmt
+	stmtGetGained  *sql.Stmt
+	stmtGetChanged *sql.Stmt
+}
+
+// New prepares the statements and starts computing the leaderboards
+func (l *Leaderboards) New(db *sql.DB, redis *redis.Client) {
+	l.db = db
+	l.redis = redis
+
+	l.prepareStatements()
+
+	go func() {
+		l.rebuild()
+		for range time.NewTicker(LeaderboardInterval).C {
+			l.rebuild()
+		}
+	}()
+}
+
+func (l *Leaderboards) prepareStatements() {
+	var err error
+
+	// Every query returns heroID, heroName, the group value and the score
+	l.stmtGetAllTime, err = l.db.Prepare(
+		"SELECT game_heroes.id, game_heroes.heroName, grouped.statsValue, game_stats.statsValue + 0" +
+			"	FROM game_stats" +
+			"	JOIN game_heroes" +
+			"		ON game_heroes.id = game_stats.heroID" +
+			"	LEFT JOIN game_stats grouped" +
+			"		ON grouped.heroID = game_stats.heroID AND grouped.statsKey = ?" +
+			"	WHERE game_stats.statsKey = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetAllTime.", err.Error())
+	}
+
+	l.stmtGetGained, err = l.db.Prepare(
+		"SELECT game_heroes.id, game_heroes.heroName, grouped.statsValue, gained.total" +
+			"	FROM (" +
+			"		SELECT heroID, SUM(IFNULL(new_value, 0) - IFNULL(old_value, 0)) AS total" +
+			"		FROM game_stats_history" +
+			"		WHERE statsKey = ? AND created_at >= FROM_UNIXTIME(?) AND source NOT LIKE 'season:%'" +
+			"		GROUP BY heroID" +
+			"	) gained" +
+			"	JOIN game_heroes" +
+			"		ON game_heroes.id = gained.heroID" +
+			"	LEFT JOIN game_stats grouped" +
+			"		ON grouped.heroID = gained.heroID AND grouped.statsKey = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetGained.", err.Error())
+	}
+
+	l.stmtGetChanged, err = l.db.Prepare(
+		"SELECT game_heroes.id, game_heroes.heroName, grouped.statsValue, game_stats.statsValue + 0" +
+			"	FROM game_stats" +
+			"	JOIN game_heroes" +
+			"		ON game_heroes.id = game_stats.heroID" +
+			"	LEFT JOIN game_stats grouped" +
+			"		ON grouped.heroID = game_stats.heroID AND grouped.statsKey = ?" +
+			"	WHERE game_stats.statsKey = ?" +
+			"		AND EXISTS (" +
+			"			SELECT 1 FROM game_stats_history" +
+			"			WHERE game_stats_history.heroID = game_stats.heroID" +
+			"				AND game_stats_history.statsKey = game_stats.statsKey" +
+			"				AND game_stats_history.created_at >= FROM_UNIXTIME(?))")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetChanged.", err.Error())
+	}
+}
+
+// Top returns the heroes ranked from to to (both 1-based and included).
+// group limits the ranking to heroes with that value of the GroupBy stat, "" ranks everyone.
+func (l *Leaderboards) Top(key string, period string, group string, from int64, to int64) ([]*Ranking, error) {
+	board, err := l.board(key, period)
+	if err != nil {
+		return nil, err
+	}
+	if from < 1 {
+		from = 1
+	}
+
+	members := l.redis.ZRevRangeWithScores
+	if board.Ascending {
+		members = l.redis.ZRangeWithScores
+	}
+	scores, err := members(leaderboardKey(key, period, group), from-1, to-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	rankings := []*Ranking{}
+	for i, score := range scores {
+		heroID := score.Member.(string)
+		rankings = append(rankings, &Ranking{
+			HeroID: heroID,
+			Rank:   from + int64(i),
+			Value:  formatScore(score.Score),
+		})
+	}
+
+	return rankings, l.addNames(rankings)
+}
+
+// Rank returns the position of heroID, nil if the hero isn't on the leaderboard
+func (l *Leaderboards) Rank(key string, period string, group string, heroID string) (*Ranking, error) {
+	board, err := l.board(key, period)
+	if err != nil {
+		return nil, err
+	}
+
+	rank := l.redis.ZRevRank
+	if board.Ascending {
+		rank = l.redis.ZRank
+	}
+	position, err := rank(leaderboardKey(key, period, group), heroID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	score, err := l.redis.ZScore(leaderboardKey(key, period, group), heroID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ranking := &Ranking{HeroID: heroID, Rank: position + 1, Value: formatScore(score)}
+	return ranking, l.addNames([]*Ranking{ranking})
+}
+
+// Count returns how many heroes are on the leaderboard
+func (l *Leaderboards) Count(key string, period string, group string) (int64, error) {
+	if _, err := l.board(key, period); err != nil {
+		return 0, err
+	}
+
+	return l.redis.ZCard(leaderboardKey(key, period, group)).Result()
+}
+
+func (l *Leaderboards) board(key string, period string) (*Leaderboard, error) {
+	if !validPeriod(period) {
+		return nil, ErrUnknownPeriod
+	}
+
+	board := Definitions.Leaderboard(key)
+	if board == nil {
+		return nil, ErrUnknownLeaderboard
+	}
+
+	return board, nil
+}
+
+func (l *Leaderboards) addNames(rankings []*Ranking) error {
+	if len(rankings) == 0 {
+		return nil
+	}
+
+	var heroIDs []string
+	for _, ranking := range rankings {
+		heroIDs = append(heroIDs, ranking.HeroID)
+	}
+
+	names, err := l.redis.HMGet(leaderboardNamesKey, heroIDs...).Result()
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		if name, ok := name.(string); ok {
+			rankings[i].Name = name
+		}
+	}
+
+	return nil
+}
+
+// rebuild computes every leaderboard again. Only one shard does it per interval.
+func (l *Leaderboards) rebuild() {
+	locked, err := l.redis.SetNX(leaderboardLockKey, "1", LeaderboardInterval-time.Second).Result()
+	if err != nil {
+		log.Errorln("Failed locking leaderboards", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	started := time.Now()
+	names := make(map[string]interface{})
+	built := make(map[string]bool)
+
+	for _, board := range Definitions.Leaderboards {
+		for _, period := range Periods {
+			scores, err := l.compute(board, period, names)
+			if err != nil {
+				log.Errorln("Failed computing leaderboard "+board.Key+" "+period, err)
+				continue
+			}
+
+			for group, members := range scores {
+				key := leaderboardKey(board.Key, period, group)
+				if err := l.replace(key, members); err != nil {
+					log.Errorln("Failed storing leaderboard "+key, err)
+					continue
+				}
+				built[key] = true
+			}
+		}
+	}
+
+	if len(names) > 0 {
+		err = l.redis.HMSet(leaderboardNamesKey, names).Err()
+		if err != nil {
+			log.Errorln("Failed storing leaderboard names", err)
+		}
+	}
+
+	l.dropStale(built)
+
+	log.Noteln("Computed leaderboards in " + time.Since(started).String())
+}
+
+// compute returns the scores of a leaderboard per group, every hero is also in the "all" group
+func (l *Leaderboards) compute(board Leaderboard, period string, names map[string]interface{}) (map[string][]redis.Z, error) {
+	var rows *sql.Rows
+	var err error
+
+	since := periodStart(period, time.Now()).Unix()
+	switch {
+	case period == PeriodAllTime:
+		rows, err = l.stmtGetAllTime.Query(board.GroupBy, board.Key)
+	case Definitions.Lookup(board.Key).Mode == ModeAdd:
+		rows, err = l.stmtGetGained.Query(board.Key, since, board.GroupBy)
+	default:
+		rows, err = l.stmtGetChanged.Query(board.GroupBy, board.Key, since)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := map[string][]redis.Z{allGroup: nil}
+	for rows.Next() {
+		var heroID, name string
+		var group sql.NullString
+		var score float64
+		if err := rows.Scan(&heroID, &name, &group, &score); err != nil {
+			return nil, err
+		}
+
+		names[heroID] = name
+		member := redis.Z{Score: score, Member: heroID}
+		scores[allGroup] = append(scores[allGroup], member)
+
+		if board.GroupBy != "" {
+			value := group.String
+			if !group.Valid {
+				value = Definitions.Default(board.GroupBy)
+			}
+			if value != "" {
+				scores[value] = append(scores[value], member)
+			}
+		}
+	}
+
+	return scores, rows.Err()
+}
+
+// replace swaps the leaderboard at key for members, readers never see a half written one
+func (l *Leaderboards) replace(key string, members []redis.Z) error {
+	if len(members) == 0 {
+		return l.redis.Del(key).Err()
+	}
+
+	building := key + ":building"
+	_, err := l.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(building)
+		pipe.ZAdd(building, members...)
+		pipe.Rename(building, key)
+		pipe.SAdd(leaderboardKeysKey, key)
+		return nil
+	})
+
+	return err
+}
+
+// dropStale removes leaderboards of groups and stats that weren't computed this time
+func (l *Leaderboards) dropStale(built map[string]bool) {
+	keys, err := l.redis.SMembers(leaderboardKeysKey).Result()
+	if err != nil {
+		log.Errorln("Failed listing leaderboards", err)
+		return
+	}
+
+	for _, key := range keys {
+		if !built[key] {
+			l.redis.Del(key)
+			l.redis.SRem(leaderboardKeysKey, key)
+		}
+	}
+}
+
+// periodStart returns when the period containing now began, weeks start on Monday 00:00 UTC.
+// Between seasons the season period starts now and stays empty.
+func periodStart(period string, now time.Time) time.Time {
+	switch period {
+	case PeriodWeekly:
+		now = now.UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case PeriodSeason:
+		if season := CurrentSeason(); season != nil {
+			return time.Unix(season.StartsAt, 0)
+		}
+		return now
+	}
+
+	return time.Time{}
+}
+
+func validPeriod(period string) bool {
+	for _, valid := range Periods {
+		if period == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func leaderboardKey(key string, period string, group string) string {
+	if group == "" {
+		group = allGroup
+	}
+
+	return "leaderboard:" + key + ":" + period + ":" + group
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
@@ -0,0 +1,327 @@
+package stats
+
+import (
+	"database/sql"
+	"time"
+
+	"../log"
+)
+
+// HeroUpdate - the changes sent for one hero in an UpdateStats request
+type HeroUpdate struct {
+	UserID  string
+	HeroID  string
+	Changes []*Change
+
+	// Source and GID are recorded in the history, like "server:12" and the game it hosts
+	Source string
+	GID    string
+}
+
+// Rejection - a key of an update that was refused
+type Rejection struct {
+	HeroID string
+	Key    string
+	Err    error
+}
+
+// MySQLStore - reads and writes game_stats
+type MySQLStore struct {
+	db *sql.DB
+
+	// Database Statements, one upsert per update mode
+	stmtSetStat *sql.Stmt
+	stmtAddStat *sql.Stmt
+	stmtMaxStat *sql.Stmt
+	stmtMinStat *sql.Stmt
+	stmtGetStat *sql.Stmt
+
+	stmtLoadHero        *sql.Stmt
+	stmtLockStat        *sql.Stmt
+	stmtDeleteStat      *sql.Stmt
+	stmtAddHistory      *sql.Stmt
+	stmtGetHistory      *sql.Stmt
+	stmtGetHistorySince *sql.Stmt
+}
+
+// New prepares the statements used for game_stats
+func (m *MySQLStore) New(db *sql.DB) {
+	var err error
+
+	m.db = db
+
+	upsert := "INSERT INTO game_stats" +
+		"	(user_id, heroID, statsKey, statsValue)" +
+		"	VALUES (?, ?, ?, ?)" +
+		"	ON DUPLICATE KEY UPDATE"
+
+	m.stmtSetStat, err = m.db.Prepare(upsert + "	statsValue = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtSetStat.", err.Error())
+	}
+
+	m.stmtAddStat, err = m.db.Prepare(upsert + "	statsValue = statsValue + ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddStat.", err.Error())
+	}
+
+	m.stmtMaxStat, err = m.db.Prepare(upsert + "	statsValue = GREATEST(statsValue + 0, ?)")
+	if err != nil {
+		log.Fatalln("Error preparing stmtMaxStat.", err.Error())
+	}
+
+	m.stmtMinStat, err = m.db.Prepare(upsert + "	statsValue = LEAST(statsValue + 0, ?)")
+	if err != nil {
+		log.Fatalln("Error preparing stmtMinStat.", err.Error())
+	}
+
+	m.stmtGetStat, err = m.db.Prepare(
+		"SELECT statsValue" +
+			"	FROM game_stats" +
+			"	WHERE user_id = ? AND heroID = ? AND statsKey = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetStat.", err.Error())
+	}
+
+	m.stmtLoadHero, err = m.db.Prepare(
+		"SELECT game_heroes.user_id, game_stats.statsKey, game_stats.statsValue" +
+			"	FROM game_heroes" +
+			"	LEFT JOIN game_stats" +
+			"		ON game_stats.user_id = game_heroes.user_id" +
+			"		AND game_stats.heroID = game_heroes.id" +
+			"	WHERE game_heroes.id = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtLoadHero.", err.Error())
+	}
+
+	m.prepareHistoryStatements()
+}
+
+// Get reads the stats straight from game_stats
+func (m *MySQLStore) Get(userID string, heroID string, keys []string) (map[string]string, error) {
+	owner, values, err := m.Load(heroID)
+	if err == ErrHeroNotFound || (err == nil && userID != "" && owner != userID) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pick(values, keys), nil
+}
+
+// Load returns the owner and all stats of a hero
+func (m *MySQLStore) Load(heroID string) (string, map[string]string, error) {
+	rows, err := m.stmtLoadHero.Query(heroID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var userID string
+	found := false
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value sql.NullString
+		err := rows.Scan(&userID, &key, &value)
+		if err != nil {
+			return "", nil, err
+		}
+		found = true
+
+		// Heroes without any stats come back as one row of NULLs
+		if key.Valid {
+			values[key.String] = value.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	if !found {
+		return "", nil, ErrHeroNotFound
+	}
+
+	return userID, values, nil
+}
+
+// Save writes values computed elsewhere (like the redis cache) and their history in one transaction
+func (m *MySQLStore) Save(userID string, heroID string, values map[string]string, history []*HistoryEntry) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		_, err = tx.Stmt(m.stmtSetStat).Exec(userID, heroID, key, value, value)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for _, entry := range history {
+		_, err = tx.Stmt(m.stmtAddHistory).Exec(entry.UserID, entry.HeroID, entry.Key, entry.OldValue, entry.NewValue, entry.Source, entry.GID, entry.CreatedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Invalidate does nothing, there is no cache
+func (m *MySQLStore) Invalidate(heroID string) error {
+	return nil
+}
+
+// Verify does nothing, there is no cache
+func (m *MySQLStore) Verify(heroID string) ([]Mismatch, error) {
+	return nil, nil
+}
+
+// Flush does nothing, every change is written right away
+func (m *MySQLStore) Flush() error {
+	return nil
+}
+
+// Apply writes all updates in one transaction. If any key is rejected nothing is written
+// and the rejected keys are returned.
+func (m *MySQLStore) Apply(updates []*HeroUpdate) ([]Rejection, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	rejected, err := m.apply(tx, updates)
+	if err != nil || len(rejected) > 0 {
+		tx.Rollback()
+		return rejected, err
+	}
+
+	return nil, tx.Commit()
+}
+
+func (m *MySQLStore) apply(tx *sql.Tx, updates []*HeroUpdate) ([]Rejection, error) {
+	var rejected []Rejection
+
+	for _, update := range updates {
+		// The level decides which stats are unlocked, lock it first so it can't change under us
+		var level sql.NullString
+		if Definitions.Progression != nil {
+			var err error
+			level, err = m.lock(tx, update.UserID, update.HeroID, Definitions.Progression.LevelKey)
+			if err != nil {
+				return rejected, err
+			}
+		}
+
+		for _, change := range update.Changes {
+			if !Definitions.Unlocked(change.Key, level.String) {
+				rejected = append(rejected, Rejection{update.HeroID, change.Key, ErrLocked})
+				continue
+			}
+
+			err := m.applyChange(tx, update, change, update.Source, &rejected)
+			if err != nil {
+				return rejected, err
+			}
+		}
+
+		if Definitions.Progression == nil {
+			continue
+		}
+
+		// Level ups of the XP gained above, an admin may have set the level as well
+		xp, err := m.lock(tx, update.UserID, update.HeroID, Definitions.Progression.XPKey)
+		if err != nil {
+			return rejected, err
+		}
+		level, err = m.lock(tx, update.UserID, update.HeroID, Definitions.Progression.LevelKey)
+		if err != nil {
+			return rejected, err
+		}
+
+		values := map[string]string{Definitions.Progression.XPKey: xp.String, Definitions.Progression.LevelKey: level.String}
+		for _, derived := range Definitions.Progress(values) {
+			err := m.applyChange(tx, update, derived, SourceProgression, &rejected)
+			if err != nil {
+				return rejected, err
+			}
+		}
+	}
+
+	return rejected, nil
+}
+
+// applyChange writes one change and its history, rejected changes are added to rejected
+func (m *MySQLStore) applyChange(tx *sql.Tx, update *HeroUpdate, change *Change, source string, rejected *[]Rejection) error {
+	old, err := m.lock(tx, update.UserID, update.HeroID, change.Key)
+	if err != nil {
+		return err
+	}
+
+	// The database combines the stored value with ours, so concurrent updates can't overwrite each other
+	var operand interface{} = change.Value
+	statement := m.stmtSetStat
+	switch change.Mode {
+	case ModeAdd:
+		statement, operand = m.stmtAddStat, change.Number
+	case ModeMax:
+		statement, operand = m.stmtMaxStat, change.Number
+	case ModeMin:
+		statement, operand = m.stmtMinStat, change.Number
+	}
+
+	_, err = tx.Stmt(statement).Exec(update.UserID, update.HeroID, change.Key, change.Initial(), operand)
+	if err != nil {
+		return err
+	}
+
+	// The row is locked by our transaction now, so this is the value we wrote
+	var stored string
+	err = tx.Stmt(m.stmtGetStat).QueryRow(update.UserID, update.HeroID, change.Key).Scan(&stored)
+	if err != nil {
+		return err
+	}
+
+	value, err := change.Check(stored)
+	if err != nil {
+		*rejected = append(*rejected, Rejection{update.HeroID, change.Key, err})
+		return nil
+	}
+
+	if value != stored {
+		_, err = tx.Stmt(m.stmtSetStat).Exec(update.UserID, update.HeroID, change.Key, value, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if old.Valid && old.String == value {
+		return nil
+	}
+
+	_, err = tx.Stmt(m.stmtAddHistory).Exec(update.UserID, update.HeroID, change.Key, old, value, source, update.GID, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	log.Noteln("Updated stat " + change.Key + " of hero " + update.HeroID + " (" + change.Mode + " " + change.Value + ") to " + value)
+	return nil
+}
+
+// Close releases the prepared statements
+func (m *MySQLStore) Close() {
+	m.stmtSetStat.Close()
+	m.stmtAddStat.Close()
+	m.stmtMaxStat.Close()
+	m.stmtMinStat.Close()
+	m.stmtGetStat.Close()
+	m.stmtLoadHero.Close()
+	m.stmtLockStat.Close()
+	m.stmtDeleteStat.Close()
+	m.stmtAddHistory.Close()
+	m.stmtGetHistory.Close()
+	m.stmtGetHistorySince.Close()
+}
@@ -0,0 +1,178 @@
+package stats
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrDerivedStat - the backend owns the stat for this writer, like the level computed from XP
+	ErrDerivedStat = errors.New("stat is derived")
+	// ErrLocked - the hero hasn't reached the level that unlocks the stat
+	ErrLocked = errors.New("stat locked")
+)
+
+// SourceProgression - history source of level ups, rewards and grants
+const SourceProgression = "progression"
+
+// Progression - XP curve, level-up rewards and grants, owned by the backend
+type Progression struct {
+	XPKey    string `yaml:"xpKey"`
+	LevelKey string `yaml:"levelKey"`
+	// RewardKey receives the reward of every level reached, like c_wallet_hero
+	RewardKey string  `yaml:"rewardKey"`
+	Levels    []Level `yaml:"levels"`
+}
+
+// Level - what a hero needs to reach a level and gets for it
+type Level struct {
+	Level int `yaml:"level"`
+	// XP is the total XP needed for this level
+	XP     float64 `yaml:"xp"`
+	Reward float64 `yaml:"reward"`
+	// Grants are stats set when the level is reached
+	Grants map[string]string `yaml:"grants"`
+}
+
+func (p *Progression) check() error {
+	if p.XPKey == "" || p.LevelKey == "" {
+		return errors.New("stats: progression needs xpKey and levelKey")
+	}
+
+	for i := 1; i < len(p.Levels); i++ {
+		if p.Levels[i].Level <= p.Levels[i-1].Level || p.Levels[i].XP < p.Levels[i-1].XP {
+			return errors.New("stats: progression levels must be ordered by level and xp, see level " + strconv.Itoa(p.Levels[i].Level))
+		}
+	}
+
+	return nil
+}
+
+// LevelFor returns the level a hero with xp has, 1 below the first level of the curve
+func (p *Progression) LevelFor(xp float64) int {
+	level := 1
+	for _, entry := range p.Levels {
+		if xp < entry.XP {
+			break
+		}
+		level = entry.Level
+	}
+
+	return level
+}
+
+// LevelUps returns the levels above from that xp reaches
+func (p *Progression) LevelUps(from int, xp float64) []Level {
+	var levels []Level
+	for _, entry := range p.Levels {
+		if entry.Level > from && xp >= entry.XP {
+			levels = append(levels, entry)
+		}
+	}
+
+	return levels
+}
+
+// Derived reports whether key is computed by the backend and can't be written by game clients or servers
+func (r *Registry) Derived(key string) bool {
+	return r.Progression != nil && key == r.Progression.LevelKey
+}
+
+// Unlocked reports whether a hero at level may write key
+func (r *Registry) Unlocked(key string, level string) bool {
+	definition := r.Lookup(key)
+	if definition == nil || definition.MinLevel == 0 {
+		return true
+	}
+
+	current, err := strconv.ParseFloat(r.valueOrDefault(r.levelKey(), level), 64)
+	if err != nil {
+		return false
+	}
+
+	return int(current) >= definition.MinLevel
+}
+
+// Progress returns the changes a hero gets for the levels its XP reached, values holds its XP and level
+func (r *Registry) Progress(values map[string]string) []*Change {
+	if r.Progression == nil {
+		return nil
+	}
+	p := r.Progression
+
+	xp, err := strconv.ParseFloat(r.valueOrDefault(p.XPKey, values[p.XPKey]), 64)
+	if err != nil {
+		return nil
+	}
+	level, err := strconv.ParseFloat(r.valueOrDefault(p.LevelKey, values[p.LevelKey]), 64)
+	if err != nil {
+		level = 1
+	}
+
+	levels := p.LevelUps(int(level), xp)
+	if len(levels) == 0 {
+		return nil
+	}
+
+	var changes []*Change
+	reward := 0.0
+	for _, entry := range levels {
+		reward += entry.Reward
+		for key, value := range entry.Grants {
+			changes = r.appendSystemChange(changes, key, ModeSet, value)
+		}
+	}
+
+	changes = r.appendSystemChange(changes, p.LevelKey, ModeSet, strconv.Itoa(levels[len(levels)-1].Level))
+	if reward != 0 && p.RewardKey != "" {
+		changes = r.appendSystemChange(changes, p.RewardKey, ModeAdd, strconv.FormatFloat(reward, 'f', -1, 64))
+	}
+
+	return changes
+}
+
+// appendSystemChange adds a change made by the backend itself, writers don't apply to it
+func (r *Registry) appendSystemChange(changes []*Change, key string, mode string, value string) []*Change {
+	if change := r.systemChange(key, mode, value); change != nil {
+		return append(changes, change)
+	}
+
+	return changes
+}
+
+// systemChange returns a change made by the backend itself, nil if key or value are invalid
+func (r *Registry) systemChange(key string, mode string, value string) *Change {
+	definition := r.Lookup(key)
+	if definition == nil {
+		return nil
+	}
+
+	change := &Change{Key: key, Mode: mode, Value: value, definition: definition}
+	if definition.Type == TypeText {
+		change.Mode, change.text = ModeSet, true
+	} else {
+		number, err := definition.parse(value)
+		if err != nil {
+			return nil
+		}
+		change.Number = number
+	}
+
+	return change
+}
+
+func (r *Registry) levelKey() string {
+	if r.Progression == nil {
+		return ""
+	}
+
+	return r.Progression.LevelKey
+}
+
+func (r *Registry) valueOrDefault(key string, value string) string {
+	if value == "" {
+		return r.Default(key)
+	}
+
+	return value
+}
@@ -0,0 +1,717 @@
+package stats
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// CacheTTL - how long stats of a hero stay cached after they were last used
+	CacheTTL = time.Minute * 30
+	// FlushInterval - how often pending changes are written back to MySQL
+	FlushInterval = time.Second * 5
+)
+
+const (
+	dirtyKey        = "stats:dirty"
+	historyQueueKey = "stats:history"
+	historyLockKey  = "stats:history:flushing"
+	// Set while Reset runs, stats are neither cached nor changed meanwhile
+	resetLockKey = "stats:resetting"
+
+	// Fields of the cached hash that aren't stats, stat keys never start with @
+	ownerField = "@user"
+
+	// Optimistic transactions are retried this often when another shard wrote the same hero
+	applyRetries = 10
+	// Rollback and Invalidate wait this often for lockWait when another shard flushes the hero
+	lockAttempts = 50
+	lockWait     = time.Millisecond * 100
+	// Apply waits this often for lockWait while a Reset runs
+	resetAttempts = 600
+	// A Reset that didn't finish within this long crashed
+	resetTimeout = time.Minute * 10
+	// A history flush holds its lock this long per batch
+	historyLockTTL = time.Minute
+	// Rows of the history queue written per transaction
+	historyBatch = 500
+)
+
+// takeDirtyScript returns the owner and the changed keys with their values of a cached hero and
+// forgets that they changed, in one step so a change made meanwhile is never forgotten unsaved.
+// KEYS are the cached hero and its set of changed keys, ARGV[1] the owner field.
+var takeDirtyScript = redis.NewScript(`
+local fields = redis.call("SMEMBERS", KEYS[2])
+redis.call("DEL", KEYS[2])
+if #fields == 0 then
+	return {}
+end
+
+local result = {redis.call("HGET", KEYS[1], ARGV[1]) or ""}
+local values = redis.call("HMGET", KEYS[1], unpack(fields))
+for i, field in ipairs(fields) do
+	if values[i] then
+		table.insert(result, field)
+		table.insert(result, values[i])
+	end
+end
+return result`)
+
+// RedisStore - caches game_stats in redis, serves reads from there and writes changes
+// back to MySQL every FlushInterval
+type RedisStore struct {
+	redis    *redis.Client
+	database *MySQLStore
+
+	// CheckConsistency compares every cache hit of a hero without pending changes with MySQL and logs differences
+	CheckConsistency bool
+}
+
+// New sets up the cache in front of database and starts flushing
+func (r *RedisStore) New(redis *redis.Client, database *MySQLStore) {
+	r.redis = redis
+	r.database = database
+
+	go func() {
+		for range time.NewTicker(FlushInterval).C {
+			if err := r.Flush(); err != nil {
+				log.Errorln("Failed flushing stats", err)
+			}
+		}
+	}()
+}
+
+// Get serves the stats from the cache, loading the hero from MySQL on a miss
+func (r *RedisStore) Get(userID string, heroID string, keys []string) (map[string]string, error) {
+	// Everything was flushed before the reset, MySQL is what counts until it's done
+	if r.resetting() {
+		return r.database.Get(userID, heroID, keys)
+	}
+
+	err := r.load(heroID)
+	if err == ErrHeroNotFound {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := r.redis.HGetAll(cacheKey(heroID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if userID != "" && values[ownerField] != userID {
+		return make(map[string]string), nil
+	}
+
+	if r.CheckConsistency {
+		r.logMismatches(heroID)
+	}
+
+	return pick(values, keys), nil
+}
+
+// Apply checks all updates against the cached values and writes them in one redis transaction.
+// If another shard changes one of the heroes meanwhile, everything is checked again.
+func (r *RedisStore) Apply(updates []*HeroUpdate) ([]Rejection, error) {
+	if err := r.waitForReset(); err != nil {
+		return nil, err
+	}
+
+	keys := []string{resetLockKey}
+	for _, update := range updates {
+		if err := r.load(update.HeroID); err != nil && err != ErrHeroNotFound {
+			return nil, err
+		}
+		keys = append(keys, cacheKey(update.HeroID))
+	}
+
+	var rejected []Rejection
+	apply := func(tx *redis.Tx) error {
+		rejected = nil
+
+		// A reset started since we waited, the watch makes sure it can't start while we write
+		if tx.Exists(resetLockKey).Val() == 1 {
+			return ErrResetting
+		}
+
+		values := make(map[string]map[string]interface{})
+		var history []interface{}
+		for _, update := range updates {
+			cached, err := tx.HGetAll(cacheKey(update.HeroID)).Result()
+			if err != nil {
+				return err
+			}
+
+			if len(cached) == 0 || cached[ownerField] != update.UserID {
+				reason := ErrNotOwner
+				if len(cached) == 0 {
+					reason = ErrHeroNotFound
+				}
+				for _, change := range update.Changes {
+					rejected = append(rejected, Rejection{update.HeroID, change.Key, reason})
+				}
+				continue
+			}
+
+			changed := make(map[string]interface{})
+			applyChange := func(change *Change, source string) error {
+				if !Definitions.Unlocked(change.Key, cached[Definitions.levelKey()]) {
+					rejected = append(rejected, Rejection{update.HeroID, change.Key, ErrLocked})
+					return nil
+				}
+
+				current, existed := cached[change.Key]
+				value, err := change.Result(current)
+				if err != nil {
+					rejected = append(rejected, Rejection{update.HeroID, change.Key, err})
+					return nil
+				}
+				if existed && value == current {
+					return nil
+				}
+
+				// Later changes of the same key in this request build on this one
+				cached[change.Key] = value
+				changed[change.Key] = value
+
+				entry := &HistoryEntry{
+					UserID:    update.UserID,
+					HeroID:    update.HeroID,
+					Key:       change.Key,
+					NewValue:  &value,
+					Source:    source,
+					GID:       update.GID,
+					CreatedAt: time.Now().Unix(),
+				}
+				if existed {
+					entry.OldValue = &current
+				}
+
+				data, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
+				history = append(history, string(data))
+				return nil
+			}
+
+			for _, sent := range update.Changes {
+				if err := applyChange(sent, update.Source); err != nil {
+					return err
+				}
+			}
+			// Level ups of the XP gained above
+			for _, derived := range Definitions.Progress(cached) {
+				if err := applyChange(derived, SourceProgression); err != nil {
+					return err
+				}
+			}
+			values[update.HeroID] = changed
+		}
+
+		if len(rejected) > 0 {
+			return nil
+		}
+
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for heroID, changed := range values {
+				if len(changed) == 0 {
+					continue
+				}
+				fields := make([]interface{}, 0, len(changed))
+				for key := range changed {
+					fields = append(fields, key)
+				}
+
+				pipe.HMSet(cacheKey(heroID), changed)
+				// Pending changes must not expire before they were flushed
+				pipe.Persist(cacheKey(heroID))
+				pipe.SAdd(dirtyFieldsKey(heroID), fields...)
+				pipe.SAdd(dirtyKey, heroID)
+			}
+			if len(history) > 0 {
+				pipe.RPush(historyQueueKey, history...)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < applyRetries; i++ {
+		err := r.redis.Watch(apply, keys...)
+		if err == ErrResetting {
+			// The reset dropped the cached values, load them again once it's done
+			return r.Apply(updates)
+		}
+		if err != redis.TxFailedErr {
+			return rejected, err
+		}
+	}
+
+	return nil, redis.TxFailedErr
+}
+
+// History writes the queued history to MySQL and reads it from there
+func (r *RedisStore) History(heroID string, limit int) ([]*HistoryEntry, error) {
+	if err := r.waitForHistory(); err != nil {
+		return nil, err
+	}
+
+	return r.database.History(heroID, limit)
+}
+
+// Rollback flushes the hero, rolls it back in MySQL and drops the cached copy. The hero stays
+// locked throughout, so no flush can write the old values back.
+func (r *RedisStore) Rollback(heroID string, to time.Time, source string) ([]string, error) {
+	if err := r.waitForHero(heroID); err != nil {
+		return nil, err
+	}
+	defer r.unlockHero(heroID)
+
+	if err := r.dropHero(heroID); err != nil {
+		return nil, err
+	}
+	// Entries still queued would be missed by the rollback and never undone
+	if err := r.waitForHistory(); err != nil {
+		return nil, err
+	}
+
+	keys, err := r.database.Rollback(heroID, to, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// A read may have cached the values from before the rollback meanwhile
+	return keys, r.dropHero(heroID)
+}
+
+// Reset writes every pending change, removes keys from the cached heroes and resets them in MySQL.
+// Meanwhile changes wait and reads go to MySQL, so no change can bring back a value from before the reset.
+func (r *RedisStore) Reset(keys []string, source string) error {
+	token, err := lock(r.redis, resetLockKey, resetTimeout)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return ErrResetting
+	}
+	defer unlock(r.redis, resetLockKey, token)
+
+	if err := r.Flush(); err != nil {
+		return err
+	}
+
+	fields := make([]interface{}, len(keys))
+	for i, key := range keys {
+		fields[i] = key
+	}
+
+	// SCAN instead of KEYS, so redis keeps answering the shards meanwhile
+	iterator := r.redis.Scan(0, cacheKey("*"), 1000).Iterator()
+	for iterator.Next() {
+		key := iterator.Val()
+		if strings.HasSuffix(key, ":flushing") {
+			continue
+		}
+
+		// A flush of another shard still running could write the old values after the database reset
+		heroID := strings.TrimPrefix(key, cacheKey(""))
+		if err := r.waitForHero(heroID); err != nil {
+			return err
+		}
+
+		_, err := r.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HDel(key, keys...)
+			pipe.SRem(dirtyFieldsKey(heroID), fields...)
+			return nil
+		})
+		r.unlockHero(heroID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return err
+	}
+
+	return r.database.Reset(keys, source)
+}
+
+// Invalidate writes pending changes of heroID and drops it from the cache,
+// the next read loads it from MySQL again
+func (r *RedisStore) Invalidate(heroID string) error {
+	if err := r.waitForHero(heroID); err != nil {
+		return err
+	}
+	defer r.unlockHero(heroID)
+
+	return r.dropHero(heroID)
+}
+
+// Verify compares the cached stats of heroID with MySQL. Heroes with pending changes differ on purpose and are skipped.
+func (r *RedisStore) Verify(heroID string) ([]Mismatch, error) {
+	cached, err := r.redis.HGetAll(cacheKey(heroID)).Result()
+	if err != nil || len(cached) == 0 {
+		return nil, err
+	}
+	if r.redis.SIsMember(dirtyKey, heroID).Val() {
+		return nil, nil
+	}
+
+	_, stored, err := r.database.Load(heroID)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []Mismatch
+	for key, value := range cached {
+		if strings.HasPrefix(key, "@") {
+			continue
+		}
+		if stored[key] != value {
+			mismatches = append(mismatches, Mismatch{key, value, stored[key]})
+		}
+	}
+	for key, value := range stored {
+		if _, ok := cached[key]; !ok {
+			mismatches = append(mismatches, Mismatch{key, "", value})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Key < mismatches[j].Key })
+
+	return mismatches, nil
+}
+
+// Flush writes every hero with pending changes and the queued history to MySQL
+func (r *RedisStore) Flush() error {
+	// Heroes another shard is flushing right now go back into the set, so only take what is there now
+	pending, err := r.redis.SCard(dirtyKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for i := int64(0); i < pending; i++ {
+		heroID, err := r.redis.SPop(dirtyKey).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := r.flushHero(heroID); err != nil {
+			return err
+		}
+	}
+
+	return r.flushHistory()
+}
+
+// flushHero writes the pending changes of heroID to MySQL. Only one shard flushes a hero at a time,
+// if another one already does, the hero is marked dirty again and picked up by the next flush.
+func (r *RedisStore) flushHero(heroID string) error {
+	locked, err := r.lockHero(heroID)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return r.redis.SAdd(dirtyKey, heroID).Err()
+	}
+	defer r.unlockHero(heroID)
+
+	return r.saveHero(heroID)
+}
+
+// saveHero writes the keys changed since the last save of heroID to MySQL, the caller holds the lock of the hero
+func (r *RedisStore) saveHero(heroID string) error {
+	r.redis.SRem(dirtyKey, heroID)
+
+	taken, err := takeDirtyScript.Run(r.redis, []string{cacheKey(heroID), dirtyFieldsKey(heroID)}, ownerField).Result()
+	if err != nil {
+		return err
+	}
+
+	pending := taken.([]interface{})
+	if len(pending) == 0 {
+		return nil
+	}
+
+	userID, _ := pending[0].(string)
+	values := make(map[string]string)
+	for i := 1; i+1 < len(pending); i += 2 {
+		values[pending[i].(string)] = pending[i+1].(string)
+	}
+
+	if err := r.database.Save(userID, heroID, values, nil); err != nil {
+		// Keys changed meanwhile are in the set already, the others go back
+		fields := make([]interface{}, 0, len(values))
+		for key := range values {
+			fields = append(fields, key)
+		}
+		if len(fields) > 0 {
+			r.redis.SAdd(dirtyFieldsKey(heroID), fields...)
+		}
+		r.redis.SAdd(dirtyKey, heroID)
+		return err
+	}
+
+	// Changes written while we were saving keep the hero dirty and without TTL
+	if !r.redis.SIsMember(dirtyKey, heroID).Val() {
+		r.redis.Expire(cacheKey(heroID), CacheTTL)
+	}
+
+	return nil
+}
+
+// dropHero saves the pending changes of heroID and removes it from the cache. If it changes while
+// being saved, it is saved again. The caller holds the lock of the hero.
+func (r *RedisStore) dropHero(heroID string) error {
+	key := cacheKey(heroID)
+
+	for i := 0; i < applyRetries; i++ {
+		if err := r.saveHero(heroID); err != nil {
+			return err
+		}
+
+		err := r.redis.Watch(func(tx *redis.Tx) error {
+			if tx.SCard(dirtyFieldsKey(heroID)).Val() > 0 {
+				return redis.TxFailedErr
+			}
+
+			_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Del(key)
+				pipe.SRem(dirtyKey, heroID)
+				return nil
+			})
+			return err
+		}, key, dirtyFieldsKey(heroID))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// lockHero takes the flush lock of heroID, false if another shard holds it
+func (r *RedisStore) lockHero(heroID string) (bool, error) {
+	return r.redis.SetNX(flushLockKey(heroID), "1", time.Minute).Result()
+}
+
+func (r *RedisStore) unlockHero(heroID string) {
+	r.redis.Del(flushLockKey(heroID))
+}
+
+// waitForHero takes the flush lock of heroID, waiting for a flush of another shard to finish
+func (r *RedisStore) waitForHero(heroID string) error {
+	for i := 0; i < lockAttempts; i++ {
+		locked, err := r.lockHero(heroID)
+		if err != nil || locked {
+			return err
+		}
+		time.Sleep(lockWait)
+	}
+
+	return ErrHeroBusy
+}
+
+func (r *RedisStore) resetting() bool {
+	return r.redis.Exists(resetLockKey).Val() == 1
+}
+
+// unlockScript deletes the lock at KEYS[1] only if it still holds the token ARGV[1],
+// a lock that expired and was taken by another shard meanwhile stays theirs
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// extendScript restarts the TTL of the lock at KEYS[1] to ARGV[2] ms if it still holds the token ARGV[1]
+var extendScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// lock takes the lock at key for ttl and returns the token to release it with, "" if another shard holds it
+func lock(client *redis.Client, key string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	locked, err := client.SetNX(key, token, ttl).Result()
+	if err != nil || !locked {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func unlock(client *redis.Client, key string, token string) {
+	if err := unlockScript.Run(client, []string{key}, token).Err(); err != nil {
+		log.Errorln("Failed releasing lock "+key, err)
+	}
+}
+
+// waitForReset returns once no Reset is running, ErrResetting if it takes too long
+func (r *RedisStore) waitForReset() error {
+	for i := 0; i < resetAttempts; i++ {
+		if !r.resetting() {
+			return nil
+		}
+		time.Sleep(lockWait)
+	}
+
+	return ErrResetting
+}
+
+// flushHistory moves the queued history entries into game_stats_history, unless another shard does already
+func (r *RedisStore) flushHistory() error {
+	token, err := lock(r.redis, historyLockKey, historyLockTTL)
+	if err != nil || token == "" {
+		return err
+	}
+	defer unlock(r.redis, historyLockKey, token)
+
+	return r.moveHistory(token)
+}
+
+// waitForHistory flushes the history queue, waiting for a flush of another shard to finish first.
+// Once it returns, every change applied before is in game_stats_history.
+func (r *RedisStore) waitForHistory() error {
+	for i := 0; i < lockAttempts; i++ {
+		token, err := lock(r.redis, historyLockKey, historyLockTTL)
+		if err != nil {
+			return err
+		}
+		if token == "" {
+			time.Sleep(lockWait)
+			continue
+		}
+		defer unlock(r.redis, historyLockKey, token)
+
+		return r.moveHistory(token)
+	}
+
+	return ErrHistoryBusy
+}
+
+// moveHistory writes the queue in batches, the caller holds historyLockKey with token
+func (r *RedisStore) moveHistory(token string) error {
+	for {
+		queued, err := r.redis.LRange(historyQueueKey, 0, historyBatch-1).Result()
+		if err != nil || len(queued) == 0 {
+			return err
+		}
+
+		var history []*HistoryEntry
+		for _, data := range queued {
+			entry := new(HistoryEntry)
+			if err := json.Unmarshal([]byte(data), entry); err != nil {
+				log.Errorln("Dropping invalid stats history entry", data, err)
+				continue
+			}
+			history = append(history, entry)
+		}
+
+		if err := r.database.Save("", "", nil, history); err != nil {
+			return err
+		}
+
+		r.redis.LTrim(historyQueueKey, int64(len(queued)), -1)
+
+		// A lock that expired meanwhile belongs to another shard now, writing on would insert its batch twice
+		kept, err := extendScript.Run(r.redis, []string{historyLockKey}, token, int64(historyLockTTL/time.Millisecond)).Int64()
+		if err != nil {
+			return err
+		}
+		if kept == 0 {
+			return ErrHistoryBusy
+		}
+	}
+}
+
+// load copies the stats of heroID from MySQL into the cache unless they are cached already
+func (r *RedisStore) load(heroID string) error {
+	key := cacheKey(heroID)
+
+	exists, err := r.redis.Exists(key).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 1 {
+		// Heroes with pending changes have no TTL, they expire once flushed
+		if r.redis.TTL(key).Val() > 0 {
+			r.redis.Expire(key, CacheTTL)
+		}
+		return nil
+	}
+
+	userID, values, err := r.database.Load(heroID)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]interface{})
+	data[ownerField] = userID
+	for statsKey, value := range values {
+		data[statsKey] = value
+	}
+
+	// Don't overwrite what another shard cached (and maybe changed) in the meantime,
+	// and don't cache values a running reset is about to remove
+	err = r.redis.Watch(func(tx *redis.Tx) error {
+		if tx.Exists(key).Val() == 1 || tx.Exists(resetLockKey).Val() == 1 {
+			return nil
+		}
+
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HMSet(key, data)
+			pipe.Expire(key, CacheTTL)
+			return nil
+		})
+		return err
+	}, key, resetLockKey)
+	if err == redis.TxFailedErr {
+		return nil
+	}
+
+	return err
+}
+
+func (r *RedisStore) logMismatches(heroID string) {
+	mismatches, err := r.Verify(heroID)
+	if err != nil {
+		log.Errorln("Failed checking cached stats of hero "+heroID, err)
+		return
+	}
+
+	for _, mismatch := range mismatches {
+		log.Errorln("Cached stat " + mismatch.Key + " of hero " + heroID + " is " + mismatch.Cached + " but " + mismatch.Database + " in MySQL")
+	}
+}
+
+func cacheKey(heroID string) string {
+	return "stats:hero:" + heroID
+}
+
+func flushLockKey(heroID string) string {
+	return cacheKey(heroID) + ":flushing"
+}
+
+// The keys of heroID changed since it was last saved to MySQL
+func dirtyFieldsKey(heroID string) string {
+	return "stats:dirtyKeys:" + heroID
+}
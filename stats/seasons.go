@@ -0,0 +1,516 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"../log"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrSeasonNotFound - there is no season with that id
+	ErrSeasonNotFound = errors.New("season not found")
+	// ErrSeasonArchived - the season ended already
+	ErrSeasonArchived = errors.New("season already archived")
+	// ErrSeasonNotArchived - the season is still running, its stats are the current ones
+	ErrSeasonNotArchived = errors.New("season not archived yet")
+	// ErrSeasonEnding - another shard is ending a season right now
+	ErrSeasonEnding = errors.New("season is being ended")
+
+	// SeasonCheckInterval - how often ended seasons are looked for
+	SeasonCheckInterval = time.Minute
+)
+
+const seasonLockKey = "seasons:ending"
+
+// Phases of ending a season, each one is done once even if ending fails halfway and is retried
+const (
+	phaseRunning  = ""
+	phaseArchived = "archived"
+	phaseRewarded = "rewarded"
+	phaseEnded    = "ended"
+)
+
+// SeasonConfig - the stats that start over every season and what the best heroes get, from stats.yml
+type SeasonConfig struct {
+	Keys    []string       `yaml:"keys"`
+	Rewards []SeasonReward `yaml:"rewards"`
+}
+
+// SeasonReward - granted to the heroes finishing a season ranked From to To on Leaderboard
+type SeasonReward struct {
+	Leaderboard string `yaml:"leaderboard"`
+	From        int    `yaml:"from"`
+	To          int    `yaml:"to"`
+	// Key is changed by Value with the mode of the stat, like adding to c_wallet_hero
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+// Season - a competitive season, times are unix timestamps
+type Season struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	StartsAt int64  `json:"startsAt"`
+	EndsAt   int64  `json:"endsAt"`
+	// ArchivedAt is 0 until the season ended and its stats were archived and reset
+	ArchivedAt int64 `json:"archivedAt"`
+	// Phase is how far ending the season got, "" while it runs
+	Phase string `json:"phase,omitempty"`
+}
+
+// Seasons - ends seasons on schedule: archives the seasonal stats into game_stats_season_<id>,
+// grants the rewards of the final ranks and resets the stats to their defaults
+type Seasons struct {
+	db    *sql.DB
+	redis *redis.Client
+	store StatsStore
+
+	// Database Statements
+	stmtGetSeasons       *sql.Stmt
+	stmtGetSeason        *sql.Stmt
+	stmtGetCurrentSeason *sql.Stmt
+	stmtGetEndedSeasons  *sql.Stmt
+	stmtAddSeason        *sql.Stmt
+	stmtSetPhase         *sql.Stmt
+	stmtArchiveSeason    *sql.Stmt
+}
+
+var (
+	currentSeason      *Season
+	currentSeasonMutex sync.RWMutex
+)
+
+const seasonColumns = "id, name, UNIX_TIMESTAMP(starts_at), UNIX_TIMESTAMP(ends_at), IFNULL(UNIX_TIMESTAMP(archived_at), 0), phase"
+
+// New prepares the statements and starts ending seasons on schedule, store is where rewards and resets go
+func (s *Seasons) New(db *sql.DB, redis *redis.Client, store StatsStore) {
+	s.db = db
+	s.redis = redis
+	s.store = store
+
+	s.prepareStatements()
+	s.refreshCurrent()
+
+	go func() {
+		for range time.NewTicker(SeasonCheckInterval).C {
+			s.endDue()
+			s.refreshCurrent()
+		}
+	}()
+}
+
+func (s *Seasons) prepareStatements() {
+	var err error
+
+	s.stmtGetSeasons, err = s.db.Prepare(
+		"SELECT " + seasonColumns +
+			"	FROM game_seasons" +
+			"	ORDER BY starts_at DESC")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetSeasons.", err.Error())
+	}
+
+	s.stmtGetSeason, err = s.db.Prepare(
+		"SELECT " + seasonColumns +
+			"	FROM game_seasons" +
+			"	WHERE id = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetSeason.", err.Error())
+	}
+
+	s.stmtGetCurrentSeason, err = s.db.Prepare(
+		"SELECT " + seasonColumns +
+			"	FROM game_seasons" +
+			"	WHERE starts_at <= NOW() AND ends_at > NOW() AND archived_at IS NULL" +
+			"	ORDER BY starts_at DESC" +
+			"	LIMIT 1")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetCurrentSeason.", err.Error())
+	}
+
+	s.stmtGetEndedSeasons, err = s.db.Prepare(
+		"SELECT " + seasonColumns +
+			"	FROM game_seasons" +
+			"	WHERE ends_at <= NOW() AND archived_at IS NULL" +
+			"	ORDER BY ends_at ASC")
+	if err != nil {
+		log.Fatalln("Error preparing stmtGetEndedSeasons.", err.Error())
+	}
+
+	s.stmtAddSeason, err = s.db.Prepare(
+		"INSERT INTO game_seasons (name, starts_at, ends_at)" +
+			"	VALUES (?, FROM_UNIXTIME(?), FROM_UNIXTIME(?))")
+	if err != nil {
+		log.Fatalln("Error preparing stmtAddSeason.", err.Error())
+	}
+
+	s.stmtSetPhase, err = s.db.Prepare(
+		"UPDATE game_seasons" +
+			"	SET phase = ?" +
+			"	WHERE id = ? AND phase = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtSetPhase.", err.Error())
+	}
+
+	s.stmtArchiveSeason, err = s.db.Prepare(
+		"UPDATE game_seasons" +
+			"	SET archived_at = NOW(), phase = ?" +
+			"	WHERE id = ? AND phase = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtArchiveSeason.", err.Error())
+	}
+}
+
+// CurrentSeason returns the running season, nil between seasons
+func CurrentSeason() *Season {
+	currentSeasonMutex.RLock()
+	defer currentSeasonMutex.RUnlock()
+
+	return currentSeason
+}
+
+// List returns every season, newest first
+func (s *Seasons) List() ([]*Season, error) {
+	rows, err := s.stmtGetSeasons.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSeasons(rows)
+}
+
+// Get returns one season
+func (s *Seasons) Get(id int64) (*Season, error) {
+	season := new(Season)
+	err := s.stmtGetSeason.QueryRow(id).Scan(&season.ID, &season.Name, &season.StartsAt, &season.EndsAt, &season.ArchivedAt, &season.Phase)
+	if err == sql.ErrNoRows {
+		return nil, ErrSeasonNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return season, nil
+}
+
+// Add schedules a season
+func (s *Seasons) Add(name string, startsAt time.Time, endsAt time.Time) (*Season, error) {
+	if !endsAt.After(startsAt) {
+		return nil, errors.New("season has to end after it starts")
+	}
+
+	result, err := s.stmtAddSeason.Exec(name, startsAt.Unix(), endsAt.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	s.refreshCurrent()
+	return &Season{ID: id, Name: name, StartsAt: startsAt.Unix(), EndsAt: endsAt.Unix()}, nil
+}
+
+// End archives the seasonal stats of the season, grants the rewards of the final ranks and resets the stats.
+// Only one shard ends seasons at a time, a season that failed halfway continues where it stopped.
+func (s *Seasons) End(id int64) error {
+	token, err := lock(s.redis, seasonLockKey, time.Minute*10)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return ErrSeasonEnding
+	}
+	defer unlock(s.redis, seasonLockKey, token)
+
+	return s.end(id)
+}
+
+// end runs the phases of ending a season left, the caller holds seasonLockKey
+func (s *Seasons) end(id int64) error {
+	season, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if season.ArchivedAt != 0 {
+		return ErrSeasonArchived
+	}
+	if Definitions.Season == nil || len(Definitions.Season.Keys) == 0 {
+		return errors.New("no seasonal stats configured")
+	}
+
+	source := "season:" + strconv.FormatInt(id, 10)
+
+	if season.Phase == phaseRunning {
+		// Pending changes of the cache belong to the season that ends
+		if err := s.store.Flush(); err != nil {
+			return err
+		}
+		// Archiving twice writes the same rows again, so a retry is harmless
+		if err := s.archive(season); err != nil {
+			return err
+		}
+		if err := s.advance(season, phaseArchived, s.stmtSetPhase); err != nil {
+			return err
+		}
+	}
+
+	if season.Phase == phaseArchived {
+		s.grantRewards(season, source)
+		if err := s.advance(season, phaseRewarded, s.stmtSetPhase); err != nil {
+			return err
+		}
+	}
+
+	if season.Phase == phaseRewarded {
+		if err := s.store.Reset(Definitions.Season.Keys, source); err != nil {
+			return err
+		}
+		// archived_at marks the season done, it's only set once the stats are reset
+		if err := s.advance(season, phaseEnded, s.stmtArchiveSeason); err != nil {
+			return err
+		}
+	}
+
+	s.refreshCurrent()
+	log.Noteln("Ended season " + season.Name)
+	return nil
+}
+
+// advance moves season from its phase to phase, ErrSeasonArchived if it isn't in the phase it was read in
+func (s *Seasons) advance(season *Season, phase string, stmt *sql.Stmt) error {
+	result, err := stmt.Exec(phase, season.ID, season.Phase)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrSeasonArchived
+	}
+
+	season.Phase = phase
+	return nil
+}
+
+// Archived returns the values of keys heroID had when the season ended, only seasonal stats are archived.
+// userID limits the lookup to heroes of that account like StatsStore.Get, "" accepts any owner.
+func (s *Seasons) Archived(id int64, userID string, heroID string, keys []string) (map[string]string, error) {
+	season, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if season.ArchivedAt == 0 {
+		return nil, ErrSeasonNotArchived
+	}
+
+	rows, err := s.db.Query("SELECT statsKey, statsValue FROM "+seasonTable(id)+
+		"	WHERE heroID = ? AND (? = '' OR user_id = ?)", heroID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+
+	return pick(values, keys), rows.Err()
+}
+
+// endDue ends every season past its end, only one shard does it at a time
+func (s *Seasons) endDue() {
+	token, err := lock(s.redis, seasonLockKey, time.Minute*10)
+	if err != nil || token == "" {
+		return
+	}
+	defer unlock(s.redis, seasonLockKey, token)
+
+	rows, err := s.stmtGetEndedSeasons.Query()
+	if err != nil {
+		log.Errorln("Failed getting ended seasons", err)
+		return
+	}
+
+	seasons, err := scanSeasons(rows)
+	if err != nil {
+		log.Errorln("Failed getting ended seasons", err)
+		return
+	}
+
+	for _, season := range seasons {
+		if err := s.end(season.ID); err != nil && err != ErrSeasonArchived {
+			log.Errorln("Failed ending season "+season.Name, err)
+		}
+	}
+}
+
+// archive copies the seasonal stats into the table of the season
+func (s *Seasons) archive(season *Season) error {
+	table := seasonTable(season.ID)
+
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS " + table + " LIKE game_stats")
+	if err != nil {
+		return err
+	}
+
+	args := make([]interface{}, len(Definitions.Season.Keys))
+	for i, key := range Definitions.Season.Keys {
+		args[i] = key
+	}
+
+	_, err = s.db.Exec("REPLACE INTO "+table+
+		"	SELECT * FROM game_stats"+
+		"	WHERE statsKey IN ("+placeholders(len(args))+")", args...)
+	return err
+}
+
+// grantRewards gives every configured reward to the heroes ranked for it in the archive of the season.
+// Leaderboards grouped by a stat are ranked per group, like the leaderboards clients see.
+// Each hero is rewarded on its own, a rejected reward doesn't cost the others theirs.
+func (s *Seasons) grantRewards(season *Season, source string) {
+	for _, reward := range Definitions.Season.Rewards {
+		updates, err := s.ranked(season, reward, source)
+		if err != nil {
+			log.Errorln("Failed ranking season "+season.Name+" by "+reward.Leaderboard, err)
+			continue
+		}
+
+		for _, update := range updates {
+			rejected, err := s.store.Apply([]*HeroUpdate{update})
+			if err != nil {
+				log.Errorln("Failed granting season reward to hero "+update.HeroID, err)
+				continue
+			}
+			for _, rejection := range rejected {
+				log.Errorln("Season reward "+rejection.Key+" of hero "+rejection.HeroID+" rejected:", rejection.Err)
+			}
+		}
+	}
+}
+
+// ranked returns the reward updates for the heroes ranked From to To on the leaderboard of reward
+func (s *Seasons) ranked(season *Season, reward SeasonReward, source string) ([]*HeroUpdate, error) {
+	board := Definitions.Leaderboard(reward.Leaderboard)
+
+	order := "DESC"
+	if board.Ascending {
+		order = "ASC"
+	}
+
+	// The group of a hero is the one it is in now, the archive only holds seasonal stats
+	rows, err := s.db.Query("SELECT archive.user_id, archive.heroID, grouped.statsValue"+
+		"	FROM "+seasonTable(season.ID)+" archive"+
+		"	LEFT JOIN game_stats grouped ON grouped.heroID = archive.heroID AND grouped.statsKey = ?"+
+		"	WHERE archive.statsKey = ?"+
+		"	ORDER BY archive.statsValue + 0 "+order+", archive.heroID ASC", board.GroupBy, reward.Leaderboard)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranks := make(map[string]int)
+	var updates []*HeroUpdate
+	for rows.Next() {
+		update := &HeroUpdate{Source: source}
+		var group sql.NullString
+		if err := rows.Scan(&update.UserID, &update.HeroID, &group); err != nil {
+			return nil, err
+		}
+
+		value := allGroup
+		if board.GroupBy != "" {
+			value = group.String
+			if !group.Valid {
+				value = Definitions.Default(board.GroupBy)
+			}
+			if value == "" {
+				continue
+			}
+		}
+
+		ranks[value]++
+		if ranks[value] < reward.From || ranks[value] > reward.To {
+			continue
+		}
+
+		update.Changes = []*Change{Definitions.systemChange(reward.Key, Definitions.Lookup(reward.Key).Mode, reward.Value)}
+		updates = append(updates, update)
+	}
+
+	return updates, rows.Err()
+}
+
+func (s *Seasons) refreshCurrent() {
+	season := new(Season)
+	err := s.stmtGetCurrentSeason.QueryRow().Scan(&season.ID, &season.Name, &season.StartsAt, &season.EndsAt, &season.ArchivedAt, &season.Phase)
+	if err == sql.ErrNoRows {
+		season = nil
+	} else if err != nil {
+		log.Errorln("Failed getting current season", err)
+		return
+	}
+
+	currentSeasonMutex.Lock()
+	currentSeason = season
+	currentSeasonMutex.Unlock()
+}
+
+// Seasonal reports whether key starts over every season
+func (r *Registry) Seasonal(key string) bool {
+	return r.Season != nil && contains(r.Season.Keys, key)
+}
+
+func (r *Registry) checkSeason() error {
+	for _, key := range r.Season.Keys {
+		if !r.Known(key) {
+			return errors.New("stats: unknown seasonal stat " + key)
+		}
+	}
+
+	for _, reward := range r.Season.Rewards {
+		switch {
+		case r.Leaderboard(reward.Leaderboard) == nil || !r.Seasonal(reward.Leaderboard):
+			return errors.New("stats: season reward needs a leaderboard of a seasonal stat, not " + reward.Leaderboard)
+		case reward.From < 1 || reward.To < reward.From:
+			return errors.New("stats: season reward on " + reward.Leaderboard + " needs 1 <= from <= to")
+		case !r.Known(reward.Key) || r.Seasonal(reward.Key):
+			return errors.New("stats: season reward " + reward.Key + " has to be a known stat that isn't reset")
+		case r.systemChange(reward.Key, r.Lookup(reward.Key).Mode, reward.Value) == nil:
+			return errors.New("stats: invalid season reward value " + reward.Value + " for " + reward.Key)
+		}
+	}
+
+	return nil
+}
+
+func scanSeasons(rows *sql.Rows) ([]*Season, error) {
+	defer rows.Close()
+
+	seasons := []*Season{}
+	for rows.Next() {
+		season := new(Season)
+		err := rows.Scan(&season.ID, &season.Name, &season.StartsAt, &season.EndsAt, &season.ArchivedAt, &season.Phase)
+		if err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, season)
+	}
+
+	return seasons, rows.Err()
+}
+
+func seasonTable(id int64) string {
+	return "game_stats_season_" + strconv.FormatInt(id, 10)
+}
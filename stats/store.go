@@ -0,0 +1,67 @@
+package stats
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrHeroNotFound - there is no hero with that id
+	ErrHeroNotFound = errors.New("hero not found")
+	// ErrNotOwner - the hero belongs to another account
+	ErrNotOwner = errors.New("hero belongs to another account")
+	// ErrNotOnServer - a game server sent stats of a hero that doesn't play on its game
+	ErrNotOnServer = errors.New("hero doesn't play on this server")
+	// ErrHeroBusy - another shard kept the hero locked for too long
+	ErrHeroBusy = errors.New("hero is busy")
+	// ErrResetting - stats are being reset, changes have to wait
+	ErrResetting = errors.New("stats are being reset")
+	// ErrHistoryBusy - another shard kept flushing the history for too long
+	ErrHistoryBusy = errors.New("stats history is busy")
+)
+
+// StatsStore - every read and write of game_stats goes through this
+type StatsStore interface {
+	// Get returns the stored values of keys for heroID, keys that were never written are left out.
+	// userID limits the lookup to heroes of that account, "" accepts any owner.
+	Get(userID string, heroID string, keys []string) (map[string]string, error)
+	// Apply writes all updates or, if any key gets rejected, none of them
+	Apply(updates []*HeroUpdate) ([]Rejection, error)
+
+	History(heroID string, limit int) ([]*HistoryEntry, error)
+	Rollback(heroID string, to time.Time, source string) ([]string, error)
+	// Reset removes keys from every hero so they read as their defaults again, recorded as changes by source
+	Reset(keys []string, source string) error
+
+	// Invalidate drops cached stats of heroID after they were changed outside of the store
+	Invalidate(heroID string) error
+	// Verify compares cached stats of heroID with the database and returns the keys that differ
+	Verify(heroID string) ([]Mismatch, error)
+	// Flush writes pending changes to the database
+	Flush() error
+}
+
+// Mismatch - a stat whose cached value differs from the database
+type Mismatch struct {
+	Key      string `json:"key"`
+	Cached   string `json:"cached"`
+	Database string `json:"database"`
+}
+
+// placeholders returns n comma separated ? for an IN list
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// pick returns the values of keys that exist in values
+func pick(values map[string]string, keys []string) map[string]string {
+	picked := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			picked[key] = value
+		}
+	}
+
+	return picked
+}
@@ -0,0 +1,171 @@
+package theater
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"../GameSpy"
+	"../bus"
+	"../log"
+	"../matchmaking"
+)
+
+// Bus - reaches the game servers connected to other shards, set from main
+var Bus bus.Bus
+
+// Message types theater puts on the bus
+const (
+	// busGamePacket - write Payload as Query to the server hosting Target
+	busGamePacket = "theater.game"
+	// busJoinAnswer - the EGRS of a game server, for the shard that sent its EGRQ
+	busJoinAnswer = "theater.egrs"
+)
+
+// How long a game server has to answer an EGRQ
+const joinRequestTimeout = time.Minute
+
+// ErrGameNotFound - no shard registered the game
+var ErrGameNotFound = errors.New("game not found")
+
+// pendingJoin - a client waiting for the game server to answer its EGRQ, egeg is what it gets if allowed
+type pendingJoin struct {
+	client *GameSpy.Client
+	egeg   map[string]string
+}
+
+// pendingJoins - the clients connected to this shard waiting for an EGRS, by GID and PID
+var pendingJoins = struct {
+	sync.Mutex
+	joins map[string]*pendingJoin
+}{joins: make(map[string]*pendingJoin)}
+
+// registerBusHandlers - both managers register the same handlers, they only use state shared by the process
+func (tM *TheaterManager) registerBusHandlers() {
+	Bus.Handle(busGamePacket, tM.busGamePacket)
+	Bus.Handle(busJoinAnswer, tM.busJoinAnswer)
+	tM.registerQueueHandlers()
+}
+
+// sendToGame writes a packet to the server hosting gid, through the shard it is connected to
+func (tM *TheaterManager) sendToGame(gid string, query string, packet map[string]string) error {
+	if gameServer, ok := matchmaking.Games.Connection(gid); ok {
+		gameServer.WriteFESL(query, packet, 0x0)
+		tM.logAnswer(query, packet, 0x0)
+		return nil
+	}
+
+	game := matchmaking.Games.Get(gid)
+	if game == nil {
+		return ErrGameNotFound
+	}
+
+	return Bus.Send(game.Shard, &bus.Message{
+		Type:    busGamePacket,
+		Target:  gid,
+		Query:   query,
+		Payload: packet,
+	})
+}
+
+func (tM *TheaterManager) busGamePacket(message *bus.Message) {
+	gameServer, ok := matchmaking.Games.Connection(message.Target)
+	if !ok {
+		log.Noteln("Dropping " + message.Query + " from shard " + message.From + ", game " + message.Target + " isn't connected here")
+		return
+	}
+
+	gameServer.WriteFESL(message.Query, message.Payload, 0x0)
+	tM.logAnswer(message.Query, message.Payload, 0x0)
+}
+
+// joinRequested remembers which shard and client sent the EGRQ of pid, so the EGRS finds its way back
+func (tM *TheaterManager) joinRequested(client *GameSpy.Client, gid string, pid string, egeg map[string]string) {
+	pendingJoins.Lock()
+	pendingJoins.joins[joinRequestKey(gid, pid)] = &pendingJoin{client: client, egeg: egeg}
+	pendingJoins.Unlock()
+
+	err := tM.redis.Set(joinRequestKey(gid, pid), Shard, joinRequestTimeout).Err()
+	if err != nil {
+		log.Errorln("Failed storing join request of "+pid+" for game "+gid, err)
+	}
+
+	// A server that never answers doesn't keep the client waiting
+	time.AfterFunc(joinRequestTimeout, func() {
+		join := takePendingJoin(gid, pid)
+		if join == nil {
+			return
+		}
+
+		log.Noteln("Game " + gid + " didn't answer the join request of " + pid)
+		matchmaking.JoinFailed(tM.redis, gid, pid)
+		if join.client.IsActive {
+			tM.sendError(join.client, "EGEG", join.egeg, errCodeJoinFailed)
+		}
+	})
+}
+
+// joinAborted forgets the join request of pid, the EGRQ never reached the game server
+func (tM *TheaterManager) joinAborted(gid string, pid string) {
+	takePendingJoin(gid, pid)
+	tM.redis.Del(joinRequestKey(gid, pid))
+}
+
+// joinAnswered sends the EGRS of a game server to the shard its EGRQ came from
+func (tM *TheaterManager) joinAnswered(answer map[string]string) {
+	key := joinRequestKey(answer["GID"], answer["PID"])
+
+	origin, err := tM.redis.Get(key).Result()
+	if err != nil {
+		log.Noteln("No join request of " + answer["PID"] + " for game " + answer["GID"] + ", it may have timed out")
+		return
+	}
+	tM.redis.Del(key)
+
+	err = Bus.Send(origin, &bus.Message{
+		Type:    busJoinAnswer,
+		Target:  answer["GID"],
+		Query:   "EGRS",
+		Payload: answer,
+	})
+	if err != nil {
+		log.Errorln("Failed sending EGRS of game "+answer["GID"]+" to shard "+origin, err)
+	}
+}
+
+// busJoinAnswer - the game server answered the EGRQ of a client connected here, it gets the EGEG or an error
+func (tM *TheaterManager) busJoinAnswer(message *bus.Message) {
+	gid, pid := message.Target, message.Payload["PID"]
+
+	join := takePendingJoin(gid, pid)
+	if join == nil || !join.client.IsActive {
+		log.Noteln("Client of " + pid + " left before game " + gid + " answered its join request")
+		return
+	}
+
+	if message.Payload["ALLOWED"] != "1" {
+		log.Noteln("Game " + gid + " refused " + pid + ", reason " + message.Payload["REASON"])
+		tM.sendError(join.client, "EGEG", join.egeg, errCodeJoinFailed)
+		return
+	}
+
+	log.Noteln("Game " + gid + " allowed " + pid + " to join")
+	join.client.WriteFESL("EGEG", join.egeg, 0x0)
+	tM.logAnswer("EGEG", join.egeg, 0x0)
+}
+
+func takePendingJoin(gid string, pid string) *pendingJoin {
+	pendingJoins.Lock()
+	defer pendingJoins.Unlock()
+
+	join, ok := pendingJoins.joins[joinRequestKey(gid, pid)]
+	if !ok {
+		return nil
+	}
+	delete(pendingJoins.joins, joinRequestKey(gid, pid))
+	return join
+}
+
+func joinRequestKey(gid string, pid string) string {
+	return "egrq:" + gid + ":" + pid
+}
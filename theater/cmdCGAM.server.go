@@ -3,8 +3,10 @@ package theater
 import (
 	"net"
 	"strconv"
+	"strings"
 
 	"../GameSpy"
+	"../auth"
 	"../lib"
 	"../log"
 	"../matchmaking"
@@ -17,6 +19,13 @@ func (tM *TheaterManager) CGAM(event GameSpy.EventClientFESLCommand) {
 		return
 	}
 
+	// Only accounts with a server role may host games
+	if event.Client.RedisState == nil || !tM.permissions.Has(event.Client.RedisState.Get("userID"), auth.PermissionServer) {
+		log.Noteln("Refusing CGAM, account is not allowed to host games")
+		event.Client.Close()
+		return
+	}
+
 	addr, ok := event.Client.IpAddr.(*net.TCPAddr)
 
 	if !ok {
@@ -27,20 +36,15 @@ func (tM *TheaterManager) CGAM(event GameSpy.EventClientFESLCommand) {
 	gameIDInt, _ := tM.redis.Incr(COUNTER_GID_KEY).Result()
 	gameID := strconv.Itoa(int(gameIDInt))
 
-	// Store our server for easy access later
-	matchmaking.Games[gameID] = event.Client
-
 	var args []interface{}
-
-	// Setup a new key for our game
-	gameServer := new(lib.RedisObject)
-	gameServer.New(tM.redis, "gdata", gameID)
+	fields := make(map[string]interface{})
 
 	keys := 0
 
 	// Stores what we know about this game in the redis db
 	for index, value := range event.Command.Message {
-		if index == "TID" {
+		// GDAT hands gdata to anyone, the password only goes to the registry
+		if index == "TID" || index == matchmaking.PasswordKey {
 			continue
 		}
 
@@ -53,35 +57,88 @@ func (tM *TheaterManager) CGAM(event GameSpy.EventClientFESLCommand) {
 		if len(value) > 0 && value[len(value)-1] == '"' {
 			value = value[:len(value)-1]
 		}
-		gameServer.Set(index, value)
+		fields[index] = value
 
 		args = append(args, gameID)
 		args = append(args, index)
 		args = append(args, value)
 	}
 
-	gameServer.Set("LID", "1")
-	gameServer.Set("GID", gameID)
-	gameServer.Set("IP", addr.IP.String())
-	gameServer.Set("AP", "0")
-	gameServer.Set("QUEUE-LENGTH", "0")
+	// Games land in the lobby the server asked for if there is one
+	lobbyID := event.Command.Message["LID"]
+	lobby, err := tM.lobbies.Get(lobbyID)
+	if err != nil {
+		lobbyID = DefaultLobbyID
+		lobby, err = tM.lobbies.Get(lobbyID)
+	}
+	if err != nil {
+		log.Errorln("Failed getting lobby "+lobbyID, err)
+		tM.sendError(event.Client, "CGAM", event.Command.Message, errCodeLobbyFull)
+		return
+	}
+	if lobby.NumGames >= lobby.MaxGames {
+		log.Noteln("Refusing CGAM, lobby " + lobbyID + " has " + strconv.Itoa(lobby.MaxGames) + " games already")
+		tM.sendError(event.Client, "CGAM", event.Command.Message, errCodeLobbyFull)
+		return
+	}
+
+	fields["LID"] = lobbyID
+	fields["GID"] = gameID
+	fields["IP"] = addr.IP.String()
+	fields["AP"] = "0"
+	fields["QUEUE-LENGTH"] = "0"
+
+	// The ping site the server is at, as configured for it or as it announced
+	region := matchmaking.RegionOf(event.Client.RedisState.Get("serverID"), strings.Trim(event.Command.Message[matchmaking.RegionKey], "\""))
+	fields[matchmaking.RegionKey] = region
+
+	// Setup a new key for our game, in one go so GDAT never sees half of it
+	gameServer := new(lib.RedisObject)
+	gameServer.New(tM.redis, "gdata", gameID)
+	err = gameServer.SetM(fields)
+	if err != nil {
+		log.Errorln("Failed storing gdata of game "+gameID, err.Error())
+	}
 
 	event.Client.RedisState.Set("gdata:GID", gameID)
+	matchmaking.HostingGame(tM.redis, event.Client.RedisState.Get("serverID"), gameID)
+
+	// Make the game known to the matchmakers of all shards
+	maxPlayers, _ := strconv.Atoi(event.Command.Message["MAX-PLAYERS"])
+	reservedSlots, _ := strconv.Atoi(event.Command.Message[matchmaking.ReservedSlotsKey])
+	err = matchmaking.Games.Register(gameID, event.Client, &matchmaking.Game{
+		LobbyID:       lobbyID,
+		ServerID:      event.Client.RedisState.Get("serverID"),
+		Map:           event.Command.Message["B-U-map"],
+		Mode:          event.Command.Message[matchmaking.GameModeKey],
+		MaxPlayers:    maxPlayers,
+		Region:        region,
+		ReservedSlots: reservedSlots,
+	}, strings.Trim(event.Command.Message[matchmaking.PasswordKey], "\""))
+	if err != nil {
+		log.Errorln("Failed registering game "+gameID, err.Error())
+	}
 
-	var err error
 	_, err = tM.setServerStatsStatement(keys).Exec(args...)
 	if err != nil {
 		log.Errorln("Failed setting stats for game server "+gameID, err.Error())
 	}
 
+	// Per-game keys, joining clients get them together with their ticket in EGEG
+	gameKeys, err := tM.tickets.CreateGame(gameID)
+	if err != nil {
+		log.Errorln("Failed creating keys for game server "+gameID, err.Error())
+		return
+	}
+
 	answer := make(map[string]string)
 	answer["TID"] = event.Command.Message["TID"]
-	answer["LID"] = "1"
+	answer["LID"] = lobbyID
 	answer["UGID"] = event.Command.Message["UGID"]
 	answer["MAX-PLAYERS"] = event.Command.Message["MAX-PLAYERS"] // Validate this
-	answer["EKEY"] = "O65zZ2D2A58mNrZw1hmuJw%3d%3d"              // Eventually generate this
-	answer["UGID"] = event.Command.Message["UGID"]               // Verify these against some auth shit
-	answer["SECRET"] = "2587913"                                 // Eventually generate this too
+	answer["EKEY"] = gameKeys.EKey
+	answer["UGID"] = event.Command.Message["UGID"] // Verify these against some auth shit
+	answer["SECRET"] = gameKeys.Secret
 	answer["JOIN"] = event.Command.Message["JOIN"]
 	answer["J"] = event.Command.Message["JOIN"]
 	answer["GID"] = gameID
@@ -12,7 +12,10 @@ func (tM *TheaterManager) ECNL(event GameSpy.EventClientFESLCommand) {
 		return
 	}
 
-	//wantsToLeaveQueue = true
+	// Leaving while queued for a full game gives up the place in the queue
+	if event.Client.RedisState != nil && tM.leaveQueue(event.Command.Message["GID"], event.Client.RedisState.Get("id")) {
+		log.Noteln(event.Client.RedisState.Get("id") + " left the queue of game " + event.Command.Message["GID"])
+	}
 
 	answer := make(map[string]string)
 	answer["TID"] = event.Command.Message["TID"]
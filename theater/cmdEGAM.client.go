@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"../GameSpy"
+	"../auth"
 	"../lib"
 	"../log"
 	"../matchmaking"
@@ -16,10 +17,44 @@ func (tM *TheaterManager) EGAM(event GameSpy.EventClientFESLCommand) {
 		log.Noteln("Client left")
 		return
 	}
-	externalIP := event.Client.IpAddr.(*net.TCPAddr).IP.String()
+	if event.Client.RedisState == nil || !tM.permissions.Has(event.Client.RedisState.Get("userID"), auth.PermissionMatchmake) {
+		log.Noteln("Refusing EGAM, account is not allowed to matchmake")
+		tM.sendError(event.Client, "EGAM", event.Command.Message, errCodeNotAllowed)
+		return
+	}
+
 	lobbyID := event.Command.Message["LID"]
 	gameID := event.Command.Message["GID"]
-	pid := event.Client.RedisState.Get("id")
+
+	ban, err := tM.bans.CheckAll(event.Client.RedisState.Get("userID"), event.Client.RedisState.Get("heroID"), "", clientIP(event.Client))
+	if err != nil {
+		log.Errorln("Failed checking bans", err)
+	}
+	if ban != nil {
+		log.Noteln("Refusing EGAM of banned " + event.Client.RedisState.Get("name") + ", ban " + ban.Type + " " + ban.Target)
+		event.Client.Close()
+		return
+	}
+
+	// The game may be hosted by another shard, joinGame gets the EGRQ there
+	game := matchmaking.Games.Get(gameID)
+	if game == nil {
+		log.Noteln("Game " + gameID + " isn't registered")
+		tM.sendError(event.Client, "EGAM", event.Command.Message, errCodeGameNotFound)
+		return
+	}
+
+	if !matchmaking.Games.CheckPassword(gameID, event.Command.Message["PASSWORD"]) {
+		log.Noteln("Refusing EGAM of " + event.Client.RedisState.Get("name") + ", wrong password for private game " + gameID)
+		tM.sendError(event.Client, "EGAM", event.Command.Message, errCodeWrongPassword)
+		return
+	}
+
+	// joinGame checks again, this refuses banned heroes before they queue
+	if tM.serverBanned(event.Client, gameID) {
+		tM.sendError(event.Client, "EGAM", event.Command.Message, errCodeServerBanned)
+		return
+	}
 
 	clientAnswer := make(map[string]string)
 	clientAnswer["TID"] = event.Command.Message["TID"]
@@ -28,97 +63,278 @@ func (tM *TheaterManager) EGAM(event GameSpy.EventClientFESLCommand) {
 	event.Client.WriteFESL("EGAM", clientAnswer, 0x0)
 	tM.logAnswer("EGAM", clientAnswer, 0x0)
 
+	// Party leaders and tournament tooling reserve slots, those heroes skip the queue
+	pid := event.Client.RedisState.Get("id")
+	if matchmaking.ReservedGame(tM.redis, pid) == gameID {
+		tM.joinGame(event.Client, event.Command.Message)
+		return
+	}
+
+	// Admins and whitelisted heroes may use the reserved slots
+	privileged := tM.permissions.Has(event.Client.RedisState.Get("userID"), auth.PermissionReservedSlot) ||
+		matchmaking.Whitelisted(tM.redis, gameID, pid)
+
+	full, err := matchmaking.Full(tM.redis, gameID, privileged)
+	if err != nil {
+		log.Errorln("Failed checking whether game "+gameID+" is full", err)
+	}
+	if full {
+		// Heroes queued for team balance may still leave room for this one
+		tM.enqueue(event.Client, event.Command.Message)
+		tM.admitQueued(gameID)
+		return
+	}
+
+	team := tM.heroTeam(pid)
+	fits, err := matchmaking.CanJoinTeam(tM.redis, gameID, team)
+	if err != nil {
+		log.Errorln("Failed checking team balance of game "+gameID, err)
+		fits = true
+	}
+	if !fits {
+		tM.balanceRefused(event.Client, event.Command.Message, team)
+		return
+	}
+
+	tM.joinGame(event.Client, event.Command.Message)
+}
+
+// maxRedirectGames - how many other games are considered for heroes whose faction can't join
+const maxRedirectGames = 5
+
+// balanceRefused - the faction of the client is full on the game it asked for, it waits or goes elsewhere
+// depending on the balance policy of the game mode
+func (tM *TheaterManager) balanceRefused(client *GameSpy.Client, message map[string]string, team string) {
+	gameID := message["GID"]
+	pid := client.RedisState.Get("id")
+
+	// The game may have been removed since the EGAM was checked
+	policy := matchmaking.DefaultBalancePolicy
+	if game := matchmaking.Games.Get(gameID); game != nil {
+		policy = matchmaking.PolicyFor(game.Mode)
+	}
+
+	if policy.WhenFull == matchmaking.BalanceRedirect {
+		player := matchmaking.Player{HeroID: pid, Team: team}
+		for _, candidate := range matchmaking.FindGames(tM.redis, []matchmaking.Player{player}, maxRedirectGames) {
+			if candidate.GID == gameID || !tM.mayRedirect(client, candidate.GID, team) {
+				continue
+			}
+
+			log.Noteln("Team " + team + " is full on game " + gameID + ", redirecting " + pid + " to game " + candidate.GID)
+
+			redirected := make(map[string]string)
+			for key, value := range message {
+				redirected[key] = value
+			}
+			redirected["GID"] = candidate.GID
+			tM.joinGame(client, redirected)
+			return
+		}
+	}
+
+	log.Noteln("Team " + team + " is full on game " + gameID + ", queueing " + pid)
+	tM.enqueue(client, message)
+}
+
+// mayRedirect - the client passes the checks of an EGAM for gameID without asking for it,
+// private games are left out as the client has no password for them
+func (tM *TheaterManager) mayRedirect(client *GameSpy.Client, gameID string, team string) bool {
+	game := matchmaking.Games.Get(gameID)
+	if game == nil || game.Private {
+		return false
+	}
+
+	if tM.serverBanned(client, gameID) {
+		return false
+	}
+
+	full, err := matchmaking.Full(tM.redis, gameID, false)
+	if err != nil || full {
+		return false
+	}
+
+	fits, err := matchmaking.CanJoinTeam(tM.redis, gameID, team)
+	return err == nil && fits
+}
+
+// serverBanned - the hero of client is banned from the server hosting gameID
+func (tM *TheaterManager) serverBanned(client *GameSpy.Client, gameID string) bool {
+	game := matchmaking.Games.Get(gameID)
+	if game == nil {
+		return false
+	}
+
+	serverBan, err := tM.serverBans.Check(game.ServerID, client.RedisState.Get("id"))
+	if err != nil {
+		log.Errorln("Failed checking bans of server "+game.ServerID, err)
+		return false
+	}
+	if serverBan != nil {
+		log.Noteln("Refusing " + client.RedisState.Get("name") + " on game " + gameID + ", banned from server " + game.ServerID)
+		return true
+	}
+
+	return false
+}
+
+// heroTeam - the faction (c_team) of a hero, "" if unknown
+func (tM *TheaterManager) heroTeam(pid string) string {
+	stats, err := tM.stats.Get("", pid, []string{"c_team"})
+	if err != nil {
+		log.Errorln("Failed gettings stats for hero "+pid, err.Error())
+		return ""
+	}
+
+	return stats["c_team"]
+}
+
+// joinGame - asks the game server to let the client in (EGRQ), the client learns where to connect to (EGEG)
+// once the server allowed it. message is the EGAM of the client.
+func (tM *TheaterManager) joinGame(client *GameSpy.Client, message map[string]string) {
+	externalIP := client.IpAddr.(*net.TCPAddr).IP.String()
+	lobbyID := message["LID"]
+	gameID := message["GID"]
+	pid := client.RedisState.Get("id")
+
+	// Reservations and the queue skip the checks of EGAM, a ban issued meanwhile still counts
+	if tM.serverBanned(client, gameID) {
+		tM.sendError(client, "EGAM", message, errCodeServerBanned)
+		return
+	}
+
+	if matchmaking.Games.Get(gameID) == nil {
+		log.Noteln("Game " + gameID + " was removed before " + pid + " could join")
+		tM.sendError(client, "EGEG", message, errCodeGameNotFound)
+		return
+	}
+
+	// The slot is taken until PENT, or until the server refuses the hero in EGRS. Checking for room
+	// and taking it is one step, whoever lost the last slot to another shard waits in the queue.
+	privileged := tM.permissions.Has(client.RedisState.Get("userID"), auth.PermissionReservedSlot) ||
+		matchmaking.Whitelisted(tM.redis, gameID, pid)
+	joining, err := matchmaking.Joining(tM.redis, gameID, pid, privileged)
+	if err != nil {
+		log.Errorln("Failed holding a slot on game "+gameID+" for "+pid, err)
+		tM.sendError(client, "EGEG", message, errCodeJoinFailed)
+		return
+	}
+	if !joining {
+		tM.enqueue(client, message)
+		return
+	}
+
 	// Get 4 stats for PID
-	rows, err := tM.getStatsStatement(4).Query(pid, "c_kit", "c_team", "elo", "level")
+	stats, err := tM.stats.Get("", pid, []string{"c_kit", "c_team", "elo", "level"})
 	if err != nil {
 		log.Errorln("Failed gettings stats for hero "+pid, err.Error())
+		stats = make(map[string]string)
 	}
 
-	stats := make(map[string]string)
+	// Name and account come from the session USER was validated with
+	stats["heroName"] = client.RedisState.Get("name")
+	stats["userID"] = client.RedisState.Get("userID")
 
-	for rows.Next() {
-		var userID, heroID, heroName, statsKey, statsValue string
-		err := rows.Scan(&userID, &heroID, &heroName, &statsKey, &statsValue)
-		if err != nil {
-			log.Errorln("Issue with database:", err.Error())
-		}
+	gsData := new(lib.RedisObject)
+	gsData.New(tM.redis, "gdata", gameID)
+
+	gameKeys, err := tM.tickets.Game(gameID)
+	if err != nil {
+		log.Errorln("No keys for game "+gameID, err.Error())
+		matchmaking.JoinFailed(tM.redis, gameID, pid)
+		tM.sendError(client, "EGEG", message, errCodeGameNotFound)
+		return
+	}
+
+	// The ticket binds this join to PID and GID, PENT only lets the player in with it
+	ticket, err := tM.tickets.Issue(gameID, pid)
+	if err != nil {
+		log.Errorln("Failed issuing ticket for "+pid+" joining "+gameID, err.Error())
+		matchmaking.JoinFailed(tM.redis, gameID, pid)
+		tM.sendError(client, "EGEG", message, errCodeJoinFailed)
+		return
+	}
+
+	serverEGRQ := make(map[string]string)
+	serverEGRQ["TID"] = "0"
+
+	serverEGRQ["NAME"] = stats["heroName"]
+	serverEGRQ["UID"] = stats["userID"]
+	//serverEGRQ["PID"] = message["R-U-accid"]
+	serverEGRQ["PID"] = pid
+	serverEGRQ["TICKET"] = ticket
+
+	//serverEGRQ["IP"] = message["R-U-externalIp"]
+	serverEGRQ["IP"] = externalIP
+	serverEGRQ["PORT"] = strconv.Itoa(client.IpAddr.(*net.TCPAddr).Port)
+	//serverEGRQ["PORT"] = message["PORT"]
+
+	serverEGRQ["INT-IP"] = message["R-INT-IP"]
+	serverEGRQ["INT-PORT"] = message["R-INT-PORT"]
+
+	serverEGRQ["PTYPE"] = "P"
+	// maybe do CID here?
+	serverEGRQ["R-USER"] = stats["heroName"]
+	serverEGRQ["R-UID"] = stats["userID"]
+	serverEGRQ["R-U-accid"] = stats["userID"]
+	serverEGRQ["R-U-elo"] = stats["elo"]
+	serverEGRQ["R-U-team"] = stats["c_team"]
+	serverEGRQ["R-U-kit"] = stats["c_kit"]
+	serverEGRQ["R-U-lvl"] = stats["level"]
+	serverEGRQ["R-U-dataCenter"] = tM.dataCenter(client, gameID)
+	// Lets the server keep the members of a party together
+	serverEGRQ["R-U-party"] = matchmaking.PartyOf(tM.redis, pid)
+	//serverEGRQ["R-U-externalIp"] = message["R-U-externalIp"]
+	serverEGRQ["R-U-externalIp"] = externalIP
+	serverEGRQ["R-U-internalIp"] = message["R-INT-IP"]
+	serverEGRQ["R-U-category"] = message["R-U-category"]
+	serverEGRQ["R-INT-IP"] = message["R-INT-IP"]
+	serverEGRQ["R-INT-PORT"] = message["R-INT-PORT"]
+
+	serverEGRQ["XUID"] = "24"
+	serverEGRQ["R-XUID"] = "24"
+
+	serverEGRQ["LID"] = lobbyID
+	serverEGRQ["GID"] = gameID
+
+	clientEGEG := make(map[string]string)
+	clientEGEG["TID"] = message["TID"]
+	clientEGEG["PL"] = "pc"
+	clientEGEG["TICKET"] = ticket
+
+	// That is the ServerID, was/is a test
+	clientEGEG["PID"] = pid
+	clientEGEG["I"] = gsData.Get("IP")
+	clientEGEG["P"] = gsData.Get("PORT")
+	clientEGEG["HUID"] = "1" // find via GID soon
+	clientEGEG["EKEY"] = gameKeys.EKey
+	clientEGEG["INT-IP"] = gsData.Get("INT-IP")
+	clientEGEG["INT-PORT"] = gsData.Get("INT-PORT")
+	clientEGEG["SECRET"] = gameKeys.Secret
+	clientEGEG["UGID"] = gsData.Get("UGID")
+	clientEGEG["LID"] = lobbyID
+	clientEGEG["GID"] = gameID
+
+	tM.joinRequested(client, gameID, pid, clientEGEG)
+	if err := tM.sendToGame(gameID, "EGRQ", serverEGRQ); err != nil {
+		log.Errorln("Failed sending EGRQ of "+pid+" to game "+gameID, err)
+		tM.joinAborted(gameID, pid)
+		matchmaking.JoinFailed(tM.redis, gameID, pid)
+		tM.sendError(client, "EGEG", message, errCodeGameNotFound)
+		return
+	}
+}
+
+// dataCenter - the ping site closest to client as it measured with FESL, the region of gid if it didn't
+func (tM *TheaterManager) dataCenter(client *GameSpy.Client, gid string) string {
+	session, err := tM.sessions.Get(client.RedisState.Get("lkey"))
+	if err == nil && session.PingSite != "" {
+		return session.PingSite
+	}
 
-		stats["heroName"] = heroName
-		stats["userID"] = userID
-		stats[statsKey] = statsValue
-	}
-
-	// todo: get game data and check if full
-
-	if gameServer, ok := matchmaking.Games[gameID]; ok {
-		gsData := new(lib.RedisObject)
-		gsData.New(tM.redis, "gdata", gameID)
-
-		//gameServer := matchmaking.Games[gameID]
-
-		serverEGRQ := make(map[string]string)
-		serverEGRQ["TID"] = "0"
-
-		serverEGRQ["NAME"] = stats["heroName"]
-		serverEGRQ["UID"] = stats["userID"]
-		//serverEGRQ["PID"] = event.Command.Message["R-U-accid"]
-		serverEGRQ["PID"] = pid
-		serverEGRQ["TICKET"] = "2018751182"
-
-		//serverEGRQ["IP"] = event.Command.Message["R-U-externalIp"]
-		serverEGRQ["IP"] = externalIP
-		serverEGRQ["PORT"] = strconv.Itoa(event.Client.IpAddr.(*net.TCPAddr).Port)
-		//serverEGRQ["PORT"] = event.Command.Message["PORT"]
-
-		serverEGRQ["INT-IP"] = event.Command.Message["R-INT-IP"]
-		serverEGRQ["INT-PORT"] = event.Command.Message["R-INT-PORT"]
-
-		serverEGRQ["PTYPE"] = "P"
-		// maybe do CID here?
-		serverEGRQ["R-USER"] = stats["heroName"]
-		serverEGRQ["R-UID"] = stats["userID"]
-		serverEGRQ["R-U-accid"] = stats["userID"]
-		serverEGRQ["R-U-elo"] = stats["elo"]
-		serverEGRQ["R-U-team"] = stats["c_team"]
-		serverEGRQ["R-U-kit"] = stats["c_kit"]
-		serverEGRQ["R-U-lvl"] = stats["level"]
-		serverEGRQ["R-U-dataCenter"] = "iad"
-		//serverEGRQ["R-U-externalIp"] = event.Command.Message["R-U-externalIp"]
-		serverEGRQ["R-U-externalIp"] = externalIP
-		serverEGRQ["R-U-internalIp"] = event.Command.Message["R-INT-IP"]
-		serverEGRQ["R-U-category"] = event.Command.Message["R-U-category"]
-		serverEGRQ["R-INT-IP"] = event.Command.Message["R-INT-IP"]
-		serverEGRQ["R-INT-PORT"] = event.Command.Message["R-INT-PORT"]
-
-		serverEGRQ["XUID"] = "24"
-		serverEGRQ["R-XUID"] = "24"
-
-		serverEGRQ["LID"] = lobbyID
-		serverEGRQ["GID"] = gameID
-
-		gameServer.WriteFESL("EGRQ", serverEGRQ, 0x0)
-		tM.logAnswer("EGRQ", serverEGRQ, 0x0)
-
-		clientEGEG := make(map[string]string)
-		clientEGEG["TID"] = event.Command.Message["TID"]
-		clientEGEG["PL"] = "pc"
-		clientEGEG["TICKET"] = "2018751182"
-
-		// That is the ServerID, was/is a test
-		clientEGEG["PID"] = pid
-		clientEGEG["I"] = gsData.Get("IP")
-		clientEGEG["P"] = gsData.Get("PORT")
-		clientEGEG["HUID"] = "1" // find via GID soon
-		clientEGEG["EKEY"] = "O65zZ2D2A58mNrZw1hmuJw%3d%3d"
-		clientEGEG["INT-IP"] = gsData.Get("INT-IP")
-		clientEGEG["INT-PORT"] = gsData.Get("INT-PORT")
-		clientEGEG["SECRET"] = "2587913"
-		clientEGEG["UGID"] = gsData.Get("UGID")
-		clientEGEG["LID"] = lobbyID
-		clientEGEG["GID"] = gameID
-
-		event.Client.WriteFESL("EGEG", clientEGEG, 0x0)
-		tM.logAnswer("EGEG", clientEGEG, 0x0)
+	if game := matchmaking.Games.Get(gid); game != nil {
+		return game.Region
 	}
 
+	return ""
 }
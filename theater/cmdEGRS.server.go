@@ -3,6 +3,7 @@ package theater
 import (
 	"../GameSpy"
 	"../log"
+	"../matchmaking"
 )
 
 // EGRS - SERVER sent up, tell us if client is 'allowed' to join
@@ -11,11 +12,24 @@ func (tM *TheaterManager) EGRS(event GameSpy.EventClientFESLCommand) {
 		return
 	}
 
-	if event.Command.Message["ALLOWED"] == "1" {
-		_, err := tM.stmtGameIncreaseJoining.Exec(event.Command.Message["GID"], Shard)
-		if err != nil {
-			log.Panicln(err)
+	gid := event.Command.Message["GID"]
+	pid := event.Command.Message["PID"]
+
+	if !hostsGame(event.Client, gid) {
+		log.Noteln("Refusing EGRS for " + pid + ", game " + gid + " isn't hosted by this server")
+		return
+	}
+
+	// Only joins we asked the server about are answered, anything else would decide for someone else's join
+	if tM.redis.Exists(joinRequestKey(gid, pid)).Val() == 1 {
+		if event.Command.Message["ALLOWED"] != "1" {
+			matchmaking.JoinFailed(tM.redis, gid, pid)
 		}
+		tM.syncGame(gid)
+
+		tM.joinAnswered(event.Command.Message)
+	} else {
+		log.Noteln("Ignoring EGRS of game " + gid + " for " + pid + ", there is no join request")
 	}
 
 	answer := make(map[string]string)
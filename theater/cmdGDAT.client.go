@@ -6,7 +6,7 @@ import (
 	"../log"
 )
 
-// GDAT - CLIENT called to get data about the server
+// GDAT - CLIENT called to get data about the server, followed by a PDAT for each of its players
 func (tM *TheaterManager) GDAT(event GameSpy.EventClientFESLCommand) {
 	if !event.Client.IsActive {
 		log.Noteln("Client left")
@@ -37,4 +37,5 @@ func (tM *TheaterManager) GDAT(event GameSpy.EventClientFESLCommand) {
 	event.Client.WriteFESL("GDAT", answer, 0x0)
 	tM.logAnswer("GDAT", answer, 0x0)
 
+	tM.sendRoster(event.Client, event.Command.Message["TID"], gameID, "")
 }
@@ -1,15 +1,119 @@
 package theater
 
 import (
+	"strconv"
+
 	"../GameSpy"
+	"../lib"
 	"../log"
+	"../matchmaking"
 )
 
-// GLST - CLIENT called to get a list of game servers? Irrelevant for heroes.
+// maxGLST - the most games one GLST lists
+const maxGLST = 500
+
+// GLST - CLIENT called by the server browser to list the games of a lobby, answered with one GDAT per game.
+// FILTER-NOT-FULL, FILTER-NOT-PRIVATE and FILTER-MIN-SIZE narrow the list, OFFSET and COUNT page through it.
 func (tM *TheaterManager) GLST(event GameSpy.EventClientFESLCommand) {
 	if !event.Client.IsActive {
 		log.Noteln("Client left")
 		return
 	}
-	log.Noteln("GLST was called")
+
+	lobbyID := event.Command.Message["LID"]
+	lobby, err := tM.lobbies.Get(lobbyID)
+	known := err == nil
+	if !known {
+		// The browser waits for the GLST, an unknown lobby simply has no games
+		log.Noteln("GLST for lobby "+lobbyID+":", err)
+		lobby = &matchmaking.Lobby{ID: lobbyID}
+	}
+
+	notFull := event.Command.Message["FILTER-NOT-FULL"] == "1"
+	notPrivate := event.Command.Message["FILTER-NOT-PRIVATE"] == "1"
+	minSize, _ := strconv.Atoi(event.Command.Message["FILTER-MIN-SIZE"])
+
+	offset, _ := strconv.Atoi(event.Command.Message["OFFSET"])
+	count, err := strconv.Atoi(event.Command.Message["COUNT"])
+	if err != nil || count < 0 || count > maxGLST {
+		count = maxGLST
+	}
+
+	var games []*matchmaking.Game
+	if known {
+		games = tM.lobbies.Games(lobbyID)
+	}
+
+	var entries []map[string]string
+	for _, game := range games {
+		if notPrivate && game.Private {
+			continue
+		}
+
+		entry := tM.gameListEntry(game)
+		activePlayers, _ := strconv.Atoi(entry["AP"])
+		if activePlayers < minSize {
+			continue
+		}
+		if notFull && game.MaxPlayers > 0 && activePlayers >= game.MaxPlayers {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if offset < 0 || offset > len(entries) {
+		offset = len(entries)
+	}
+	entries = entries[offset:]
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+
+	answer := make(map[string]string)
+	answer["TID"] = event.Command.Message["TID"]
+	answer["LID"] = lobbyID
+	answer["LOBBY-NUM-GAMES"] = strconv.Itoa(lobby.NumGames)
+	answer["LOBBY-MAX-GAMES"] = strconv.Itoa(lobby.MaxGames)
+	answer["FAVORITE-GAMES"] = "0"
+	answer["FAVORITE-PLAYERS"] = "0"
+	answer["NUM-GAMES"] = strconv.Itoa(len(entries))
+	event.Client.WriteFESL(event.Command.Query, answer, 0x0)
+	tM.logAnswer(event.Command.Query, answer, 0x0)
+
+	for _, entry := range entries {
+		entry["TID"] = event.Command.Message["TID"]
+		event.Client.WriteFESL("GDAT", entry, 0x0)
+		tM.logAnswer("GDAT", entry, 0x0)
+	}
+}
+
+// gameListEntry - the GDAT of a game in the server browser: its gdata and the short keys of the game list
+func (tM *TheaterManager) gameListEntry(game *matchmaking.Game) map[string]string {
+	gdata := new(lib.RedisObject)
+	gdata.New(tM.redis, "gdata", game.GID)
+
+	entry := gdata.GetAll()
+	entry["LID"] = game.LobbyID
+	entry["GID"] = game.GID
+	entry["N"] = entry["NAME"]
+	entry["I"] = entry["IP"]
+	entry["P"] = entry["PORT"]
+	entry["J"] = entry["JOIN"]
+	entry["MP"] = strconv.Itoa(game.MaxPlayers)
+	entry["QP"] = entry["QUEUE-LENGTH"]
+	entry["PL"] = "PC"
+
+	entry["PW"] = "0"
+	if game.Private {
+		entry["PW"] = "1"
+	}
+
+	players, err := matchmaking.PlayerCount(tM.redis, game.GID)
+	if err != nil {
+		log.Errorln("Failed counting players of game "+game.GID, err)
+	}
+	entry["AP"] = strconv.Itoa(players)
+
+	return entry
 }
@@ -1,33 +1,45 @@
 package theater
 
 import (
+	"strconv"
+
 	"../GameSpy"
 	"../log"
 )
 
-// LLST - CLIENT (???) unknown, potentially bookmarks
+// DefaultLobbyID - the lobby games are created in when their server doesn't ask for a known one
+const DefaultLobbyID = "1"
+
+// LLST - CLIENT called to list the lobbies, answered with one LDAT per lobby
 func (tM *TheaterManager) LLST(event GameSpy.EventClientFESLCommand) {
 	if !event.Client.IsActive {
 		log.Noteln("Client left")
 		return
 	}
 
+	lobbies, err := tM.lobbies.List()
+	if err != nil {
+		log.Errorln("Failed listing lobbies", err)
+	}
+
 	answer := make(map[string]string)
 	answer["TID"] = event.Command.Message["TID"]
-	answer["NUM-LOBBIES"] = "1"
+	answer["NUM-LOBBIES"] = strconv.Itoa(len(lobbies))
 	event.Client.WriteFESL(event.Command.Query, answer, 0x0)
+	tM.logAnswer(event.Command.Query, answer, 0x0)
 
-	// Todo: create dataset for lobbies, iterate through and send one for each lobby (LDAT>)()
-	ldatPacket := make(map[string]string)
-	ldatPacket["TID"] = "5"
-	ldatPacket["FAVORITE-GAMES"] = "0"
-	ldatPacket["FAVORITE-PLAYERS"] = "0"
-	ldatPacket["LID"] = "1"
-	ldatPacket["LOCALE"] = "en_US"
-	ldatPacket["MAX-GAMES"] = "10000"
-	ldatPacket["NAME"] = "bfwestPC02"
-	ldatPacket["NUM-GAMES"] = "1"
-	ldatPacket["PASSING"] = "0"
-	event.Client.WriteFESL("LDAT", ldatPacket, 0x0)
-	tM.logAnswer("LDAT", ldatPacket, 0x0)
+	for _, lobby := range lobbies {
+		ldatPacket := make(map[string]string)
+		ldatPacket["TID"] = event.Command.Message["TID"]
+		ldatPacket["FAVORITE-GAMES"] = "0"
+		ldatPacket["FAVORITE-PLAYERS"] = "0"
+		ldatPacket["LID"] = lobby.ID
+		ldatPacket["LOCALE"] = lobby.Locale
+		ldatPacket["MAX-GAMES"] = strconv.Itoa(lobby.MaxGames)
+		ldatPacket["NAME"] = lobby.Name
+		ldatPacket["NUM-GAMES"] = strconv.Itoa(lobby.NumGames)
+		ldatPacket["PASSING"] = "0"
+		event.Client.WriteFESL("LDAT", ldatPacket, 0x0)
+		tM.logAnswer("LDAT", ldatPacket, 0x0)
+	}
 }
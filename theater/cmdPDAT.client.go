@@ -0,0 +1,56 @@
+package theater
+
+import (
+	"strconv"
+
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+// PDAT - CLIENT called by the server browser to get the players of a game, answered with one PDAT per player.
+// PID narrows the answer to one player.
+func (tM *TheaterManager) PDAT(event GameSpy.EventClientFESLCommand) {
+	if !event.Client.IsActive {
+		log.Noteln("Client left")
+		return
+	}
+
+	tM.sendRoster(event.Client, event.Command.Message["TID"], event.Command.Message["GID"], event.Command.Message["PID"])
+}
+
+// sendRoster - writes a PDAT for every player on gid to client, only for pid unless it is empty
+func (tM *TheaterManager) sendRoster(client *GameSpy.Client, tid string, gid string, pid string) {
+	game := matchmaking.Games.Get(gid)
+	if game == nil {
+		log.Noteln("Roster of unknown game " + gid + " requested")
+		return
+	}
+
+	players, err := matchmaking.FullRoster(tM.redis, gid)
+	if err != nil {
+		log.Errorln("Failed getting roster of game "+gid, err)
+		return
+	}
+
+	for _, player := range players {
+		if pid != "" && player.HeroID != pid {
+			continue
+		}
+
+		answer := make(map[string]string)
+		for key, value := range player.Keys {
+			answer[key] = value
+		}
+		answer["TID"] = tid
+		answer["LID"] = game.LobbyID
+		answer["GID"] = gid
+		answer["PID"] = player.HeroID
+		answer["NAME"] = player.Name
+		answer["TEAM"] = player.Team
+		answer["JOINED"] = strconv.FormatInt(player.JoinedAt, 10)
+
+		client.WriteFESL("PDAT", answer, 0x0)
+		tM.logAnswer("PDAT", answer, 0x0)
+	}
+}
@@ -1,8 +1,12 @@
 package theater
 
 import (
+	"strconv"
+	"time"
+
 	"../GameSpy"
 	"../log"
+	"../matchmaking"
 )
 
 // PENT - SERVER sent up when a player joins (entitle player?)
@@ -12,39 +16,58 @@ func (tM *TheaterManager) PENT(event GameSpy.EventClientFESLCommand) {
 	}
 
 	pid := event.Command.Message["PID"]
+	gid := event.Command.Message["GID"]
+
+	if !hostsGame(event.Client, gid) {
+		log.Noteln("Refusing PENT of " + pid + ", game " + gid + " isn't hosted by this server")
+		tM.sendError(event.Client, "PENT", event.Command.Message, errCodeNotAllowed)
+		return
+	}
+
+	// Only players we matched into this game through EGAM may enter
+	err := tM.tickets.Validate(gid, pid, event.Command.Message["TICKET"])
+	if err != nil {
+		log.Noteln("Refusing "+pid+" on game "+gid+", no valid ticket:", err)
+
+		kick := make(map[string]string)
+		kick["PID"] = pid
+		kick["LID"] = event.Command.Message["LID"]
+		kick["GID"] = gid
+		event.Client.WriteFESL("KICK", kick, 0x0)
+		tM.logAnswer("KICK", kick, 0x0)
+		return
+	}
 
 	// Get 4 stats for PID
-	rows, err := tM.getStatsStatement(4).Query(pid, "c_kit", "c_team", "elo", "level")
+	stats, err := tM.stats.Get("", pid, []string{"c_kit", "c_team", "elo", "level"})
 	if err != nil {
 		log.Errorln("Failed gettings stats for hero "+pid, err.Error())
 	}
 
-	stats := make(map[string]string)
+	player := matchmaking.Player{HeroID: pid, Team: stats["c_team"], JoinedAt: time.Now().Unix()}
+	player.Elo, _ = strconv.ParseFloat(stats["elo"], 64)
 
-	for rows.Next() {
-		var userID, heroID, heroName, statsKey, statsValue string
-		err := rows.Scan(&userID, &heroID, &heroName, &statsKey, &statsValue)
-		if err != nil {
-			log.Errorln("Issue with database:", err.Error())
-		}
-		stats[statsKey] = statsValue
+	var id, userID, online string
+	err = tM.stmtGetHeroeByID.QueryRow(pid).Scan(&id, &userID, &player.Name, &online)
+	if err != nil {
+		log.Errorln("Failed getting name of hero "+pid, err.Error())
 	}
 
-	switch stats["c_team"] {
-	case "1":
-		_, err = tM.stmtGameIncreaseTeam1.Exec(event.Command.Message["GID"], Shard)
-		if err != nil {
-			log.Panicln(err)
-		}
-	case "2":
-		_, err = tM.stmtGameIncreaseTeam2.Exec(event.Command.Message["GID"], Shard)
-		if err != nil {
-			log.Panicln(err)
-		}
-	default:
-		log.Errorln("Invalid team " + stats["c_team"] + " for " + pid)
+	err = matchmaking.JoinedGame(tM.redis, gid, player)
+	if err != nil {
+		log.Errorln("Failed adding hero "+pid+" to the roster of game "+gid, err)
 	}
 
+	team, _ := strconv.Atoi(player.Team)
+	_, err = tM.stmtAddGamePlayer.Exec(gid, Shard, pid, player.Name, team, player.JoinedAt)
+	if err != nil {
+		log.Errorln("Failed storing hero "+pid+" on game "+gid, err.Error())
+	}
+	tM.syncGame(gid)
+
+	// The other faction may join now that this one grew
+	tM.admitQueued(gid)
+
 	// This allows all right now, I think.
 	answer := make(map[string]string)
 	answer["TID"] = event.Command.Message["TID"]
@@ -0,0 +1,31 @@
+package theater
+
+import (
+	"../GameSpy"
+	"../log"
+	"../matchmaking"
+)
+
+// PING - CLIENT/SERVER answer to our PING, game servers that keep answering keep their game
+func (tM *TheaterManager) PING(event GameSpy.EventClientFESLCommand) {
+	if !event.Client.IsActive || event.Client.RedisState == nil {
+		return
+	}
+
+	gameID := event.Client.RedisState.Get("gdata:GID")
+	if gameID == "" {
+		return
+	}
+
+	if err := matchmaking.Games.Heartbeat(gameID); err != nil {
+		log.Errorln("Failed storing heartbeat of game "+gameID, err)
+	}
+	if err := tM.tickets.KeepGame(gameID); err != nil {
+		log.Errorln("Failed keeping the keys of game "+gameID, err)
+	}
+
+	_, err := tM.stmtUpdateGame.Exec(gameID, Shard)
+	if err != nil {
+		log.Errorln("Failed updating game "+gameID, err)
+	}
+}
@@ -3,47 +3,40 @@ package theater
 import (
 	"../GameSpy"
 	"../log"
+	"../matchmaking"
 )
 
-// PENT - SERVER sent up when a player joins (entitle player?)
+// PLVT - SERVER sent up when a player leaves
 func (tM *TheaterManager) PLVT(event GameSpy.EventClientFESLCommand) {
 	if !event.Client.IsActive {
 		return
 	}
 
 	pid := event.Command.Message["PID"]
+	gid := event.Command.Message["GID"]
 
-	// Get 4 stats for PID
-	rows, err := tM.getStatsStatement(4).Query(pid, "c_kit", "c_team", "elo", "level")
-	if err != nil {
-		log.Errorln("Failed gettings stats for hero "+pid, err.Error())
+	if !hostsGame(event.Client, gid) {
+		log.Noteln("Refusing PLVT of " + pid + ", game " + gid + " isn't hosted by this server")
+		tM.sendError(event.Client, "PLVT", event.Command.Message, errCodeNotAllowed)
+		return
 	}
 
-	stats := make(map[string]string)
-
-	for rows.Next() {
-		var userID, heroID, heroName, statsKey, statsValue string
-		err := rows.Scan(&userID, &heroID, &heroName, &statsKey, &statsValue)
-		if err != nil {
-			log.Errorln("Issue with database:", err.Error())
-		}
-		stats[statsKey] = statsValue
+	if err := matchmaking.LeftGame(tM.redis, gid, pid); err != nil {
+		log.Errorln("Failed removing hero "+pid+" from the roster of game "+gid, err)
 	}
 
-	switch stats["c_team"] {
-	case "1":
-		_, err = tM.stmtGameDecreaseTeam1.Exec(event.Command.Message["GID"], Shard)
-		if err != nil {
-			log.Panicln(err)
-		}
-	case "2":
-		_, err = tM.stmtGameDecreaseTeam2.Exec(event.Command.Message["GID"], Shard)
-		if err != nil {
-			log.Panicln(err)
-		}
-	default:
-		log.Errorln("Invalid team " + stats["c_team"] + " for " + pid)
+	_, err := tM.stmtDeleteGamePlayer.Exec(gid, Shard, pid)
+	if err != nil {
+		log.Errorln("Failed removing hero "+pid+" from game "+gid, err.Error())
 	}
+	_, err = tM.stmtDeleteServerPlayerStats.Exec(gid, pid)
+	if err != nil {
+		log.Errorln("Failed deleting stats of hero "+pid+" on game "+gid, err.Error())
+	}
+	tM.syncGame(gid)
+
+	// The slot goes to whoever waits longest and keeps the teams even
+	tM.admitQueued(gid)
 
 	answer := make(map[string]string)
 	answer["PID"] = event.Command.Message["PID"]
@@ -2,7 +2,6 @@ package theater
 
 import (
 	"../GameSpy"
-	"../lib"
 	"../log"
 )
 
@@ -18,12 +17,4 @@ func (tM *TheaterManager) UBRA(event GameSpy.EventClientFESLCommand) {
 	answer["TID"] = event.Command.Message["TID"]
 	event.Client.WriteFESL(event.Command.Query, answer, 0x0)
 	tM.logAnswer(event.Command.Query, answer, 0x0)
-
-	gdata := new(lib.RedisObject)
-	gdata.New(tM.redis, "gdata", event.Command.Message["GID"])
-
-	if event.Command.Message["START"] == "1" {
-		gdata.Set("AP", "0")
-	}
-
 }
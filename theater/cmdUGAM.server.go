@@ -5,6 +5,7 @@ import (
 
 	"../lib"
 	"../log"
+	"../matchmaking"
 )
 
 // UGAM - SERVER Called to udpate serverquery ifo
@@ -16,12 +17,20 @@ func (tM *TheaterManager) UGAM(event GameSpy.EventClientFESLCommand) {
 
 	gameID := event.Command.Message["GID"]
 
+	// The registry change reaches every shard, only the server hosting the game may make it
+	if !hostsGame(event.Client, gameID) {
+		log.Noteln("Refusing UGAM, game " + gameID + " isn't hosted by this server")
+		return
+	}
+
 	gdata := new(lib.RedisObject)
 	gdata.New(tM.redis, "gdata", gameID)
 
 	log.Noteln("Updating GameServer " + gameID)
 
 	var args []interface{}
+	updated := make(map[string]string)
+	fields := make(map[string]interface{})
 
 	keys := 0
 	for index, value := range event.Command.Message {
@@ -29,8 +38,6 @@ func (tM *TheaterManager) UGAM(event GameSpy.EventClientFESLCommand) {
 			continue
 		}
 
-		keys++
-
 		// Strip quotes
 		if len(value) > 0 && value[0] == '"' {
 			value = value[1:]
@@ -39,12 +46,41 @@ func (tM *TheaterManager) UGAM(event GameSpy.EventClientFESLCommand) {
 			value = value[:len(value)-1]
 		}
 
-		gdata.Set(index, value)
+		updated[index] = value
+
+		// GDAT hands gdata to anyone, the password only goes to the registry
+		if index == matchmaking.PasswordKey {
+			continue
+		}
+
+		keys++
+		fields[index] = value
 		args = append(args, gameID)
 		args = append(args, index)
 		args = append(args, value)
 	}
-	_, err := tM.stmtUpdateGame.Exec(event.Command.Message["GID"], Shard)
+	// The configured region of the server beats the announced one, in gdata and the registry alike
+	if announced, ok := updated[matchmaking.RegionKey]; ok {
+		serverID := ""
+		if game := matchmaking.Games.Get(gameID); game != nil {
+			serverID = game.ServerID
+		}
+		updated[matchmaking.RegionKey] = matchmaking.RegionOf(serverID, announced)
+		fields[matchmaking.RegionKey] = updated[matchmaking.RegionKey]
+	}
+
+	// All at once, GDAT never sees half an update. A game reaped in the meantime stays gone.
+	err := gdata.Update(fields)
+	if err != nil {
+		log.Errorln("Failed updating gdata of game "+gameID, err.Error())
+	}
+
+	err = matchmaking.Games.Update(gameID, updated)
+	if err != nil {
+		log.Errorln("Failed updating registered game "+gameID, err.Error())
+	}
+
+	_, err = tM.stmtUpdateGame.Exec(event.Command.Message["GID"], Shard)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -1,11 +1,9 @@
 package theater
 
 import (
-	"strconv"
-
 	"../GameSpy"
-	"../lib"
 	"../log"
+	"../matchmaking"
 )
 
 // UPLA - SERVER presumably "update player"? valid response reqiured
@@ -14,13 +12,20 @@ func (tM *TheaterManager) UPLA(event GameSpy.EventClientFESLCommand) {
 		return
 	}
 
+	pid := event.Command.Message["PID"]
+	gid := event.Command.Message["GID"]
+
+	// The roster keys show up in PDAT, the server browser and the admin API
+	if !hostsGame(event.Client, gid) {
+		log.Noteln("Refusing UPLA of " + pid + ", game " + gid + " isn't hosted by this server")
+		return
+	}
+
 	var args []interface{}
+	playerKeys := make(map[string]string)
 
 	keys := 0
 
-	pid := event.Command.Message["PID"]
-	gid := event.Command.Message["GID"]
-
 	for index, value := range event.Command.Message {
 		if index == "TID" || index == "PID" || index == "GID" {
 			continue
@@ -36,6 +41,8 @@ func (tM *TheaterManager) UPLA(event GameSpy.EventClientFESLCommand) {
 			value = value[:len(value)-1]
 		}
 
+		playerKeys[index] = value
+
 		args = append(args, gid)
 		args = append(args, pid)
 		args = append(args, index)
@@ -48,14 +55,11 @@ func (tM *TheaterManager) UPLA(event GameSpy.EventClientFESLCommand) {
 		log.Errorln("Failed to update stats for player "+pid, err.Error())
 	}
 
-	gdata := new(lib.RedisObject)
-	gdata.New(tM.redis, "gdata", event.Command.Message["GID"])
-
-	num, _ := strconv.Atoi(gdata.Get("AP"))
-
-	num++
-
-	gdata.Set("AP", strconv.Itoa(num))
+	// The roster shows them to the server browser and admins
+	err = matchmaking.UpdatePlayer(tM.redis, gid, pid, playerKeys)
+	if err != nil {
+		log.Errorln("Failed to update roster keys for player "+pid, err.Error())
+	}
 
 	// Don't answer
 	/*answer := make(map[string]string)
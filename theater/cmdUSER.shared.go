@@ -3,7 +3,6 @@ package theater
 import (
 	"../GameSpy"
 	"../core"
-	"../lib"
 	"../log"
 )
 
@@ -14,20 +13,37 @@ func (tM *TheaterManager) USER(event GameSpy.EventClientFESLCommand) {
 		return
 	}
 
-	lkeyRedis := new(lib.RedisObject)
-	lkeyRedis.New(tM.redis, "lkeys", event.Command.Message["LKEY"])
+	session, err := tM.sessions.Get(event.Command.Message["LKEY"])
+	if err != nil {
+		log.Noteln("Refusing USER with unknown or expired lkey", err)
+		event.Client.Close()
+		return
+	}
+
+	ban, err := tM.bans.CheckAll(session.UserID, session.HeroID, session.ServerID, clientIP(event.Client))
+	if err != nil {
+		log.Errorln("Failed checking bans", err)
+	}
+	if ban != nil {
+		log.Noteln("Refusing USER of banned " + session.Name + ", ban " + ban.Type + " " + ban.Target)
+		event.Client.Close()
+		return
+	}
 
 	redisState := new(core.RedisState)
-	redisState.New(tM.redis, "mm:"+event.Command.Message["LKEY"])
+	redisState.New(tM.redis, "mm:"+session.LKey)
 	event.Client.RedisState = redisState
 
-	redisState.Set("id", lkeyRedis.Get("id"))
-	redisState.Set("userID", lkeyRedis.Get("userID"))
-	redisState.Set("name", lkeyRedis.Get("name"))
+	redisState.Set("id", session.ID)
+	redisState.Set("userID", session.UserID)
+	redisState.Set("name", session.Name)
+	redisState.Set("heroID", session.HeroID)
+	redisState.Set("serverID", session.ServerID)
+	redisState.Set("lkey", session.LKey)
 
 	answer := make(map[string]string)
 	answer["TID"] = event.Command.Message["TID"]
-	answer["NAME"] = lkeyRedis.Get("name")
+	answer["NAME"] = session.Name
 	answer["CID"] = ""
 	event.Client.WriteFESL(event.Command.Query, answer, 0x0)
 	tM.logAnswer(event.Command.Query, answer, 0x0)
@@ -0,0 +1,111 @@
+package theater
+
+import (
+	"encoding/json"
+	"errors"
+
+	"../bus"
+	"../log"
+	"../matchmaking"
+
+	"github.com/go-redis/redis"
+)
+
+// AnnouncementsChannel - redis pub/sub channel carrying announcements to the clients of every shard
+const AnnouncementsChannel = "theater:announcements"
+
+// Kinds of announcements, sent as TYPE of the CHAT packet
+const (
+	AnnounceChat   = "chat"
+	AnnounceSystem = "system"
+)
+
+// ErrNotInGame - the hero doesn't play on the game
+var ErrNotInGame = errors.New("hero not in game")
+
+// Announcement - a message from the admins, for the players of one game or for every client if GID is empty
+type Announcement struct {
+	GID  string `json:"gid,omitempty"`
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Kick has the server hosting gid drop heroID, its PLVT then takes the hero off the roster
+func Kick(redis *redis.Client, gid string, heroID string) error {
+	game := matchmaking.Games.Get(gid)
+	if game == nil {
+		return ErrGameNotFound
+	}
+	if matchmaking.GameOfHero(redis, heroID) != gid {
+		return ErrNotInGame
+	}
+
+	log.Noteln("Kicking hero " + heroID + " from game " + gid)
+
+	return Bus.Send(game.Shard, &bus.Message{
+		Type:   busGamePacket,
+		Target: gid,
+		Query:  "KICK",
+		Payload: map[string]string{
+			"PID": heroID,
+			"LID": game.LobbyID,
+			"GID": gid,
+		},
+	})
+}
+
+// Announce sends announcement to the server hosting its game, or to every client of every shard
+func Announce(client *redis.Client, announcement *Announcement) error {
+	if announcement.GID == "" {
+		payload, err := json.Marshal(announcement)
+		if err != nil {
+			return err
+		}
+
+		return client.Publish(AnnouncementsChannel, string(payload)).Err()
+	}
+
+	game := matchmaking.Games.Get(announcement.GID)
+	if game == nil {
+		return ErrGameNotFound
+	}
+
+	return Bus.Send(game.Shard, &bus.Message{
+		Type:    busGamePacket,
+		Target:  announcement.GID,
+		Query:   "CHAT",
+		Payload: announcement.packet(),
+	})
+}
+
+func (announcement *Announcement) packet() map[string]string {
+	packet := make(map[string]string)
+	packet["TID"] = "0"
+	packet["TYPE"] = announcement.Type
+	packet["TEXT"] = announcement.Text
+	if announcement.GID != "" {
+		packet["GID"] = announcement.GID
+	}
+
+	return packet
+}
+
+// announceToClients - writes every announcement for all clients to the clients connected to this manager
+func (tM *TheaterManager) announceToClients() {
+	pubsub := tM.redis.Subscribe(AnnouncementsChannel)
+	for msg := range pubsub.Channel() {
+		announcement := new(Announcement)
+		if err := json.Unmarshal([]byte(msg.Payload), announcement); err != nil {
+			log.Errorln("Invalid announcement", msg.Payload, err)
+			continue
+		}
+
+		packet := announcement.packet()
+		for _, client := range tM.socket.GetClients() {
+			if client.IsActive {
+				client.WriteFESL("CHAT", packet, 0x0)
+			}
+		}
+		tM.logAnswer("CHAT", packet, 0x0)
+	}
+}
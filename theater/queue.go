@@ -0,0 +1,302 @@
+package theater
+
+import (
+	"strconv"
+	"sync"
+
+	"../GameSpy"
+	"../bus"
+	"../lib"
+	"../log"
+	"../matchmaking"
+)
+
+// Message types of the join queue
+const (
+	// busQueueAdmit - a slot freed up for Payload["PID"] waiting on this shard for game Target
+	busQueueAdmit = "theater.queue.admit"
+	// busQueuePosition - Payload["PID"] moved to Payload["QPOS"] in the queue of Target
+	busQueuePosition = "theater.queue.position"
+)
+
+// queuedJoin - the EGAM of a client waiting for a full game
+type queuedJoin struct {
+	pid     string
+	client  *GameSpy.Client
+	message map[string]string
+}
+
+// queuedJoins - the queued clients connected to this shard, by GID and PID. The order lives in redis,
+// the connection and EGAM only exist where the client is connected.
+var queuedJoins = struct {
+	sync.Mutex
+	joins map[string]*queuedJoin
+}{joins: make(map[string]*queuedJoin)}
+
+func (tM *TheaterManager) registerQueueHandlers() {
+	Bus.Handle(busQueueAdmit, tM.busQueueAdmit)
+	Bus.Handle(busQueuePosition, tM.busQueuePosition)
+}
+
+// enqueue - the game of the client's EGAM is full, let it wait for a slot (QENT)
+func (tM *TheaterManager) enqueue(client *GameSpy.Client, message map[string]string) {
+	gameID := message["GID"]
+	pid := client.RedisState.Get("id")
+
+	position, err := matchmaking.Enqueue(tM.redis, gameID, pid, Shard)
+	if err != nil {
+		log.Errorln("Failed queueing "+pid+" for game "+gameID, err)
+		return
+	}
+
+	queuedJoins.Lock()
+	queuedJoins.joins[queuedJoinKey(gameID, pid)] = &queuedJoin{pid: pid, client: client, message: message}
+	queuedJoins.Unlock()
+
+	log.Noteln("Game " + gameID + " is full, queued " + pid + " at position " + strconv.Itoa(position))
+
+	serverQENT := make(map[string]string)
+	serverQENT["TID"] = "0"
+	serverQENT["LID"] = message["LID"]
+	serverQENT["GID"] = gameID
+	serverQENT["PID"] = pid
+	serverQENT["NAME"] = client.RedisState.Get("name")
+	serverQENT["UID"] = client.RedisState.Get("userID")
+	serverQENT["QPOS"] = strconv.Itoa(position)
+	if err := tM.sendToGame(gameID, "QENT", serverQENT); err != nil {
+		log.Errorln("Failed sending QENT of "+pid+" to game "+gameID, err)
+	}
+
+	tM.queueChanged(gameID)
+}
+
+// leaveQueue - takes pid out of the queue of gameID (QLVT), false if it wasn't queued
+func (tM *TheaterManager) leaveQueue(gameID string, pid string) bool {
+	queuedJoins.Lock()
+	delete(queuedJoins.joins, queuedJoinKey(gameID, pid))
+	queuedJoins.Unlock()
+
+	removed, err := matchmaking.Dequeue(tM.redis, gameID, pid)
+	if err != nil {
+		log.Errorln("Failed removing "+pid+" from the queue of game "+gameID, err)
+		return false
+	}
+	if !removed {
+		return false
+	}
+
+	tM.sendQLVT(gameID, pid)
+	tM.queueChanged(gameID)
+	return true
+}
+
+// leaveQueues - client disconnected, it stops waiting for every game
+func (tM *TheaterManager) leaveQueues(client *GameSpy.Client) {
+	var left []*queuedJoin
+
+	queuedJoins.Lock()
+	for key, join := range queuedJoins.joins {
+		if join.client == client {
+			left = append(left, join)
+			delete(queuedJoins.joins, key)
+		}
+	}
+	queuedJoins.Unlock()
+
+	for _, join := range left {
+		tM.leaveQueue(join.message["GID"], join.pid)
+	}
+}
+
+// admitQueued - a slot freed up on gameID, the hero waiting longest whose faction may join gets it
+func (tM *TheaterManager) admitQueued(gameID string) {
+	free, err := matchmaking.FreeSlots(tM.redis, gameID, false)
+	if err != nil {
+		log.Errorln("Failed counting free slots of game "+gameID, err)
+		return
+	}
+	if free <= 0 {
+		return
+	}
+
+	queue, err := tM.pruneQueue(gameID)
+	if err != nil {
+		log.Errorln("Failed getting the queue of game "+gameID, err)
+		return
+	}
+
+	for _, queued := range queue {
+		fits, err := matchmaking.CanJoinTeam(tM.redis, gameID, tM.heroTeam(queued.HeroID))
+		if err != nil {
+			log.Errorln("Failed checking team balance of game "+gameID, err)
+			return
+		}
+		if !fits {
+			continue
+		}
+
+		// Another shard may have admitted the same hero in the meantime
+		removed, err := matchmaking.Dequeue(tM.redis, gameID, queued.HeroID)
+		if err != nil {
+			log.Errorln("Failed removing "+queued.HeroID+" from the queue of game "+gameID, err)
+			return
+		}
+		if removed {
+			tM.admit(gameID, queued)
+			return
+		}
+	}
+}
+
+// admit - hands the slot to the shard the queued hero waits on
+func (tM *TheaterManager) admit(gameID string, queued matchmaking.QueuedPlayer) {
+	log.Noteln("Admitting " + queued.HeroID + " from the queue of game " + gameID)
+
+	err := Bus.Send(queued.Shard, &bus.Message{
+		Type:    busQueueAdmit,
+		Target:  gameID,
+		Payload: map[string]string{"PID": queued.HeroID},
+	})
+	if err != nil {
+		// The shard of the client is gone, and the client with it
+		log.Errorln("Failed admitting "+queued.HeroID+" on shard "+queued.Shard, err)
+		tM.sendQLVT(gameID, queued.HeroID)
+		tM.admitQueued(gameID)
+		return
+	}
+
+	tM.queueChanged(gameID)
+}
+
+func (tM *TheaterManager) busQueueAdmit(message *bus.Message) {
+	gameID, pid := message.Target, message.Payload["PID"]
+
+	queuedJoins.Lock()
+	join, ok := queuedJoins.joins[queuedJoinKey(gameID, pid)]
+	delete(queuedJoins.joins, queuedJoinKey(gameID, pid))
+	queuedJoins.Unlock()
+
+	if !ok || !join.client.IsActive {
+		log.Noteln("Queued " + pid + " left before getting into game " + gameID + ", admitting the next one")
+		tM.sendQLVT(gameID, pid)
+		tM.admitQueued(gameID)
+		return
+	}
+
+	tM.sendQLVT(gameID, pid)
+	tM.joinGame(join.client, join.message)
+}
+
+// pruneQueue - drops the heroes waiting on shards that died from the queue of gameID and returns the rest,
+// their clients went down with the shard and would otherwise hold the queue forever
+func (tM *TheaterManager) pruneQueue(gameID string) ([]matchmaking.QueuedPlayer, error) {
+	queue, err := matchmaking.Queue(tM.redis, gameID)
+	if err != nil {
+		return nil, err
+	}
+
+	var alive []matchmaking.QueuedPlayer
+	defer func() {
+		if len(alive) != len(queue) {
+			tM.queueChanged(gameID)
+		}
+	}()
+
+	for _, queued := range queue {
+		if queued.Shard == Shard || matchmaking.Games.ShardAlive(queued.Shard) {
+			queued.Position = len(alive) + 1
+			alive = append(alive, queued)
+			continue
+		}
+
+		log.Noteln("Dropping " + queued.HeroID + " from the queue of game " + gameID + ", shard " + queued.Shard + " is dead")
+		if removed, err := matchmaking.Dequeue(tM.redis, gameID, queued.HeroID); err != nil {
+			return nil, err
+		} else if removed {
+			tM.sendQLVT(gameID, queued.HeroID)
+		}
+	}
+
+	return alive, nil
+}
+
+// queueChanged - tells the game server the queue length (QLEN) and every queued client its position
+func (tM *TheaterManager) queueChanged(gameID string) {
+	// Writing gdata of a reaped game would bring it back
+	game := matchmaking.Games.Get(gameID)
+	if game == nil {
+		return
+	}
+
+	queue, err := matchmaking.Queue(tM.redis, gameID)
+	if err != nil {
+		log.Errorln("Failed getting the queue of game "+gameID, err)
+		return
+	}
+
+	gdata := new(lib.RedisObject)
+	gdata.New(tM.redis, "gdata", gameID)
+	err = gdata.Update(map[string]interface{}{"QUEUE-LENGTH": strconv.Itoa(len(queue))})
+	if err != nil {
+		log.Errorln("Failed storing the queue length of game "+gameID, err)
+	}
+
+	serverQLEN := make(map[string]string)
+	serverQLEN["TID"] = "0"
+	serverQLEN["LID"] = game.LobbyID
+	serverQLEN["GID"] = gameID
+	serverQLEN["QLEN"] = strconv.Itoa(len(queue))
+	if err := tM.sendToGame(gameID, "QLEN", serverQLEN); err != nil {
+		log.Errorln("Failed sending QLEN to game "+gameID, err)
+	}
+
+	for _, queued := range queue {
+		err := Bus.Send(queued.Shard, &bus.Message{
+			Type:    busQueuePosition,
+			Target:  gameID,
+			Payload: map[string]string{"PID": queued.HeroID, "QPOS": strconv.Itoa(queued.Position)},
+		})
+		if err != nil {
+			log.Errorln("Failed sending queue position to "+queued.HeroID+" on shard "+queued.Shard, err)
+		}
+	}
+}
+
+func (tM *TheaterManager) busQueuePosition(message *bus.Message) {
+	queuedJoins.Lock()
+	join, ok := queuedJoins.joins[queuedJoinKey(message.Target, message.Payload["PID"])]
+	queuedJoins.Unlock()
+
+	if !ok || !join.client.IsActive {
+		return
+	}
+
+	clientQPOS := make(map[string]string)
+	clientQPOS["TID"] = "0"
+	clientQPOS["LID"] = join.message["LID"]
+	clientQPOS["GID"] = message.Target
+	clientQPOS["QPOS"] = message.Payload["QPOS"]
+	join.client.WriteFESL("QPOS", clientQPOS, 0x0)
+	tM.logAnswer("QPOS", clientQPOS, 0x0)
+}
+
+// sendQLVT - tells the game server pid stopped waiting
+func (tM *TheaterManager) sendQLVT(gameID string, pid string) {
+	game := matchmaking.Games.Get(gameID)
+	if game == nil {
+		return
+	}
+
+	serverQLVT := make(map[string]string)
+	serverQLVT["TID"] = "0"
+	serverQLVT["LID"] = game.LobbyID
+	serverQLVT["GID"] = gameID
+	serverQLVT["PID"] = pid
+	if err := tM.sendToGame(gameID, "QLVT", serverQLVT); err != nil {
+		log.Errorln("Failed sending QLVT of "+pid+" to game "+gameID, err)
+	}
+}
+
+func queuedJoinKey(gid string, pid string) string {
+	return gid + ":" + pid
+}
@@ -0,0 +1,157 @@
+package theater
+
+import (
+	"sync"
+	"time"
+
+	"../lib"
+	"../log"
+	"../matchmaking"
+)
+
+// ReapInterval - how often games whose server stopped reporting are looked for
+var ReapInterval = time.Second * 30
+
+// Only one shard reaps at a time
+const reaperLockKey = "games:reaping"
+
+// Both managers of a process share the registry, one reaper is enough
+var reaperOnce sync.Once
+
+// startReaper - cleans up after dead shards once, then reaps stale games every ReapInterval
+func (tM *TheaterManager) startReaper() {
+	reaperOnce.Do(func() {
+		tM.reconcile()
+
+		go func() {
+			for range time.NewTicker(ReapInterval).C {
+				tM.reapStaleGames()
+			}
+		}()
+	})
+}
+
+// reapStaleGames - removes the games of every shard whose server sent no PING or UGAM within matchmaking.GameTimeout
+func (tM *TheaterManager) reapStaleGames() {
+	locked, err := tM.redis.SetNX(reaperLockKey, Shard, ReapInterval-time.Second).Result()
+	if err != nil {
+		log.Errorln("Failed locking the game reaper", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	for _, game := range matchmaking.Games.Stale() {
+		log.Noteln("Reaping game " + game.GID + " of shard " + game.Shard + ", its server stopped reporting")
+
+		// The connection is as dead as the game, if it is still around
+		if client, ok := matchmaking.Games.Connection(game.GID); ok {
+			client.Close()
+		}
+
+		tM.removeGame(game.GID, game.Shard, game.ServerID)
+	}
+
+	// Heroes queued on dead shards block the queues of games still running
+	for _, game := range matchmaking.Games.List() {
+		queue, err := tM.pruneQueue(game.GID)
+		if err != nil {
+			log.Errorln("Failed pruning the queue of game "+game.GID, err)
+			continue
+		}
+		if len(queue) > 0 {
+			tM.admitQueued(game.GID)
+		}
+	}
+}
+
+// reconcile - removes what shards that died without cleaning up left in MySQL and redis
+func (tM *TheaterManager) reconcile() {
+	dead := make(map[string]bool)
+
+	rows, err := tM.stmtGetGamesOfShards.Query()
+	if err != nil {
+		log.Errorln("Failed getting games of all shards", err)
+		return
+	}
+
+	var leftovers [][2]string
+	for rows.Next() {
+		var gid, shard string
+		if err := rows.Scan(&gid, &shard); err != nil {
+			log.Errorln("Failed reading game of shard", err)
+			continue
+		}
+
+		if _, checked := dead[shard]; !checked {
+			dead[shard] = shard != Shard && !matchmaking.Games.ShardAlive(shard)
+		}
+		if dead[shard] {
+			leftovers = append(leftovers, [2]string{gid, shard})
+		}
+	}
+	rows.Close()
+
+	for _, leftover := range leftovers {
+		serverID := ""
+		if game := matchmaking.Games.Get(leftover[0]); game != nil {
+			serverID = game.ServerID
+		}
+
+		log.Noteln("Removing game " + leftover[0] + " of dead shard " + leftover[1])
+		tM.removeGame(leftover[0], leftover[1], serverID)
+	}
+
+	// Games only redis still knows about
+	for _, game := range append(matchmaking.Games.List(), matchmaking.Games.Stale()...) {
+		if game.Shard != Shard && !matchmaking.Games.ShardAlive(game.Shard) {
+			log.Noteln("Removing game " + game.GID + " of dead shard " + game.Shard)
+			tM.removeGame(game.GID, game.Shard, game.ServerID)
+		}
+	}
+
+	if _, err := tM.stmtDeleteOrphanedServerStats.Exec(); err != nil {
+		log.Errorln("Failed deleting server stats of removed games", err)
+	}
+	if _, err := tM.stmtDeleteOrphanedGamePlayers.Exec(); err != nil {
+		log.Errorln("Failed deleting players of removed games", err)
+	}
+}
+
+// removeGame - deletes everything known about a game of shard, the game server hosting it was serverID
+func (tM *TheaterManager) removeGame(gid string, shard string, serverID string) {
+	_, err := tM.stmtDeleteServerStatsByGID.Exec(gid)
+	if err != nil {
+		log.Errorln("Failed deleting settings for  "+gid, err.Error())
+	}
+
+	_, err = tM.stmtDeleteServerPlayerStatsByGID.Exec(gid)
+	if err != nil {
+		log.Errorln("Failed deleting player stats for "+gid, err.Error())
+	}
+
+	_, err = tM.stmtDeleteGamePlayers.Exec(gid, shard)
+	if err != nil {
+		log.Errorln("Failed deleting players of "+gid+" and shard "+shard, err.Error())
+	}
+
+	_, err = tM.stmtDeleteGameByGIDAndShard.Exec(gid, shard)
+	if err != nil {
+		log.Errorln("Failed deleting game for "+gid+" and shard "+shard, err.Error())
+	}
+
+	// Delete game out of the registry of all shards
+	matchmaking.Games.Remove(gid)
+
+	gameServer := new(lib.RedisObject)
+	gameServer.New(tM.redis, "gdata", gid)
+	gameServer.Delete()
+
+	tM.tickets.DeleteGame(gid)
+	// The server may host a new game already
+	if serverID != "" && matchmaking.GameOfServer(tM.redis, serverID) == gid {
+		matchmaking.HostingGame(tM.redis, serverID, "")
+	}
+	matchmaking.EndedGame(tM.redis, gid)
+}
@@ -0,0 +1,72 @@
+package theater
+
+import (
+	"sync"
+	"time"
+
+	"../lib"
+	"../log"
+	"../matchmaking"
+)
+
+// SyncInterval - how often the games of this shard are written from the roster to gdata and MySQL
+var SyncInterval = time.Second * 30
+
+// Both managers of a process share the games of the shard, one sync is enough
+var syncOnce sync.Once
+
+// startSync - keeps gdata and the games rows of this shard in line with the roster every SyncInterval
+func (tM *TheaterManager) startSync() {
+	syncOnce.Do(func() {
+		go func() {
+			for range time.NewTicker(SyncInterval).C {
+				tM.syncGames()
+			}
+		}()
+	})
+}
+
+// syncGames - fixes whatever counters of this shard's games drifted
+func (tM *TheaterManager) syncGames() {
+	for _, game := range matchmaking.Games.List() {
+		if game.Shard == Shard {
+			tM.syncGame(game.GID)
+		}
+	}
+}
+
+// syncGame - writes the players of gid as the roster knows them to gdata AP and to its games row.
+// AP only ever comes from the roster, PENT and PLVT sync right away.
+func (tM *TheaterManager) syncGame(gid string) {
+	game := matchmaking.Games.Get(gid)
+	if game == nil {
+		return
+	}
+
+	occupancy, err := matchmaking.OccupancyOf(tM.redis, gid)
+	if err != nil {
+		log.Errorln("Failed counting players of game "+gid, err)
+		return
+	}
+
+	gdata := new(lib.RedisObject)
+	gdata.New(tM.redis, "gdata", gid)
+	err = gdata.Update(map[string]interface{}{"AP": occupancy.Players})
+	if err != nil {
+		log.Errorln("Failed updating active players of game "+gid, err)
+	}
+
+	_, err = tM.stmtSyncGame.Exec(
+		occupancy.Players,
+		occupancy.Joining,
+		game.MaxPlayers,
+		occupancy.Teams["1"],
+		occupancy.Teams["2"],
+		game.Map,
+		gid,
+		Shard,
+	)
+	if err != nil {
+		log.Errorln("Failed syncing game "+gid, err.Error())
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"os"
 	"time"
 
 	"../GameSpy"
+	"../auth"
 	"../core"
 	"../lib"
 	"../log"
 	"../matchmaking"
+	"../moderation"
+	"../stats"
 	"github.com/go-redis/redis"
 )
 
@@ -39,7 +43,7 @@ type GameServer struct {
 	maxObservers       int
 	sguid              string
 	hash               string
-	password           string
+	password           string // PASSWORD of CGAM/UGAM, matchmaking.Games keeps it hashed
 	ugid               string
 	sType              string
 	join               string
@@ -70,19 +74,29 @@ type TheaterManager struct {
 	cacheCounters    *lib.RedisObject
 	iDB              *core.InfluxDB
 	localMode        bool
+	sessions         *auth.Sessions
+	tickets          *auth.Tickets
+	permissions      *auth.Permissions
+	bans             *moderation.Bans
+	serverBans       *moderation.ServerBans
+	lobbies          *matchmaking.Lobbies
+	stats            stats.StatsStore
 
 	// Database Statements
 	stmtGetHeroeByID                      *sql.Stmt
 	stmtDeleteServerStatsByGID            *sql.Stmt
 	stmtDeleteGameByGIDAndShard           *sql.Stmt
 	stmtAddGame                           *sql.Stmt
-	stmtGameIncreaseJoining               *sql.Stmt
-	stmtGameIncreaseTeam1                 *sql.Stmt
-	stmtGameIncreaseTeam2                 *sql.Stmt
-	stmtGameDecreaseTeam1                 *sql.Stmt
-	stmtGameDecreaseTeam2                 *sql.Stmt
 	stmtUpdateGame                        *sql.Stmt
-	mapGetStatsVariableAmount             map[int]*sql.Stmt
+	stmtSyncGame                          *sql.Stmt
+	stmtGetGamesOfShards                  *sql.Stmt
+	stmtDeleteOrphanedServerStats         *sql.Stmt
+	stmtAddGamePlayer                     *sql.Stmt
+	stmtDeleteGamePlayer                  *sql.Stmt
+	stmtDeleteGamePlayers                 *sql.Stmt
+	stmtDeleteServerPlayerStats           *sql.Stmt
+	stmtDeleteServerPlayerStatsByGID      *sql.Stmt
+	stmtDeleteOrphanedGamePlayers         *sql.Stmt
 	mapSetServerStatsVariableAmount       map[int]*sql.Stmt
 	mapSetServerPlayerStatsVariableAmount map[int]*sql.Stmt
 }
@@ -92,13 +106,14 @@ var Shard string
 const COUNTER_GID_KEY = "counters:GID"
 
 // New creates and starts a new TheaterManager
-func (tM *TheaterManager) New(name string, port string, db *sql.DB, redis *redis.Client, iDB *core.InfluxDB, localMode bool) {
+func (tM *TheaterManager) New(name string, port string, db *sql.DB, redis *redis.Client, statsStore stats.StatsStore, iDB *core.InfluxDB, localMode bool) {
 	var err error
 
 	tM.socket = new(GameSpy.Socket)
 	tM.socketUDP = new(GameSpy.SocketUDP)
 	tM.db = db
 	tM.redis = redis
+	tM.stats = statsStore
 	tM.name = name
 	tM.eventsChannel, err = tM.socket.New(tM.name, port, true)
 	tM.iDB = iDB
@@ -113,11 +128,42 @@ func (tM *TheaterManager) New(name string, port string, db *sql.DB, redis *redis
 	tM.stopTicker = make(chan bool, 1)
 
 	// Prepare database statements
-	tM.mapGetStatsVariableAmount = make(map[int]*sql.Stmt)
 	tM.mapSetServerStatsVariableAmount = make(map[int]*sql.Stmt)
 	tM.mapSetServerPlayerStatsVariableAmount = make(map[int]*sql.Stmt)
 	tM.prepareStatements()
 
+	tM.sessions = new(auth.Sessions)
+	tM.sessions.New(redis)
+	tM.tickets = new(auth.Tickets)
+	tM.tickets.New(redis)
+	tM.permissions = new(auth.Permissions)
+	tM.permissions.New(db, redis)
+	tM.bans = new(moderation.Bans)
+	tM.bans.New(db, redis)
+	tM.serverBans = new(moderation.ServerBans)
+	tM.serverBans.New(db)
+	tM.lobbies = new(matchmaking.Lobbies)
+	tM.lobbies.New(db)
+
+	tM.registerBusHandlers()
+
+	// Disconnect clients whose session got revoked, no matter which shard revoked it
+	go func() {
+		for lkey := range tM.sessions.Revocations() {
+			tM.disconnectSession(lkey)
+		}
+	}()
+
+	// Banned players and servers are disconnected right away
+	go func() {
+		for ban := range tM.bans.Issued() {
+			tM.disconnectBanned(ban)
+		}
+	}()
+
+	// Admins talk to everyone connected, no matter which shard they used
+	go tM.announceToClients()
+
 	// Collect metrics every 10 seconds
 	tM.batchTicker = time.NewTicker(time.Second * 1)
 	go func() {
@@ -128,6 +174,9 @@ func (tM *TheaterManager) New(name string, port string, db *sql.DB, redis *redis
 
 	//tM.redis.Set(COUNTER_GID_KEY, 0, 0)
 
+	tM.startReaper()
+	tM.startSync()
+
 	go tM.run()
 }
 
@@ -177,93 +226,82 @@ func (tM *TheaterManager) prepareStatements() {
 		log.Fatalln("Error preparing stmtAddGame.", err.Error())
 	}
 
-	tM.stmtGameIncreaseJoining, err = tM.db.Prepare(
-		"UPDATE games SET " +
-			"	players_joining = players_joining + 1," +
+	tM.stmtUpdateGame, err = tM.db.Prepare(
+		"UPDATE games SET" +
 			"	updated_at = NOW()" +
 			"WHERE gid = ? AND shard = ?")
 	if err != nil {
-		log.Fatalln("Error preparing stmtGameIncreaseJoining.", err.Error())
+		log.Fatalln("Error preparing stmtUpdateGame.", err.Error())
 	}
 
-	tM.stmtGameIncreaseTeam1, err = tM.db.Prepare(
-		"UPDATE games SET " +
-			"	players_connected = players_connected + 1," +
-			"	players_joining = players_joining - 1," +
-			"	team_1 = team_1 + 1," +
-			"	updated_at = NOW()" +
-			"WHERE gid = ? AND shard = ?")
+	tM.stmtSyncGame, err = tM.db.Prepare(
+		"UPDATE games SET" +
+			"	players_connected = ?," +
+			"	players_joining = ?," +
+			"	players_max = ?," +
+			"	team_1 = ?," +
+			"	team_2 = ?," +
+			"	status_mapname = COALESCE(NULLIF(?, ''), status_mapname)" +
+			"	WHERE gid = ? AND shard = ?")
 	if err != nil {
-		log.Fatalln("Error preparing stmtGameIncreaseTeam1.", err.Error())
+		log.Fatalln("Error preparing stmtSyncGame.", err.Error())
 	}
 
-	tM.stmtGameIncreaseTeam2, err = tM.db.Prepare(
-		"UPDATE games SET " +
-			"	players_connected = players_connected + 1," +
-			"	players_joining = players_joining - 1," +
-			"	team_2 = team_2 + 1," +
-			"	updated_at = NOW()" +
-			"WHERE gid = ? AND shard = ?")
+	tM.stmtGetGamesOfShards, err = tM.db.Prepare(
+		"SELECT gid, shard FROM games")
 	if err != nil {
-		log.Fatalln("Error preparing stmtGameIncreaseTeam2.", err.Error())
+		log.Fatalln("Error preparing stmtGetGamesOfShards.", err.Error())
 	}
 
-	tM.stmtGameDecreaseTeam1, err = tM.db.Prepare(
-		"UPDATE games SET " +
-			"	players_connected = players_connected - 1," +
-			"	team_1 = team_1 - 1," +
-			"	updated_at = NOW()" +
-			"WHERE gid = ? AND shard = ?")
+	tM.stmtDeleteOrphanedServerStats, err = tM.db.Prepare(
+		"DELETE FROM game_server_stats" +
+			"	WHERE gid NOT IN (SELECT gid FROM games)")
 	if err != nil {
-		log.Fatalln("Error preparing stmtGameDecreaseTeam1.", err.Error())
+		log.Fatalln("Error preparing stmtDeleteOrphanedServerStats.", err.Error())
 	}
 
-	tM.stmtGameDecreaseTeam2, err = tM.db.Prepare(
-		"UPDATE games SET " +
-			"	players_connected = players_connected - 1," +
-			"	team_2 = team_2 - 1," +
-			"	updated_at = NOW()" +
-			"WHERE gid = ? AND shard = ?")
+	tM.stmtAddGamePlayer, err = tM.db.Prepare(
+		"INSERT INTO game_players" +
+			"	(gid, shard, pid, hero_name, team, joined_at)" +
+			"	VALUES (?, ?, ?, ?, ?, FROM_UNIXTIME(?))" +
+			"	ON DUPLICATE KEY UPDATE" +
+			"	hero_name=VALUES(hero_name)," +
+			"	team=VALUES(team)," +
+			"	joined_at=VALUES(joined_at)")
 	if err != nil {
-		log.Fatalln("Error preparing stmtGameDecreaseTeam2.", err.Error())
+		log.Fatalln("Error preparing stmtAddGamePlayer.", err.Error())
 	}
 
-	tM.stmtUpdateGame, err = tM.db.Prepare(
-		"UPDATE games SET" +
-			"	updated_at = NOW()" +
-			"WHERE gid = ? AND shard = ?")
+	tM.stmtDeleteGamePlayer, err = tM.db.Prepare(
+		"DELETE FROM game_players WHERE gid = ? AND shard = ? AND pid = ?")
 	if err != nil {
-		log.Fatalln("Error preparing stmtUpdateGame.", err.Error())
+		log.Fatalln("Error preparing stmtDeleteGamePlayer.", err.Error())
 	}
-}
-
-func (tM *TheaterManager) getStatsStatement(statsAmount int) *sql.Stmt {
-	var err error
 
-	// Check if we already have a statement prepared for that amount of stats
-	if statement, ok := tM.mapGetStatsVariableAmount[statsAmount]; ok {
-		return statement
+	tM.stmtDeleteGamePlayers, err = tM.db.Prepare(
+		"DELETE FROM game_players WHERE gid = ? AND shard = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtDeleteGamePlayers.", err.Error())
 	}
 
-	var query string
-	for i := 1; i < statsAmount; i++ {
-		query += "?, "
+	tM.stmtDeleteServerPlayerStats, err = tM.db.Prepare(
+		"DELETE FROM game_server_player_stats WHERE gid = ? AND pid = ?")
+	if err != nil {
+		log.Fatalln("Error preparing stmtDeleteServerPlayerStats.", err.Error())
 	}
 
-	sql := "SELECT game_heroes.user_id, game_heroes.id, game_heroes.heroName, game_stats.statsKey, game_stats.statsValue" +
-		"	FROM game_heroes" +
-		"	LEFT JOIN game_stats" +
-		"		ON game_stats.user_id = game_heroes.user_id" +
-		"		AND game_stats.heroID = game_heroes.id" +
-		"	WHERE game_heroes.id=?" +
-		"		AND game_stats.statsKey IN (" + query + "?)"
-
-	tM.mapGetStatsVariableAmount[statsAmount], err = tM.db.Prepare(sql)
+	tM.stmtDeleteServerPlayerStatsByGID, err = tM.db.Prepare(
+		"DELETE FROM game_server_player_stats WHERE gid = ?")
 	if err != nil {
-		log.Fatalln("Error preparing stmtGetStatsVariableAmount with "+sql+" query.", err.Error())
+		log.Fatalln("Error preparing stmtDeleteServerPlayerStatsByGID.", err.Error())
 	}
 
-	return tM.mapGetStatsVariableAmount[statsAmount]
+	tM.stmtDeleteOrphanedGamePlayers, err = tM.db.Prepare(
+		"DELETE FROM game_players" +
+			"	WHERE (gid, shard) NOT IN (SELECT gid, shard FROM games)")
+	if err != nil {
+		log.Fatalln("Error preparing stmtDeleteOrphanedGamePlayers.", err.Error())
+	}
 }
 
 func (tM *TheaterManager) setServerStatsStatement(statsAmount int) *sql.Stmt {
@@ -323,9 +361,12 @@ func (tM *TheaterManager) setServerPlayerStatsStatement(statsAmount int) *sql.St
 }
 
 func (tM *TheaterManager) closeStatements() {
-	// Close the dynamic lenght getStats statements
-	for index := range tM.mapGetStatsVariableAmount {
-		tM.mapGetStatsVariableAmount[index].Close()
+	// Close the dynamic lenght setServerStats statements
+	for index := range tM.mapSetServerStatsVariableAmount {
+		tM.mapSetServerStatsVariableAmount[index].Close()
+	}
+	for index := range tM.mapSetServerPlayerStatsVariableAmount {
+		tM.mapSetServerPlayerStatsVariableAmount[index].Close()
 	}
 }
 
@@ -333,7 +374,7 @@ func (tM *TheaterManager) collectMetrics() {
 	// Create a point and add to batch
 	tags := map[string]string{"clients": "clients-total", "server": "theaterManager-" + tM.name}
 	fields := map[string]interface{}{
-		"clients": len(tM.socket.Clients),
+		"clients": len(tM.socket.GetClients()),
 	}
 
 	tM.iDB.AddMetric("clients_total", tags, fields)
@@ -364,6 +405,8 @@ func (tM *TheaterManager) run() {
 				go tM.LLST(event.Data.(GameSpy.EventClientFESLCommand))
 			case event.Name == "client.command.GDAT":
 				go tM.GDAT(event.Data.(GameSpy.EventClientFESLCommand))
+			case event.Name == "client.command.PDAT":
+				go tM.PDAT(event.Data.(GameSpy.EventClientFESLCommand))
 			case event.Name == "client.command.EGAM":
 				go tM.EGAM(event.Data.(GameSpy.EventClientFESLCommand))
 			case event.Name == "client.command.ECNL":
@@ -382,6 +425,8 @@ func (tM *TheaterManager) run() {
 				go tM.PENT(event.Data.(GameSpy.EventClientFESLCommand))
 			case event.Name == "client.command.PLVT":
 				go tM.PLVT(event.Data.(GameSpy.EventClientFESLCommand))
+			case event.Name == "client.command.PING":
+				go tM.PING(event.Data.(GameSpy.EventClientFESLCommand))
 			case event.Name == "client.command.UPLA":
 				go tM.UPLA(event.Data.(GameSpy.EventClientFESLCommand))
 			case event.Name == "client.close":
@@ -446,6 +491,38 @@ func (tM *TheaterManager) logAnswer(msgType string, msgContent map[string]string
 	}
 }
 
+// Theater error codes, answered in ERR when a command is refused
+const (
+	// errCodeNotAllowed - the account lacks the permission for the command
+	errCodeNotAllowed = "1"
+	// errCodeGameNotFound - the game isn't registered or its server can't be reached
+	errCodeGameNotFound = "2"
+	// errCodeJoinFailed - the game server refused the hero or didn't answer in time
+	errCodeJoinFailed = "3"
+	// errCodeWrongPassword - the game is private and the password didn't match
+	errCodeWrongPassword = "4"
+	// errCodeLobbyFull - the lobby has as many games as it may have
+	errCodeLobbyFull = "5"
+	// errCodeServerBanned - the hero is banned from the server hosting the game
+	errCodeServerBanned = "6"
+)
+
+// sendError - answers query of client with an error code instead of the usual packet, so it doesn't wait forever
+func (tM *TheaterManager) sendError(client *GameSpy.Client, query string, message map[string]string, code string) {
+	answer := make(map[string]string)
+	answer["TID"] = message["TID"]
+	answer["LID"] = message["LID"]
+	answer["GID"] = message["GID"]
+	answer["ERR"] = code
+	client.WriteFESL(query, answer, 0x0)
+	tM.logAnswer(query, answer, 0x0)
+}
+
+// hostsGame - gid is the game client created with CGAM, game servers only report about their own game
+func hostsGame(client *GameSpy.Client, gid string) bool {
+	return gid != "" && client.RedisState != nil && client.RedisState.Get("gdata:GID") == gid
+}
+
 func (tM *TheaterManager) newClient(event GameSpy.EventNewClient) {
 	if !event.Client.IsActive {
 		log.Noteln("Client left")
@@ -476,36 +553,60 @@ func (tM *TheaterManager) newClient(event GameSpy.EventNewClient) {
 func (tM *TheaterManager) close(event GameSpy.EventClientClose) {
 	log.Noteln("Client closed.")
 
+	// Queued clients give up their places
+	tM.leaveQueues(event.Client)
+
 	if event.Client.RedisState != nil {
 
 		if event.Client.RedisState.Get("gdata:GID") != "" {
+			tM.removeGame(event.Client.RedisState.Get("gdata:GID"), Shard, event.Client.RedisState.Get("serverID"))
+		}
 
-			// Delete game from db
-			_, err := tM.stmtDeleteServerStatsByGID.Exec(event.Client.RedisState.Get("gdata:GID"))
-			if err != nil {
-				log.Errorln("Failed deleting settings for  "+event.Client.RedisState.Get("gdata:GID"), err.Error())
-			}
+		event.Client.RedisState.Delete()
+	}
 
-			_, err = tM.stmtDeleteGameByGIDAndShard.Exec(event.Client.RedisState.Get("gdata:GID"), Shard)
-			if err != nil {
-				log.Errorln("Failed deleting game for "+event.Client.RedisState.Get("gdata:GID")+" and shard "+Shard, err.Error())
-			}
+	if !event.Client.State.HasLogin {
+		return
+	}
 
-			// Delete game out of matchmaking array
-			delete(matchmaking.Games, event.Client.RedisState.Get("gdata:GID"))
+}
 
-			gameServer := new(lib.RedisObject)
-			gameServer.New(tM.redis, "gdata", event.Client.RedisState.Get("gdata:GID"))
-			gameServer.Delete()
+// disconnectSession - closes every connection that authenticated with lkey
+func (tM *TheaterManager) disconnectSession(lkey string) {
+	for _, client := range tM.socket.GetClients() {
+		if !client.IsActive || client.RedisState == nil {
+			continue
 		}
 
-		event.Client.RedisState.Delete()
+		if client.RedisState.Get("lkey") == lkey {
+			log.Noteln("Disconnecting " + client.RedisState.Get("name") + ", session " + lkey + " was revoked")
+			client.Close()
+		}
+	}
+}
+
+// disconnectBanned - closes every connection covered by a freshly issued ban
+func (tM *TheaterManager) disconnectBanned(ban *moderation.Ban) {
+	for _, client := range tM.socket.GetClients() {
+		if !client.IsActive || client.RedisState == nil {
+			continue
+		}
+
+		if ban.Matches(client.RedisState.Get("userID"), client.RedisState.Get("heroID"), client.RedisState.Get("serverID"), clientIP(client)) {
+			log.Noteln("Disconnecting banned " + client.RedisState.Get("name"))
+			client.State.Banned = true
+			client.Close()
+		}
 	}
+}
 
-	if !event.Client.State.HasLogin {
-		return
+func clientIP(client *GameSpy.Client) net.IP {
+	addr, ok := client.IpAddr.(*net.TCPAddr)
+	if !ok {
+		return nil
 	}
 
+	return addr.IP
 }
 
 func (tM *TheaterManager) error(event GameSpy.EventClientTLSError) {